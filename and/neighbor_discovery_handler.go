@@ -25,6 +25,7 @@ type NeighborDiscoveryEvent struct {
 	World     INeighborDiscoveryWorldBase //can be nil
 	Status    int
 	Message   string
+	Peer_name string //local name of the peer, see ReservePeerNamer. can be ""
 }
 
 type INeighborDiscoveryHandler interface {
@@ -32,14 +33,21 @@ type INeighborDiscoveryHandler interface {
 	ReserveErrorListener(listener chan<- error)
 	ReserveConnectCallback(func(address any))
 	ReserveSNBTimer(func(time.Duration, string))
+	ReservePeerNamer(func(peer_hash string) string)
 
 	OpenWorld(path string, world INeighborDiscoveryWorldBase) bool
 	CloseWorld(path string)
 	ChangeWorldPath(prev_path string, new_path string) bool
 	GetWorld(path string) (INeighborDiscoveryWorldBase, bool)
+	GetMembers(world_uuid string) []INeighborDiscoveryPeerBase //of a world we are in. nil if none
+	IsMember(world_uuid string, peer_hash string) bool
+	IsJoining(peer_hash string) bool //a join through the peer is ongoing
 
+	IdentityRotated(old_hash string, new_hash string) //called before Connected of the rotated peer
 	Connected(peer INeighborDiscoveryPeerBase)
+	Suspend(peer_hash string) bool //connection lost, reconnecting. false if the peer is in no world; see Disconnected
 	Disconnected(peer_hash string) //also connect fail.
+	CloseAll()                     //RST every session, then forget all worlds, peers and joins, without events
 	JoinConnected(local_path string, peer INeighborDiscoveryPeerBase, path string)
 	JoinAny(local_path string, address any, peer_hash string, path string)
 	OnJN(peer INeighborDiscoveryPeerBase, path string)
@@ -72,6 +80,9 @@ func (e *NeighborDiscoveryEvent) Stringify() string {
 	sb.WriteString(e.Localpath)
 	sb.WriteString(",")
 	sb.WriteString(e.Peer_hash)
+	if e.Peer_name != "" {
+		sb.WriteString("(" + e.Peer_name + ")")
+	}
 	sb.WriteString(",")
 	sb.WriteString(e.Path)
 	if e.World != nil {
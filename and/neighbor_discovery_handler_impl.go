@@ -41,14 +41,16 @@ type NeighborDiscoveryHandler struct {
 	event_listener   chan<- NeighborDiscoveryEvent
 	error_listener   chan<- error
 	connect_callback func(address any)
+	peer_namer       func(peer_hash string) string
 	snb_timer        func(time.Duration, string)
 	snb_randsrc      distuv_rand.Source
 
 	local_hash string
 
-	peers    map[string]INeighborDiscoveryPeerBase  //identity hash > peer - all connected peers
-	worlds   map[string]INeighborDiscoveryWorldBase //localpath > world - same world for different localpath is not allowed.
-	sessions map[string]*NeighborDiscoverySession   //world UUID > session - only one session for same world UUID.
+	peers     map[string]INeighborDiscoveryPeerBase  //identity hash > peer - all connected peers
+	suspended map[string]bool                        //identity hash - connection lost, still a member until Connected or Disconnected
+	worlds    map[string]INeighborDiscoveryWorldBase //localpath > world - same world for different localpath is not allowed.
+	sessions  map[string]*NeighborDiscoverySession   //world UUID > session - only one session for same world UUID.
 
 	candidate_sessions map[string]*CandidateSession //candidate join target sessions. non empty only if there is ongoing join process (previously, AC_PM)
 
@@ -61,6 +63,7 @@ func NewNeighborDiscoveryHandler(local_hash string) *NeighborDiscoveryHandler {
 	result.snb_randsrc = distuv_rand.NewSource(uint64(time.Now().UTC().UnixNano()))
 	result.local_hash = local_hash
 	result.peers = make(map[string]INeighborDiscoveryPeerBase)
+	result.suspended = make(map[string]bool)
 	result.worlds = make(map[string]INeighborDiscoveryWorldBase)
 	result.sessions = make(map[string]*NeighborDiscoverySession)
 	result.candidate_sessions = make(map[string]*CandidateSession)
@@ -78,6 +81,15 @@ func (h *NeighborDiscoveryHandler) ReserveErrorListener(listener chan<- error) {
 func (h *NeighborDiscoveryHandler) ReserveConnectCallback(connect_callback func(address any)) {
 	h.connect_callback = connect_callback
 }
+func (h *NeighborDiscoveryHandler) ReservePeerNamer(peer_namer func(peer_hash string) string) {
+	h.peer_namer = peer_namer
+}
+func (h *NeighborDiscoveryHandler) PeerName(peer_hash string) string {
+	if h.peer_namer == nil {
+		return ""
+	}
+	return h.peer_namer(peer_hash)
+}
 func (h *NeighborDiscoveryHandler) ReserveSNBTimer(snb_timer func(time.Duration, string)) {
 	h.snb_timer = snb_timer
 }
@@ -177,13 +189,68 @@ func (h *NeighborDiscoveryHandler) GetWorld(localpath string) (INeighborDiscover
 	return result, ok
 }
 
+func (h *NeighborDiscoveryHandler) GetMembers(world_uuid string) []INeighborDiscoveryPeerBase {
+	session, ok := h.sessions[world_uuid]
+	if !ok {
+		return nil
+	}
+	result := make([]INeighborDiscoveryPeerBase, 0, len(session.members))
+	for _, member := range session.members {
+		result = append(result, member)
+	}
+	return result
+}
+func (h *NeighborDiscoveryHandler) IsMember(world_uuid string, peer_hash string) bool {
+	session, ok := h.sessions[world_uuid]
+	if !ok {
+		return false
+	}
+	_, ok = session.members[peer_hash]
+	return ok
+}
+func (h *NeighborDiscoveryHandler) IsJoining(peer_hash string) bool {
+	_, ok := h.join_targets[peer_hash]
+	return ok
+}
+
+// records kept under a previous identity hash now belong to the current one.
+func (h *NeighborDiscoveryHandler) IdentityRotated(old_hash string, new_hash string) {
+	for _, session := range h.sessions {
+		peer, ok := session.CC_MR[old_hash]
+		if ok {
+			delete(session.CC_MR, old_hash)
+			session.CC_MR[new_hash] = peer
+		}
+	}
+
+	old_paths, ok := h.join_targets[old_hash]
+	if !ok {
+		return
+	}
+	delete(h.join_targets, old_hash)
+	join_paths, ok := h.join_targets[new_hash]
+	if !ok {
+		h.join_targets[new_hash] = old_paths
+		return
+	}
+	for path, localpath := range old_paths {
+		_, ok := join_paths[path]
+		if ok {
+			h.event_listener <- NeighborDiscoveryEvent{JoinExpired, localpath, old_hash, nil, path, nil, 0, "", h.PeerName(old_hash)}
+			delete(h.join_local_paths, localpath)
+			continue
+		}
+		join_paths[path] = localpath
+	}
+}
+
 func (h *NeighborDiscoveryHandler) Connected(peer INeighborDiscoveryPeerBase) {
 	//add in peers
 	peer_id_hash := peer.GetHash()
 	_, ok := h.peers[peer_id_hash]
 	if ok {
 		//error: duplicate connection
-		h.error_listener <- errors.New("duplicate connection: " + peer.GetHash())
+		h.error_listener <- errors.New("duplicate connection: " + h.PeerName(peer_id_hash) + " (" + peer_id_hash + ")")
 		return
 	}
 	if peer_id_hash == h.local_hash {
@@ -192,6 +259,30 @@ func (h *NeighborDiscoveryHandler) Connected(peer INeighborDiscoveryPeerBase) {
 	}
 	h.peers[peer_id_hash] = peer
 
+	//a suspended peer came back. membership is kept without events; the sessions resynchronize:
+	//MEM re-adds us where the peer dropped us, SNB of all members makes it CRR for those it missed.
+	if h.suspended[peer_id_hash] {
+		delete(h.suspended, peer_id_hash)
+		for _, session := range h.sessions {
+			_, ok := session.members[peer_id_hash]
+			if !ok {
+				continue
+			}
+			session.members[peer_id_hash] = peer
+			peer.SendMEM(session.world)
+
+			members_hash := make([]string, 0, len(session.members))
+			for member_hash := range session.members {
+				if member_hash != peer_id_hash {
+					members_hash = append(members_hash, member_hash)
+				}
+			}
+			if len(members_hash) != 0 {
+				peer.SendSNB(session.world, members_hash)
+			}
+		}
+	}
+
 	//look for all sessions, CC_MR to member.
 	for _, session := range h.sessions {
 		_, ok := session.CC_MR[peer_id_hash]
@@ -201,7 +292,7 @@ func (h *NeighborDiscoveryHandler) Connected(peer INeighborDiscoveryPeerBase) {
 			session.members[peer_id_hash] = peer
 			session.snb_targets[peer_id_hash] = 3
 			h.SetSNBTimer(session)
-			h.event_listener <- NeighborDiscoveryEvent{PeerJoin, "", peer.GetHash(), peer, "", session.world, 0, ""}
+			h.event_listener <- NeighborDiscoveryEvent{PeerJoin, "", peer.GetHash(), peer, "", session.world, 0, "", h.PeerName(peer.GetHash())}
 		}
 	}
 
@@ -213,16 +304,43 @@ func (h *NeighborDiscoveryHandler) Connected(peer INeighborDiscoveryPeerBase) {
 		}
 	}
 }
+
+// keeps the peer in the worlds it is a member of, without events, while it reconnects.
+// false if it is a member of none; call Disconnected instead.
+func (h *NeighborDiscoveryHandler) Suspend(peer_hash string) bool {
+	is_member := false
+	for _, session := range h.sessions {
+		if _, ok := session.members[peer_hash]; ok {
+			is_member = true
+			break
+		}
+	}
+	if !is_member {
+		return false
+	}
+
+	delete(h.peers, peer_hash)
+	h.suspended[peer_hash] = true
+	for _, session := range h.sessions {
+		delete(session.CC_MR, peer_hash)
+	}
+	for _, session := range h.candidate_sessions {
+		delete(session.members, peer_hash)
+	}
+	h._ExpireJoinTargets(peer_hash)
+	return true
+}
 func (h *NeighborDiscoveryHandler) Disconnected(peer_hash string) {
 	//remove from peers
 	delete(h.peers, peer_hash)
+	delete(h.suspended, peer_hash)
 
 	//look for all sessions, remove
 	for _, session := range h.sessions {
 		peer, ok := session.members[peer_hash]
 		if ok {
 			delete(session.members, peer_hash)
-			h.event_listener <- NeighborDiscoveryEvent{PeerLeave, "", peer_hash, peer, "", session.world, 0, ""}
+			h.event_listener <- NeighborDiscoveryEvent{PeerLeave, "", peer_hash, peer, "", session.world, 0, "", h.PeerName(peer_hash)}
 		}
 
 		delete(session.CC_MR, peer_hash)
@@ -237,12 +355,38 @@ func (h *NeighborDiscoveryHandler) Disconnected(peer_hash string) {
 		}
 	}
 
-	//delete from join targets
+	h._ExpireJoinTargets(peer_hash)
+}
+
+// on local shutdown. members of every session and candidate session are told to RST.
+func (h *NeighborDiscoveryHandler) CloseAll() {
+	for world_uuid, session := range h.sessions {
+		for _, member := range session.members {
+			member.SendRST(world_uuid)
+		}
+	}
+	for candidate_uuid, candidate_session := range h.candidate_sessions {
+		for _, candidate_member := range candidate_session.members {
+			candidate_member.SendRST(candidate_uuid)
+		}
+	}
+
+	h.peers = make(map[string]INeighborDiscoveryPeerBase)
+	h.suspended = make(map[string]bool)
+	h.worlds = make(map[string]INeighborDiscoveryWorldBase)
+	h.sessions = make(map[string]*NeighborDiscoverySession)
+	h.candidate_sessions = make(map[string]*CandidateSession)
+	h.join_targets = make(map[string]map[string]string)
+	h.join_local_paths = make(map[string]bool)
+}
+
+// join processes through the peer end.
+func (h *NeighborDiscoveryHandler) _ExpireJoinTargets(peer_hash string) {
 	join_target, ok := h.join_targets[peer_hash]
 	if ok {
 		delete(h.join_targets, peer_hash)
 		for path, localpath := range join_target {
-			h.event_listener <- NeighborDiscoveryEvent{JoinExpired, localpath, peer_hash, nil, path, nil, 0, ""}
+			h.event_listener <- NeighborDiscoveryEvent{JoinExpired, localpath, peer_hash, nil, path, nil, 0, "", h.PeerName(peer_hash)}
 			delete(h.join_local_paths, localpath)
 		}
 
@@ -269,7 +413,7 @@ func (h *NeighborDiscoveryHandler) _AppendJoinInfo(localpath string, peer_hash s
 
 	_, ok = join_paths[path]
 	if ok {
-		h.event_listener <- NeighborDiscoveryEvent{JoinExpired, localpath, peer_hash, nil, path, nil, 0, ""}
+		h.event_listener <- NeighborDiscoveryEvent{JoinExpired, localpath, peer_hash, nil, path, nil, 0, "", h.PeerName(peer_hash)}
 		h.error_listener <- errors.New("duplicate join call: " + peer_hash + path)
 		return
 	}
@@ -278,7 +422,7 @@ func (h *NeighborDiscoveryHandler) _AppendJoinInfo(localpath string, peer_hash s
 }
 func (h *NeighborDiscoveryHandler) JoinConnected(localpath string, peer INeighborDiscoveryPeerBase, path string) {
 	if h.IsLocalPathOccupied(localpath) {
-		h.event_listener <- NeighborDiscoveryEvent{JoinExpired, localpath, peer.GetHash(), peer, path, nil, 0, ""}
+		h.event_listener <- NeighborDiscoveryEvent{JoinExpired, localpath, peer.GetHash(), peer, path, nil, 0, "", h.PeerName(peer.GetHash())}
 		h.error_listener <- errors.New("local path collision in JoinAny: " + localpath)
 		return
 	}
@@ -293,7 +437,7 @@ func (h *NeighborDiscoveryHandler) JoinConnected(localpath string, peer INeighbo
 }
 func (h *NeighborDiscoveryHandler) JoinAny(localpath string, address any, peer_hash string, path string) {
 	if h.IsLocalPathOccupied(localpath) {
-		h.event_listener <- NeighborDiscoveryEvent{JoinExpired, localpath, peer_hash, nil, path, nil, 0, ""}
+		h.event_listener <- NeighborDiscoveryEvent{JoinExpired, localpath, peer_hash, nil, path, nil, 0, "", h.PeerName(peer_hash)}
 		h.error_listener <- errors.New("local path collision in JoinAny: " + localpath)
 		return
 	}
@@ -335,7 +479,7 @@ func (h *NeighborDiscoveryHandler) OnJN(peer INeighborDiscoveryPeerBase, path st
 
 	session.members[peer.GetHash()] = peer
 	peer.SendJOK(path, world)
-	h.event_listener <- NeighborDiscoveryEvent{PeerJoin, "", peer.GetHash(), peer, "", session.world, 0, ""}
+	h.event_listener <- NeighborDiscoveryEvent{PeerJoin, "", peer.GetHash(), peer, "", session.world, 0, "", h.PeerName(peer.GetHash())}
 }
 func (h *NeighborDiscoveryHandler) OnJOK(peer INeighborDiscoveryPeerBase, path string, world INeighborDiscoveryWorldBase) {
 	//check for ongoing join processes
@@ -357,10 +501,10 @@ func (h *NeighborDiscoveryHandler) OnJOK(peer INeighborDiscoveryPeerBase, path s
 		return
 	}
 
-	h.event_listener <- NeighborDiscoveryEvent{JoinSuccess, localpath, peer.GetHash(), peer, path, world, 200, "OK"}
+	h.event_listener <- NeighborDiscoveryEvent{JoinSuccess, localpath, peer.GetHash(), peer, path, world, 200, "OK", h.PeerName(peer.GetHash())}
 	session.members[peer.GetHash()] = peer
 	for _, peer := range session.members {
-		h.event_listener <- NeighborDiscoveryEvent{PeerJoin, "", peer.GetHash(), peer, "", world, 0, ""}
+		h.event_listener <- NeighborDiscoveryEvent{PeerJoin, "", peer.GetHash(), peer, "", world, 0, "", h.PeerName(peer.GetHash())}
 	}
 
 	delete(join_paths, path)
@@ -389,7 +533,7 @@ func (h *NeighborDiscoveryHandler) OnJDN(peer INeighborDiscoveryPeerBase, path s
 		return
 	}
 
-	h.event_listener <- NeighborDiscoveryEvent{JoinDenied, localpath, peer.GetHash(), peer, path, nil, status, message}
+	h.event_listener <- NeighborDiscoveryEvent{JoinDenied, localpath, peer.GetHash(), peer, path, nil, status, message, h.PeerName(peer.GetHash())}
 
 	delete(join_paths, path)
 	if len(join_paths) == 0 {
@@ -490,7 +634,7 @@ func (h *NeighborDiscoveryHandler) OnMEM(peer INeighborDiscoveryPeerBase, world_
 	}
 
 	session.members[peer.GetHash()] = peer
-	h.event_listener <- NeighborDiscoveryEvent{PeerJoin, "", peer.GetHash(), peer, "", session.world, 0, ""}
+	h.event_listener <- NeighborDiscoveryEvent{PeerJoin, "", peer.GetHash(), peer, "", session.world, 0, "", h.PeerName(peer.GetHash())}
 }
 func (h *NeighborDiscoveryHandler) OnSNB(peer INeighborDiscoveryPeerBase, world_uuid string, members_hash []string) {
 	session, candidate := h.ValidateSessionMember(peer, world_uuid)
@@ -543,6 +687,7 @@ func (h *NeighborDiscoveryHandler) OnRST(peer INeighborDiscoveryPeerBase, world_
 	if session != nil {
 		delete(session.members, peer.GetHash())
 		delete(session.snb_targets, peer.GetHash())
+		h.event_listener <- NeighborDiscoveryEvent{PeerLeave, "", peer.GetHash(), peer, "", session.world, 0, "", h.PeerName(peer.GetHash())}
 	}
 	if candidate != nil {
 		delete(candidate.members, peer.GetHash())
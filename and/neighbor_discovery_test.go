@@ -323,6 +323,27 @@ func TestJoinFail2(t *testing.T) {
 	}
 }
 
+func TestJoinRotated(t *testing.T) {
+	local_host := NewLocalHost()
+	ndh := local_host.ndh
+
+	//the join target rotated its identity after we learned its hash
+	join_target := NewNeighborDiscoveryTestPeer()
+	old_hash := "peer-uid-rotated-" + join_target.GetHash()
+	join_world := NewWorld_Testimpl()
+	ndh.JoinAny("/", "*", old_hash, "/target")
+	ndh.IdentityRotated(old_hash, join_target.GetHash())
+	ndh.Connected(join_target)
+	if msg := <-join_target._log; msg != "AHMP/1.0 JN /target" {
+		t.Fatal("join not sent to rotated peer: " + msg)
+	}
+	ndh.OnJOK(join_target, "/target", join_world)
+
+	time.Sleep(time.Second)
+	for len(local_host.local_peer._log) > 0 {
+		fmt.Println(<-local_host.local_peer._log)
+	}
+}
 func TestExpiredJoin1(t *testing.T) {
 	local_host := NewLocalHost()
 	ndh := local_host.ndh
@@ -411,3 +432,54 @@ func TestAccept(t *testing.T) {
 		fmt.Println(<-peer_target._log)
 	}
 }
+
+func TestSuspend(t *testing.T) {
+	local_host := NewLocalHost()
+	ndh := local_host.ndh
+
+	world := NewWorld_Testimpl()
+	ndh.OpenWorld("/home", world)
+	member1 := NewNeighborDiscoveryTestPeer()
+	member2 := NewNeighborDiscoveryTestPeer()
+	ndh.Connected(member1)
+	ndh.OnJN(member1, "/home")
+	ndh.Connected(member2)
+	ndh.OnJN(member2, "/home")
+
+	time.Sleep(time.Millisecond * 100)
+	for _, log := range []chan string{local_host.local_peer._log, member1._log, member2._log} {
+		for len(log) > 0 {
+			<-log
+		}
+	}
+
+	//member1 drops and comes back: no PeerLeave/PeerJoin, and the session resynchronizes
+	if !ndh.Suspend(member1.GetHash()) {
+		t.Fatal("member not suspended")
+	}
+	ndh.Connected(member1)
+	if msg := <-member1._log; msg != "AHMP/1.0 MEM "+world.GetUUID() {
+		t.Fatal("MEM not sent on resume: " + msg)
+	}
+	if msg := <-member1._log; !strings.HasSuffix(msg, "["+member2.GetHash()+"]") {
+		t.Fatal("SNB not sent on resume: " + msg)
+	}
+	time.Sleep(time.Millisecond * 100)
+	if len(local_host.local_peer._log) != 0 {
+		t.Fatal("unexpected event on resume: " + <-local_host.local_peer._log)
+	}
+
+	//a peer in no world is not kept
+	stranger := NewNeighborDiscoveryTestPeer()
+	ndh.Connected(stranger)
+	if ndh.Suspend(stranger.GetHash()) {
+		t.Fatal("non-member suspended")
+	}
+
+	//giving up on a suspended peer is a normal leave
+	ndh.Suspend(member2.GetHash())
+	ndh.Disconnected(member2.GetHash())
+	if msg := <-local_host.local_peer._log; !strings.HasPrefix(msg, "PeerLeave") {
+		t.Fatal("no PeerLeave after giving up: " + msg)
+	}
+}
@@ -8,6 +8,9 @@ import (
 	"github.com/quic-go/quic-go"
 )
 
+// multi-endpoint addresses in JNI and IDA can be long.
+const ahmp_max_line_length = 4096
+
 type AHMPError struct {
 	msg string
 }
@@ -31,6 +34,23 @@ type AHMPRaw_ID struct {
 	pubkey []byte
 }
 
+type AHMPRaw_IDC struct {
+	nonce []byte //hex
+}
+
+type AHMPRaw_IDS struct {
+	hash      []byte
+	signature []byte
+}
+
+type AHMPRaw_IDO struct {
+	address []byte //how the sender sees the receiver, ip:port
+}
+
+type AHMPRaw_IDA struct {
+	address []byte //advertised abyss address
+}
+
 type AHMPRaw_JN struct {
 	path []byte
 }
@@ -65,10 +85,18 @@ type AHMPRaw_CRR struct {
 	missing_hash []byte
 }
 
+type AHMPRaw_PCH struct {
+	world_uuid []byte //world the sender introduces the peer in
+	address    []byte //peer that is about to dial us
+}
+
 type AHMPRaw_RST struct {
 	world_uuid []byte
 }
 
+// the last message on a duplicate session; see Peer.TryAddSession.
+type AHMPRaw_DUP struct{}
+
 type AHMPParser struct {
 	buffer bytes.Buffer
 }
@@ -77,9 +105,15 @@ type quicReader struct {
 	stream quic.Stream
 }
 
+// one stream read per bytes.Buffer.ReadFrom call. the AHMP stream never ends while the peer is up,
+// so its end is reported as an error; ReadFrom would swallow io.EOF.
+// the last bytes may come with io.EOF; they are parsed first, and the next read reports the end.
 func (r quicReader) Read(p []byte) (int, error) {
 	n, err := r.stream.Read(p)
-	if err != nil {
+	if err == io.EOF && n == 0 {
+		return n, io.ErrUnexpectedEOF
+	}
+	if err != nil && err != io.EOF {
 		return n, err
 	}
 	return n, io.EOF
@@ -106,21 +140,18 @@ func (p *AHMPParser) Read(stream quic.Stream) (any, error) {
 	reader := quicReader{stream: stream}
 	GetLine := func() ([]byte, error) {
 		for {
-			line, err := p.buffer.ReadBytes('\n')
-			if err == io.EOF {
-				if p.buffer.Len() > 128 {
-					return nil, NewAHMPError("ahmp too long line")
-				}
-				_, err = p.buffer.ReadFrom(reader)
-				if err != nil {
-					return nil, err
-				}
-				continue
+			//a partial line stays in the buffer until the rest arrives
+			if pos := bytes.IndexByte(p.buffer.Bytes(), '\n'); pos != -1 {
+				line := bytes.Clone(p.buffer.Next(pos + 1))
+				return line[:pos], nil
 			}
+			if p.buffer.Len() > ahmp_max_line_length {
+				return nil, NewAHMPError("ahmp too long line")
+			}
+			_, err := p.buffer.ReadFrom(reader)
 			if err != nil {
 				return nil, err
 			}
-			return line[:len(line)-1], nil
 		}
 	}
 	GetBody := func(content_length int) ([]byte, error) {
@@ -130,7 +161,7 @@ func (p *AHMPParser) Read(stream quic.Stream) (any, error) {
 				return nil, err
 			}
 		}
-		return p.buffer.Next(content_length), nil
+		return bytes.Clone(p.buffer.Next(content_length)), nil //Next() aliases the buffer, which is overwritten by later reads
 	}
 	ContentLengthHeaderOnlyBodyParse := func() ([]byte, error) {
 		headerline, err := GetLine()
@@ -173,11 +204,14 @@ func (p *AHMPParser) Read(stream quic.Stream) (any, error) {
 	}
 
 	pos := bytes.IndexByte(line, ' ')
-	if !bytes.Equal(line[:pos], []byte("AHMP/1.0")) {
-		return nil, NewAHMPError("unknown AHMP subprotocol: " + string(line[:pos]))
+	if pos == -1 || !bytes.Equal(line[:pos], []byte("AHMP/1.0")) {
+		return nil, NewAHMPError("unknown AHMP subprotocol: " + string(line))
 	}
 	line = line[pos+1:]
 
+	if string(line) == "DUP" { //the only method without arguments
+		return AHMPRaw_DUP{}, NoBodyFinish()
+	}
 	pos = bytes.IndexByte(line, ' ')
 	if pos == -1 {
 		return nil, NewAHMPError("unknown AHMP method: " + string(line))
@@ -192,6 +226,17 @@ func (p *AHMPParser) Read(stream quic.Stream) (any, error) {
 		parsed.name = args
 		parsed.pubkey, err = ContentLengthHeaderOnlyBodyParse()
 		return parsed, err
+	case "IDC":
+		return AHMPRaw_IDC{nonce: args}, NoBodyFinish()
+	case "IDS":
+		var parsed AHMPRaw_IDS
+		parsed.hash = args
+		parsed.signature, err = ContentLengthHeaderOnlyBodyParse()
+		return parsed, err
+	case "IDA":
+		return AHMPRaw_IDA{address: args}, NoBodyFinish()
+	case "IDO":
+		return AHMPRaw_IDO{address: args}, NoBodyFinish()
 	case "JN":
 		return AHMPRaw_JN{path: args}, NoBodyFinish()
 	case "JOK":
@@ -232,6 +277,13 @@ func (p *AHMPParser) Read(stream quic.Stream) (any, error) {
 			return parsed, NewAHMPError("malformed CRR message")
 		}
 		return parsed, NoBodyFinish()
+	case "PCH":
+		var parsed AHMPRaw_PCH
+		parsed.world_uuid, parsed.address, ok = _Split2(args)
+		if !ok {
+			return parsed, NewAHMPError("malformed PCH message")
+		}
+		return parsed, NoBodyFinish()
 	case "RST":
 		return AHMPRaw_RST{world_uuid: args}, NoBodyFinish()
 	default:
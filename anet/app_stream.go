@@ -0,0 +1,90 @@
+package anet
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/quic-go/quic-go"
+)
+
+// application streams: "<protocol>\n" then the protocol's own bytes, in both directions.
+// protocol names starting with "abyss-" are ours (see relay.go).
+const reserved_protocol_prefix = "abyss-"
+const max_protocol_len = 64
+
+// serves one incoming stream of the protocol. the stream is the handler's to close.
+type StreamHandler func(peer *Peer, stream quic.Stream)
+
+type streamHandlers struct {
+	mtx      sync.Mutex
+	handlers map[string]StreamHandler
+}
+
+func newStreamHandlers() *streamHandlers {
+	result := new(streamHandlers)
+	result.handlers = make(map[string]StreamHandler)
+	return result
+}
+
+func checkProtocolName(protocol string) error {
+	if protocol == "" || len(protocol) > max_protocol_len || strings.ContainsAny(protocol, " \r\n") {
+		return errors.New("invalid protocol name")
+	}
+	if strings.HasPrefix(protocol, reserved_protocol_prefix) {
+		return errors.New("reserved protocol name: " + protocol)
+	}
+	return nil
+}
+
+// streams peers open with OpenStream(protocol) are passed to handler, each in its own goroutine.
+// nil handler unregisters; streams of an unregistered protocol are reset with StreamErrorUnknownProtocol.
+func (n *Networker) HandleStream(protocol string, handler StreamHandler) error {
+	if err := checkProtocolName(protocol); err != nil {
+		return err
+	}
+	n.stream_handlers.mtx.Lock()
+	defer n.stream_handlers.mtx.Unlock()
+	if handler == nil {
+		delete(n.stream_handlers.handlers, protocol)
+		return nil
+	}
+	n.stream_handlers.handlers[protocol] = handler
+	return nil
+}
+
+func (n *Networker) serveAppStream(session *Transmission, stream quic.Stream, protocol string) {
+	n.stream_handlers.mtx.Lock()
+	handler, ok := n.stream_handlers.handlers[protocol]
+	n.stream_handlers.mtx.Unlock()
+	if !ok {
+		cancelStream(stream, StreamErrorUnknownProtocol)
+		return
+	}
+	peer, err := n.GetPeerByHash(session.GetHash())
+	if err != nil {
+		cancelStream(stream, StreamErrorUnknownProtocol)
+		return
+	}
+	handler(peer, stream)
+}
+
+// a new stream to the peer for an application protocol. blocks while the peer's stream limit is reached.
+// if the peer has no handler for the protocol, the stream is reset with StreamErrorUnknownProtocol.
+func (p *Peer) OpenStream(ctx context.Context, protocol string) (quic.Stream, error) {
+	if err := checkProtocolName(protocol); err != nil {
+		return nil, err
+	}
+	session := p.session()
+	stream, err := session.connection.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	session.counters.streams_opened.Add(1)
+	if err := writeStreamHeader(stream, protocol, ""); err != nil {
+		cancelStream(stream, StreamErrorUnknownProtocol)
+		return nil, err
+	}
+	return stream, nil
+}
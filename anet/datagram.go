@@ -0,0 +1,172 @@
+package anet
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// datagram: kind(1) | world UUID(16) | payload. unreliable and unordered; a lost one is not resent.
+// the payload must fit a single packet, about 1100 bytes; larger ones fail to send.
+const datagram_kind_world byte = 1
+const datagram_header_size = 17
+const datagram_queue_len = 64
+
+// an unreliable message from a member of a world.
+type WorldDatagram struct {
+	Peer_hash string
+	Payload   []byte
+}
+
+// a datagram that could not be sent to a member. Err is a *quic.DatagramTooLargeError when the
+// payload does not fit the member's session, or the error of the closed session.
+type WorldDatagramError struct {
+	Peer_hash string
+	Err       error
+}
+
+func (e *WorldDatagramError) Error() string {
+	return "datagram to " + e.Peer_hash + ": " + e.Err.Error()
+}
+func (e *WorldDatagramError) Unwrap() error {
+	return e.Err
+}
+
+type datagramState struct {
+	mtx      sync.Mutex
+	channels map[string]chan WorldDatagram //world UUID > subscription
+}
+
+func newDatagramState() *datagramState {
+	result := new(datagramState)
+	result.channels = make(map[string]chan WorldDatagram)
+	return result
+}
+
+// datagrams members send us in the world. delivered while the channel has room, dropped otherwise.
+// repeated calls return the same channel until CloseWorldDatagrams.
+func (n *Networker) WorldDatagrams(world_uuid string) <-chan WorldDatagram {
+	n.datagrams.mtx.Lock()
+	defer n.datagrams.mtx.Unlock()
+	ch, ok := n.datagrams.channels[world_uuid]
+	if !ok {
+		ch = make(chan WorldDatagram, datagram_queue_len)
+		n.datagrams.channels[world_uuid] = ch
+	}
+	return ch
+}
+
+func (n *Networker) isSubscribed(world_uuid string) bool {
+	n.datagrams.mtx.Lock()
+	defer n.datagrams.mtx.Unlock()
+	_, ok := n.datagrams.channels[world_uuid]
+	return ok
+}
+
+// closes the channel; later datagrams for the world are dropped.
+func (n *Networker) CloseWorldDatagrams(world_uuid string) {
+	n.datagrams.mtx.Lock()
+	defer n.datagrams.mtx.Unlock()
+	if ch, ok := n.datagrams.channels[world_uuid]; ok {
+		close(ch)
+		delete(n.datagrams.channels, world_uuid)
+	}
+}
+
+func makeWorldDatagram(world_uuid string, payload []byte) ([]byte, error) {
+	id, err := uuid.Parse(world_uuid)
+	if err != nil {
+		return nil, err
+	}
+	packet := make([]byte, 0, datagram_header_size+len(payload))
+	packet = append(packet, datagram_kind_world)
+	packet = append(packet, id[:]...)
+	return append(packet, payload...), nil
+}
+
+// to one member of the world. a send failure is a *WorldDatagramError.
+func (n *Networker) SendWorldDatagram(world_uuid string, peer_hash string, payload []byte) error {
+	packet, err := makeWorldDatagram(world_uuid, payload)
+	if err != nil {
+		return err
+	}
+	n.ndh_lock.Lock()
+	is_member := n.ndh.IsMember(world_uuid, peer_hash)
+	n.ndh_lock.Unlock()
+	if !is_member {
+		return errors.New("not a member of the world")
+	}
+	peer, err := n.GetPeerByHash(peer_hash)
+	if err != nil {
+		return err
+	}
+	return sendWorldDatagram(peer, packet)
+}
+
+func sendWorldDatagram(peer *Peer, packet []byte) error {
+	if err := peer.session().connection.SendDatagram(packet); err != nil {
+		return &WorldDatagramError{peer.GetHash(), err}
+	}
+	return nil
+}
+
+// to every member of the world. a member that fails does not stop the others;
+// the failures are joined, one *WorldDatagramError per member.
+func (n *Networker) BroadcastWorldDatagram(world_uuid string, payload []byte) error {
+	packet, err := makeWorldDatagram(world_uuid, payload)
+	if err != nil {
+		return err
+	}
+	n.ndh_lock.Lock()
+	members := n.ndh.GetMembers(world_uuid)
+	n.ndh_lock.Unlock()
+
+	var errs []error
+	for _, member := range members {
+		peer, ok := member.(*Peer)
+		if !ok {
+			continue
+		}
+		if err := sendWorldDatagram(peer, packet); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// delivers the datagrams of a session until it closes. only members of the world are heard.
+// datagrams of worlds nobody subscribed to are dropped before the membership check.
+func (n *Networker) serveDatagrams(session *Transmission) {
+	for {
+		packet, err := session.connection.ReceiveDatagram(context.Background())
+		if err != nil {
+			return
+		}
+		if len(packet) < datagram_header_size || packet[0] != datagram_kind_world {
+			continue
+		}
+		world_uuid := uuid.UUID(packet[1:datagram_header_size]).String()
+		peer_hash := session.GetHash()
+		if !n.isSubscribed(world_uuid) {
+			continue
+		}
+
+		n.ndh_lock.Lock()
+		is_member := n.ndh.IsMember(world_uuid, peer_hash)
+		n.ndh_lock.Unlock()
+		if !is_member {
+			continue
+		}
+
+		n.datagrams.mtx.Lock()
+		if ch, ok := n.datagrams.channels[world_uuid]; ok {
+			select {
+			case ch <- WorldDatagram{peer_hash, packet[datagram_header_size:]}:
+			default:
+			}
+		}
+		n.datagrams.mtx.Unlock()
+	}
+}
@@ -0,0 +1,191 @@
+package anet
+
+import (
+	"abyss/atype"
+	"crypto"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"math/big"
+	"slices"
+	"time"
+)
+
+// private-use OID for the abyss identity extension.
+// the extension carries the identity (public key pem + name) the certificate key belongs to,
+// so that the peer can recompute the identity hash during the TLS handshake.
+// it also carries the rotation history, so a peer dialing a previous hash can accept the current one.
+var identity_extension_oid = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 59193, 1, 1}
+
+type identityExtension struct {
+	Name      string `asn1:"utf8"`
+	Publickey []byte
+	Rotations [][]byte `asn1:"optional,omitempty"` //atype.EncodeAbyssRotation, oldest first
+}
+
+// self-signed certificate, signed by the identity key itself.
+func newIdentityCertificate(local_private_identity atype.AbyssPrivateIdentity) (tls.Certificate, error) {
+	local_identity := local_private_identity.Identity
+	local_signer := local_private_identity.Privatekey
+
+	extension := identityExtension{Name: local_identity.Name, Publickey: local_identity.Publickey}
+	for _, rotation := range local_private_identity.Rotations {
+		encoded, err := atype.EncodeAbyssRotation(rotation)
+		if err != nil {
+			return tls.Certificate{}, err
+		}
+		extension.Rotations = append(extension.Rotations, encoded)
+	}
+	extension_value, err := asn1.Marshal(extension)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 127))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: local_identity.Hash},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour * 24 * 365),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		ExtraExtensions: []pkix.Extension{
+			{Id: identity_extension_oid, Value: extension_value},
+		},
+	}
+	derBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, local_signer.Public(), local_signer)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{
+		Certificate: [][]byte{derBytes},
+		PrivateKey:  local_signer,
+	}, nil
+}
+
+// checks that the certificate key is the key of the identity it carries, and returns the identity
+// with its verified previous hashes (oldest first).
+// TLS proves the peer holds the certificate key, so this authenticates the identity hash.
+// on resumption the certificates are the ones of the original handshake, kept in the session ticket.
+func verifyIdentityCertificate(state tls.ConnectionState) (atype.AbyssIdentity, []string, error) {
+	if len(state.PeerCertificates) == 0 {
+		return atype.AbyssIdentity{}, nil, errors.New("no peer certificate")
+	}
+	return identityFromCertificate(state.PeerCertificates[0])
+}
+
+func identityFromCertificate(cert *x509.Certificate) (atype.AbyssIdentity, []string, error) {
+	if err := cert.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature); err != nil {
+		return atype.AbyssIdentity{}, nil, err
+	}
+
+	var extension identityExtension
+	found := false
+	for _, ext := range cert.Extensions {
+		if ext.Id.Equal(identity_extension_oid) {
+			if _, err := asn1.Unmarshal(ext.Value, &extension); err != nil {
+				return atype.AbyssIdentity{}, nil, err
+			}
+			found = true
+			break
+		}
+	}
+	if !found {
+		return atype.AbyssIdentity{}, nil, errors.New("certificate without abyss identity")
+	}
+
+	identity, err := atype.MakeAbyssIdentity(extension.Publickey, extension.Name)
+	if err != nil {
+		return atype.AbyssIdentity{}, nil, err
+	}
+	publickey, ok := identity.Parsed_publickey.(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !publickey.Equal(cert.PublicKey) {
+		return atype.AbyssIdentity{}, nil, errors.New("certificate key does not match identity")
+	}
+
+	rotations := make([]atype.AbyssRotation, 0, len(extension.Rotations))
+	for _, encoded := range extension.Rotations {
+		rotation, err := atype.DecodeAbyssRotation(encoded)
+		if err != nil {
+			return atype.AbyssIdentity{}, nil, err
+		}
+		rotations = append(rotations, rotation)
+	}
+	previous_hashes, err := atype.VerifyAbyssRotationChain(rotations, identity.Hash)
+	if err != nil {
+		return atype.AbyssIdentity{}, nil, err
+	}
+	return identity, previous_hashes, nil
+}
+
+// the private key must match the identity, or every handshake fails.
+func checkIdentityKey(local_private_identity atype.AbyssPrivateIdentity) error {
+	key_check_msg := []byte("abyss key check")
+	key_check_sig, err := atype.SignAbyssMessage(local_private_identity.Privatekey, key_check_msg)
+	if err != nil {
+		return err
+	}
+	if atype.VerifyAbyssSignature(local_private_identity.Identity, key_check_msg, key_check_sig) != nil {
+		return errors.New("private key does not match identity")
+	}
+	return nil
+}
+
+// TLS configuration shared by every transport: mutual authentication with identity certificates.
+func newIdentityTLSConfig(local_private_identity atype.AbyssPrivateIdentity) (tls.Config, error) {
+	certificate, err := newIdentityCertificate(local_private_identity)
+	if err != nil {
+		return tls.Config{}, err
+	}
+	return tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		ClientAuth:   tls.RequireAnyClientCert,
+		NextProtos:   []string{"abyss"}, //TLS offers 0-RTT only for a session with a negotiated ALPN
+		//there is no CA; the peer certificate is checked against the abyss identity instead.
+		//VerifyConnection, unlike VerifyPeerCertificate, also runs on resumed sessions.
+		InsecureSkipVerify: true,
+		VerifyConnection: func(state tls.ConnectionState) error {
+			_, _, err := verifyIdentityCertificate(state)
+			return err
+		},
+	}, nil
+}
+
+// detects man-in-the-middle during the TLS handshake.
+// a peer that rotated away from the dialed hash is accepted with its current identity.
+func dialIdentityTLSConfig(base *tls.Config, expected_hash string) *tls.Config {
+	tls_conf := base.Clone()
+	tls_conf.VerifyConnection = func(state tls.ConnectionState) error {
+		identity, previous_hashes, err := verifyIdentityCertificate(state)
+		if err != nil {
+			return err
+		}
+		if identity.Hash != expected_hash && !slices.Contains(previous_hashes, expected_hash) {
+			return errors.New("certificate hash mismatch")
+		}
+		return nil
+	}
+	return tls_conf
+}
+
+// session tickets of the peers we dialed, by identity hash rather than by server name,
+// so that a peer reached at another endpoint still resumes its session.
+type identitySessionCache struct {
+	cache         tls.ClientSessionCache
+	expected_hash string
+}
+
+func (c identitySessionCache) Get(_ string) (*tls.ClientSessionState, bool) {
+	return c.cache.Get(c.expected_hash)
+}
+
+func (c identitySessionCache) Put(_ string, session *tls.ClientSessionState) {
+	c.cache.Put(c.expected_hash, session)
+}
@@ -0,0 +1,272 @@
+package anet
+
+import (
+	"abyss/atype"
+	"context"
+	"errors"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// announcement, one UDP datagram to the multicast group:
+//
+//	ABYSS-LAN/1.0 <identity hash> <listen port>
+//	<local path>
+//	...
+//
+// announcements are not authenticated; a host joined through one is still verified by its identity hash.
+const lan_announce_version = "ABYSS-LAN/1.0"
+const lan_max_packet_size = 1200
+
+type LanDiscoveryConfig struct {
+	Group     *net.UDPAddr   //IPv4 multicast group. default 239.255.65.83:1606
+	Interface *net.Interface //listen and announce on this interface. default: chosen by the system
+	Interval  time.Duration  //between announcements. default 5s
+	Expiry    time.Duration  //a host not heard from for this long is lost. default 3 intervals
+}
+
+func (c LanDiscoveryConfig) withDefaults() LanDiscoveryConfig {
+	if c.Group == nil {
+		c.Group = &net.UDPAddr{IP: net.IPv4(239, 255, 65, 83), Port: 1606}
+	}
+	if c.Interval == 0 {
+		c.Interval = time.Second * 5
+	}
+	if c.Expiry == 0 {
+		c.Expiry = c.Interval * 3
+	}
+	return c
+}
+
+type LanDiscoveryEventType int
+
+const (
+	LanHostFound   LanDiscoveryEventType = iota
+	LanHostChanged LanDiscoveryEventType = iota //address or paths changed
+	LanHostLost    LanDiscoveryEventType = iota
+)
+
+// a host announcing itself on the local network. join its worlds with JoinAny(local_path, Address, Address.Pubkey_hash, path).
+type LanHost struct {
+	Address   atype.AbyssAddress //announcement source ip and the announced port
+	Paths     []string
+	Last_seen time.Time
+}
+
+type LanDiscoveryEvent struct {
+	EventType LanDiscoveryEventType
+	Host      LanHost
+}
+
+type lanDiscovery struct {
+	config      LanDiscoveryConfig
+	local_hash  string
+	port        uint16
+	listen_conn *net.UDPConn
+	send_conn   *net.UDPConn
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mtx   sync.Mutex
+	hosts map[string]LanHost //identity hash > host
+}
+
+func makeLanAnnouncement(local_hash string, port uint16, paths []string) []byte {
+	var sb strings.Builder
+	sb.WriteString(lan_announce_version + " " + local_hash + " " + strconv.Itoa(int(port)) + "\n")
+	for _, path := range paths {
+		if sb.Len()+len(path)+1 > lan_max_packet_size {
+			break
+		}
+		sb.WriteString(path + "\n")
+	}
+	return []byte(sb.String())
+}
+
+func parseLanAnnouncement(packet []byte, source net.IP) (LanHost, bool) {
+	lines := strings.Split(strings.TrimSuffix(string(packet), "\n"), "\n")
+	header := strings.Split(lines[0], " ")
+	if len(header) != 3 || header[0] != lan_announce_version {
+		return LanHost{}, false
+	}
+	port, err := strconv.ParseUint(header[2], 10, 16)
+	if err != nil || port == 0 {
+		return LanHost{}, false
+	}
+	address, ok := atype.MakeAbyssAddress(header[1], source.String(), uint16(port), "")
+	if !ok {
+		return LanHost{}, false
+	}
+	paths := make([]string, 0, len(lines)-1)
+	for _, path := range lines[1:] {
+		if path != "" {
+			paths = append(paths, path)
+		}
+	}
+	return LanHost{Address: address, Paths: paths}, true
+}
+
+// first IPv4 address of the interface, to send multicast through it.
+func lanInterfaceIP(iface *net.Interface) (net.IP, error) {
+	if iface == nil {
+		return net.IPv4zero, nil
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.To4() != nil {
+			return ipnet.IP.To4(), nil
+		}
+	}
+	return nil, errors.New("no IPv4 address on " + iface.Name)
+}
+
+// announce our open worlds on the local network, and report the hosts announcing theirs on LanEventCh.
+func (n *Networker) StartLanDiscovery(config LanDiscoveryConfig) error {
+	n.lan_mtx.Lock()
+	defer n.lan_mtx.Unlock()
+	if n.lan != nil {
+		return errors.New("lan discovery already running")
+	}
+	listen_port, ok := n.netcore.(IListenPort)
+	if !ok {
+		return errors.New("net core is not on a network")
+	}
+
+	lan := new(lanDiscovery)
+	lan.config = config.withDefaults()
+	lan.local_hash = n.netcore.LocalIdentity().Hash
+	lan.port = listen_port.ListenPort()
+	lan.hosts = make(map[string]LanHost)
+
+	send_ip, err := lanInterfaceIP(lan.config.Interface)
+	if err != nil {
+		return err
+	}
+	lan.listen_conn, err = net.ListenMulticastUDP("udp4", lan.config.Interface, lan.config.Group)
+	if err != nil {
+		return err
+	}
+	//multicast from a socket bound to an interface address leaves through that interface
+	lan.send_conn, err = net.ListenUDP("udp4", &net.UDPAddr{IP: send_ip})
+	if err != nil {
+		lan.listen_conn.Close()
+		return err
+	}
+	lan.ctx, lan.cancel = context.WithCancel(context.Background())
+
+	lan.wg.Add(2)
+	go n.lanAnnounceLoop(lan)
+	go n.lanListenLoop(lan)
+	n.lan = lan
+	return nil
+}
+
+func (n *Networker) StopLanDiscovery() {
+	n.lan_mtx.Lock()
+	lan := n.lan
+	n.lan = nil
+	n.lan_mtx.Unlock()
+	if lan == nil {
+		return
+	}
+	lan.cancel()
+	lan.listen_conn.Close()
+	lan.send_conn.Close()
+	lan.wg.Wait()
+}
+
+// hosts currently announcing on the local network, ordered by identity hash.
+func (n *Networker) LanHosts() []LanHost {
+	n.lan_mtx.Lock()
+	lan := n.lan
+	n.lan_mtx.Unlock()
+	if lan == nil {
+		return nil
+	}
+
+	lan.mtx.Lock()
+	result := make([]LanHost, 0, len(lan.hosts))
+	for _, host := range lan.hosts {
+		result = append(result, host)
+	}
+	lan.mtx.Unlock()
+	slices.SortFunc(result, func(a LanHost, b LanHost) int {
+		return strings.Compare(a.Address.Pubkey_hash, b.Address.Pubkey_hash)
+	})
+	return result
+}
+
+func (n *Networker) lanEmit(lan *lanDiscovery, event LanDiscoveryEvent) {
+	select {
+	case n.LanEventCh <- event:
+	case <-lan.ctx.Done():
+	}
+}
+
+// announces every interval, and expires hosts not heard from.
+func (n *Networker) lanAnnounceLoop(lan *lanDiscovery) {
+	defer lan.wg.Done()
+	ticker := time.NewTicker(lan.config.Interval)
+	defer ticker.Stop()
+	for {
+		lan.send_conn.WriteToUDP(makeLanAnnouncement(lan.local_hash, lan.port, n.openPaths()), lan.config.Group)
+
+		select {
+		case <-ticker.C:
+		case <-lan.ctx.Done():
+			return
+		}
+
+		var lost []LanHost
+		lan.mtx.Lock()
+		for hash, host := range lan.hosts {
+			if time.Since(host.Last_seen) > lan.config.Expiry {
+				delete(lan.hosts, hash)
+				lost = append(lost, host)
+			}
+		}
+		lan.mtx.Unlock()
+		for _, host := range lost {
+			n.lanEmit(lan, LanDiscoveryEvent{LanHostLost, host})
+		}
+	}
+}
+
+func (n *Networker) lanListenLoop(lan *lanDiscovery) {
+	defer lan.wg.Done()
+	buf := make([]byte, lan_max_packet_size)
+	for {
+		size, source, err := lan.listen_conn.ReadFromUDP(buf)
+		if err != nil {
+			if lan.ctx.Err() != nil {
+				return
+			}
+			continue
+		}
+		host, ok := parseLanAnnouncement(buf[:size], source.IP)
+		if !ok || host.Address.Pubkey_hash == lan.local_hash {
+			continue
+		}
+		host.Last_seen = time.Now()
+
+		lan.mtx.Lock()
+		previous, known := lan.hosts[host.Address.Pubkey_hash]
+		lan.hosts[host.Address.Pubkey_hash] = host
+		lan.mtx.Unlock()
+
+		if !known {
+			n.lanEmit(lan, LanDiscoveryEvent{LanHostFound, host})
+		} else if previous.Address.Text != host.Address.Text || !slices.Equal(previous.Paths, host.Paths) {
+			n.lanEmit(lan, LanDiscoveryEvent{LanHostChanged, host})
+		}
+	}
+}
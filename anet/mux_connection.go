@@ -0,0 +1,814 @@
+package anet
+
+import (
+	"abyss/atype"
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// frame: type(1) | stream id(8) | payload length(4) | payload
+const (
+	mux_frame_stream      byte = 0 //stream data; the first frame of a peer-initiated id opens the stream
+	mux_frame_fin         byte = 1 //end of the sender's write side
+	mux_frame_reset       byte = 2 //CancelWrite, payload: error code(8)
+	mux_frame_stop        byte = 3 //CancelRead, payload: error code(8)
+	mux_frame_datagram    byte = 4
+	mux_frame_close       byte = 5 //CloseWithError, payload: error code(8) | reason
+	mux_frame_max_data    byte = 6 //stream bytes the peer may send in total, payload: limit(8)
+	mux_frame_max_stream  byte = 7 //stream bytes the peer may send on the stream, payload: limit(8)
+	mux_frame_max_streams byte = 8 //streams the peer may open in total; id 0: bidirectional, 2: unidirectional. payload: limit(8)
+	mux_frame_header_size      = 13
+
+	mux_max_frame_payload  = 16 * 1024
+	mux_stream_window      = 1024 * 1024      //unread bytes per stream
+	mux_connection_window  = 16 * 1024 * 1024 //unread bytes of all streams together
+	mux_datagram_queue_len = 128
+)
+
+// quic.Connection over a single TLS byte stream (in-memory pipe, TCP, relay).
+// streams are multiplexed with a minimal framing and flow controlled as in QUIC: writers block when
+// the peer's stream or connection window is full, and OpenStreamSync waits for the peer's stream limit
+// (MaxIncomingStreams, MaxIncomingUniStreams), which each side announces right after TLS.
+// limits only rise, so limit frames may be sent in any order.
+// stream ids follow the QUIC numbering, so the client and the server never collide.
+// a peer that sends past a limit gets the connection closed.
+type muxConnection struct {
+	conn      *tls.Conn
+	tls_state tls.ConnectionState
+
+	write_mtx sync.Mutex
+
+	mtx          sync.Mutex
+	streams      map[quic.StreamID]*muxStream
+	next_bidi    quic.StreamID //next id we open
+	next_uni     quic.StreamID
+	peer_bidi    quic.StreamID //next id the peer opens
+	peer_uni     quic.StreamID
+	max_bidi     int64 //streams we open, as allowed by the peer
+	max_uni      int64
+	grant_bidi   int64 //streams the peer opens, as allowed by us: the config limit plus the released ones
+	grant_uni    int64
+	sent_data    int64         //stream bytes sent
+	max_data     int64         //limit of sent_data
+	recv_data    int64         //stream bytes received
+	read_data    int64         //stream bytes read or discarded
+	grant_data   int64         //limit of recv_data
+	credit       chan struct{} //closed and replaced when a send limit rises
+	accept_bidi  chan *muxStream
+	accept_uni   chan *muxStream
+	datagrams    chan []byte
+	close_ctx    context.Context
+	close_cancel context.CancelCauseFunc
+	counters     *sessionCounters
+}
+
+// the TLS handshake must be complete. config gives the incoming stream limits.
+func newMuxConnection(conn *tls.Conn, is_client bool, config NetCoreConfig) *muxConnection {
+	result := new(muxConnection)
+	result.conn = conn
+	result.tls_state = conn.ConnectionState()
+	result.streams = make(map[quic.StreamID]*muxStream)
+	if is_client {
+		result.next_bidi, result.next_uni, result.peer_bidi, result.peer_uni = 0, 2, 1, 3
+	} else {
+		result.next_bidi, result.next_uni, result.peer_bidi, result.peer_uni = 1, 3, 0, 2
+	}
+	result.grant_bidi = max(config.MaxIncomingStreams, 0)
+	result.grant_uni = max(config.MaxIncomingUniStreams, 0)
+	result.max_data = mux_connection_window
+	result.grant_data = mux_connection_window
+	result.credit = make(chan struct{})
+	result.accept_bidi = make(chan *muxStream, result.grant_bidi)
+	result.accept_uni = make(chan *muxStream, result.grant_uni)
+	result.datagrams = make(chan []byte, mux_datagram_queue_len)
+	result.close_ctx, result.close_cancel = context.WithCancelCause(context.Background())
+	result.counters = new(sessionCounters)
+
+	go result.readLoop()
+	result.writeFrame(mux_frame_max_streams, 0, binary.BigEndian.AppendUint64(nil, uint64(result.grant_bidi)))
+	result.writeFrame(mux_frame_max_streams, 2, binary.BigEndian.AppendUint64(nil, uint64(result.grant_uni)))
+	return result
+}
+
+func (c *muxConnection) writeFrame(frame_type byte, id quic.StreamID, payload ...[]byte) error {
+	length := 0
+	for _, p := range payload {
+		length += len(p)
+	}
+	var header [mux_frame_header_size]byte
+	header[0] = frame_type
+	binary.BigEndian.PutUint64(header[1:9], uint64(id))
+	binary.BigEndian.PutUint32(header[9:13], uint32(length))
+
+	c.write_mtx.Lock()
+	defer c.write_mtx.Unlock()
+	if err := c.closeErr(); err != nil {
+		return err
+	}
+	buffers := net.Buffers(append([][]byte{header[:]}, payload...))
+	written, err := buffers.WriteTo(c.conn)
+	c.counters.bytes_sent.Add(uint64(written))
+	return err
+}
+
+// for limit frames, which may be sent with locks held and from the read loop.
+func (c *muxConnection) sendLimit(frame_type byte, id quic.StreamID, limit int64) {
+	go c.writeFrame(frame_type, id, binary.BigEndian.AppendUint64(nil, uint64(limit)))
+}
+
+// called with mtx held.
+func (c *muxConnection) signalCredit() {
+	close(c.credit)
+	c.credit = make(chan struct{})
+}
+
+func (c *muxConnection) closeErr() error {
+	if c.close_ctx.Err() == nil {
+		return nil
+	}
+	return context.Cause(c.close_ctx)
+}
+
+func (c *muxConnection) terminate(err error) {
+	c.close_cancel(err)
+	err = context.Cause(c.close_ctx) //the first cause wins; closing the conn below fails the read loop too
+	c.conn.Close()
+
+	c.mtx.Lock()
+	streams := c.streams
+	c.streams = make(map[quic.StreamID]*muxStream)
+	c.mtx.Unlock()
+	for _, stream := range streams {
+		stream.fail(err)
+	}
+}
+
+func (c *muxConnection) readLoop() {
+	var header [mux_frame_header_size]byte
+	for {
+		if _, err := io.ReadFull(c.conn, header[:]); err != nil {
+			c.terminate(err)
+			return
+		}
+		id := quic.StreamID(binary.BigEndian.Uint64(header[1:9]))
+		length := binary.BigEndian.Uint32(header[9:13])
+		if length > mux_max_frame_payload+8 {
+			c.CloseWithError(0x1, "frame too large")
+			return
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(c.conn, payload); err != nil {
+			c.terminate(err)
+			return
+		}
+		c.counters.bytes_received.Add(uint64(mux_frame_header_size + length))
+
+		switch header[0] {
+		case mux_frame_stream, mux_frame_fin, mux_frame_reset:
+			if header[0] == mux_frame_stream && !c.receiveData(len(payload)) {
+				c.CloseWithError(0x1, "connection window exceeded")
+				return
+			}
+			stream, ok := c.incomingStream(id)
+			if !ok {
+				c.CloseWithError(0x1, "stream limit exceeded")
+				return
+			}
+			if stream == nil {
+				if header[0] == mux_frame_stream {
+					c.readData(len(payload))
+				}
+				continue
+			}
+			switch header[0] {
+			case mux_frame_stream:
+				if !stream.receive(payload) {
+					c.CloseWithError(0x1, "stream window exceeded")
+					return
+				}
+			case mux_frame_fin:
+				stream.receiveFin()
+			case mux_frame_reset:
+				if len(payload) != 8 {
+					c.CloseWithError(0x1, "invalid frame")
+					return
+				}
+				stream.receiveReset(quic.StreamErrorCode(binary.BigEndian.Uint64(payload)))
+			}
+		case mux_frame_stop:
+			if len(payload) != 8 {
+				c.CloseWithError(0x1, "invalid frame")
+				return
+			}
+			c.mtx.Lock()
+			stream, ok := c.streams[id]
+			c.mtx.Unlock()
+			if ok {
+				stream.receiveStop(quic.StreamErrorCode(binary.BigEndian.Uint64(payload)))
+			}
+		case mux_frame_max_data, mux_frame_max_stream, mux_frame_max_streams:
+			if len(payload) != 8 {
+				c.CloseWithError(0x1, "invalid frame")
+				return
+			}
+			c.receiveLimit(header[0], id, int64(binary.BigEndian.Uint64(payload)))
+		case mux_frame_datagram:
+			select {
+			case c.datagrams <- payload:
+			default: //datagrams may be dropped
+			}
+		case mux_frame_close:
+			if len(payload) < 8 {
+				c.terminate(errors.New("invalid close frame"))
+				return
+			}
+			c.terminate(&quic.ApplicationError{
+				Remote:       true,
+				ErrorCode:    quic.ApplicationErrorCode(binary.BigEndian.Uint64(payload[:8])),
+				ErrorMessage: string(payload[8:]),
+			})
+			return
+		default:
+			c.CloseWithError(0x1, "unknown frame type")
+			return
+		}
+	}
+}
+
+// false if the peer sent past the connection window; the connection must be closed.
+func (c *muxConnection) receiveData(n int) bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.recv_data += int64(n)
+	return c.recv_data <= c.grant_data
+}
+
+// returns connection window for bytes that left the receive buffers.
+// the window is extended once half of it is used, so limit frames stay rare.
+func (c *muxConnection) readData(n int) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.read_data += int64(n)
+	if c.grant_data-c.read_data <= mux_connection_window/2 {
+		c.grant_data = c.read_data + mux_connection_window
+		c.sendLimit(mux_frame_max_data, 0, c.grant_data)
+	}
+}
+
+func (c *muxConnection) receiveLimit(frame_type byte, id quic.StreamID, limit int64) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	switch frame_type {
+	case mux_frame_max_data:
+		c.max_data = max(c.max_data, limit)
+	case mux_frame_max_stream:
+		if stream, ok := c.streams[id]; ok {
+			stream.max_sent = max(stream.max_sent, limit)
+		}
+	case mux_frame_max_streams:
+		if id%4 >= 2 {
+			c.max_uni = max(c.max_uni, limit)
+		} else {
+			c.max_bidi = max(c.max_bidi, limit)
+		}
+	}
+	c.signalCredit()
+}
+
+// up to n bytes the stream may send now, taken from its window and the connection's.
+// when none, the channel closes as soon as a limit rises.
+func (c *muxConnection) reserveSend(stream *muxStream, n int) (int, <-chan struct{}) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	available := min(int64(n), stream.max_sent-stream.sent, c.max_data-c.sent_data)
+	if available <= 0 {
+		return 0, c.credit
+	}
+	stream.sent += available
+	c.sent_data += available
+	return int(available), nil
+}
+
+// nil for frames of streams that are already gone.
+// false if the id would open more peer streams than the limit allows; the connection must be closed.
+func (c *muxConnection) incomingStream(id quic.StreamID) (*muxStream, bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if stream, ok := c.streams[id]; ok {
+		return stream, true
+	}
+
+	is_uni := id%4 >= 2
+	next, limit := &c.peer_bidi, c.grant_bidi
+	accept := c.accept_bidi
+	if is_uni {
+		next, limit = &c.peer_uni, c.grant_uni
+		accept = c.accept_uni
+	}
+	if id%2 != (*next)%2 || id < *next {
+		return nil, true //our own stream, or a closed peer stream
+	}
+	//lower ids open implicitly, as in QUIC; check the highest before allocating any
+	if int64(id/4) >= limit {
+		return nil, false
+	}
+
+	var stream *muxStream
+	for ; *next <= id; *next += 4 {
+		stream = newMuxStream(c, *next, is_uni, true)
+		c.streams[*next] = stream
+		select {
+		case accept <- stream:
+		default: //the queue holds limit streams
+			return nil, false
+		}
+	}
+	return stream, true
+}
+
+// without ctx, fails instead of waiting for the peer's stream limit.
+func (c *muxConnection) openStream(ctx context.Context, is_uni bool) (*muxStream, error) {
+	for {
+		if err := c.closeErr(); err != nil {
+			return nil, err
+		}
+		c.mtx.Lock()
+		next, limit := &c.next_bidi, c.max_bidi
+		if is_uni {
+			next, limit = &c.next_uni, c.max_uni
+		}
+		if int64(*next/4) < limit {
+			stream := newMuxStream(c, *next, is_uni, false)
+			c.streams[*next] = stream
+			*next += 4
+			c.mtx.Unlock()
+			return stream, nil
+		}
+		credit := c.credit
+		c.mtx.Unlock()
+
+		if ctx == nil {
+			return nil, errors.New("too many open streams")
+		}
+		select {
+		case <-credit:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-c.close_ctx.Done():
+		}
+	}
+}
+
+// a released peer stream lets the peer open another.
+func (c *muxConnection) removeStream(id quic.StreamID) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if _, ok := c.streams[id]; !ok {
+		return
+	}
+	delete(c.streams, id)
+	if id%2 == c.peer_bidi%2 {
+		if id%4 >= 2 {
+			c.grant_uni++
+			c.sendLimit(mux_frame_max_streams, 2, c.grant_uni)
+		} else {
+			c.grant_bidi++
+			c.sendLimit(mux_frame_max_streams, 0, c.grant_bidi)
+		}
+	}
+}
+
+func (c *muxConnection) AcceptStream(ctx context.Context) (quic.Stream, error) {
+	select {
+	case stream := <-c.accept_bidi:
+		return stream, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-c.close_ctx.Done():
+		return nil, c.closeErr()
+	}
+}
+func (c *muxConnection) AcceptUniStream(ctx context.Context) (quic.ReceiveStream, error) {
+	select {
+	case stream := <-c.accept_uni:
+		return stream, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-c.close_ctx.Done():
+		return nil, c.closeErr()
+	}
+}
+func (c *muxConnection) OpenStream() (quic.Stream, error) {
+	return c.openStream(nil, false)
+}
+func (c *muxConnection) OpenStreamSync(ctx context.Context) (quic.Stream, error) {
+	return c.openStream(ctx, false)
+}
+func (c *muxConnection) OpenUniStream() (quic.SendStream, error) {
+	return c.openStream(nil, true)
+}
+func (c *muxConnection) OpenUniStreamSync(ctx context.Context) (quic.SendStream, error) {
+	return c.openStream(ctx, true)
+}
+func (c *muxConnection) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+func (c *muxConnection) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+func (c *muxConnection) CloseWithError(code quic.ApplicationErrorCode, reason string) error {
+	if c.closeErr() != nil {
+		return nil
+	}
+	var code_bytes [8]byte
+	binary.BigEndian.PutUint64(code_bytes[:], uint64(code))
+	c.writeFrame(mux_frame_close, 0, code_bytes[:], []byte(reason))
+	c.terminate(&quic.ApplicationError{Remote: false, ErrorCode: code, ErrorMessage: reason})
+	return nil
+}
+func (c *muxConnection) Context() context.Context {
+	return c.close_ctx
+}
+func (c *muxConnection) ConnectionState() quic.ConnectionState {
+	return quic.ConnectionState{TLS: c.tls_state, SupportsDatagrams: true}
+}
+func (c *muxConnection) SendDatagram(payload []byte) error {
+	if len(payload) > mux_max_frame_payload {
+		return &quic.DatagramTooLargeError{MaxDatagramPayloadSize: mux_max_frame_payload}
+	}
+	return c.writeFrame(mux_frame_datagram, 0, payload)
+}
+func (c *muxConnection) ReceiveDatagram(ctx context.Context) ([]byte, error) {
+	select {
+	case datagram := <-c.datagrams:
+		return datagram, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-c.close_ctx.Done():
+		return nil, c.closeErr()
+	}
+}
+
+type muxStream struct {
+	conn   *muxConnection
+	id     quic.StreamID
+	notify chan struct{} //signals receive side changes
+
+	sent     int64 //bytes sent; guarded by conn.mtx, as is max_sent
+	max_sent int64 //limit of sent, raised by the peer
+
+	mtx            sync.Mutex
+	recv_buf       bytes.Buffer
+	recv_offset    int64 //bytes received
+	read_offset    int64 //bytes read or discarded
+	grant_offset   int64 //limit of recv_offset
+	recv_fin       bool
+	recv_err       error
+	read_deadline  time.Time
+	send_done      bool //write side closed or reset
+	send_err       error
+	write_deadline time.Time
+
+	send_ctx    context.Context
+	send_cancel context.CancelCauseFunc
+}
+
+// a unidirectional stream has only the side it is used for.
+func newMuxStream(conn *muxConnection, id quic.StreamID, is_uni bool, is_incoming bool) *muxStream {
+	result := new(muxStream)
+	result.conn = conn
+	result.id = id
+	result.notify = make(chan struct{}, 1)
+	result.max_sent = mux_stream_window
+	result.grant_offset = mux_stream_window
+	result.send_ctx, result.send_cancel = context.WithCancelCause(conn.close_ctx)
+	if is_uni {
+		if is_incoming {
+			result.send_done = true
+			result.send_cancel(errors.New("receive only stream"))
+		} else {
+			result.recv_fin = true
+		}
+	}
+	return result
+}
+
+func (s *muxStream) signal() {
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+// called with mtx held.
+func (s *muxStream) releaseIfDone() {
+	if (s.recv_fin || s.recv_err != nil) && s.send_done {
+		s.conn.removeStream(s.id)
+	}
+}
+
+// false if the peer sent past the stream window; the connection must be closed.
+func (s *muxStream) receive(payload []byte) bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.recv_fin || s.recv_err != nil {
+		s.conn.readData(len(payload)) //data after CancelRead is discarded
+		return true
+	}
+	s.recv_offset += int64(len(payload))
+	if s.recv_offset > s.grant_offset {
+		return false
+	}
+	s.recv_buf.Write(payload)
+	s.signal()
+	return true
+}
+
+// called with mtx held, for bytes that left recv_buf.
+func (s *muxStream) consumed(n int) {
+	s.conn.readData(n)
+	s.read_offset += int64(n)
+	if !s.recv_fin && s.recv_err == nil && s.grant_offset-s.read_offset <= mux_stream_window/2 {
+		s.grant_offset = s.read_offset + mux_stream_window
+		s.conn.sendLimit(mux_frame_max_stream, s.id, s.grant_offset)
+	}
+}
+func (s *muxStream) receiveFin() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.recv_fin = true
+	s.signal()
+	s.releaseIfDone()
+}
+func (s *muxStream) receiveReset(code quic.StreamErrorCode) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.recv_err == nil {
+		s.recv_err = &quic.StreamError{StreamID: s.id, ErrorCode: code, Remote: true}
+	}
+	s.signal()
+	s.releaseIfDone()
+}
+func (s *muxStream) receiveStop(code quic.StreamErrorCode) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if !s.send_done {
+		s.send_done = true
+		s.send_err = &quic.StreamError{StreamID: s.id, ErrorCode: code, Remote: true}
+		s.send_cancel(s.send_err)
+		go s.conn.writeFrame(mux_frame_reset, s.id, binary.BigEndian.AppendUint64(nil, uint64(code))) //the read loop never blocks on writes
+	}
+	s.releaseIfDone()
+}
+func (s *muxStream) fail(err error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.recv_err == nil {
+		s.recv_err = err
+	}
+	if s.send_err == nil {
+		s.send_err = err
+	}
+	s.send_done = true
+	s.send_cancel(err)
+	s.signal()
+}
+
+func (s *muxStream) StreamID() quic.StreamID {
+	return s.id
+}
+func (s *muxStream) Read(p []byte) (int, error) {
+	for {
+		s.mtx.Lock()
+		if s.recv_buf.Len() != 0 {
+			n, _ := s.recv_buf.Read(p)
+			s.consumed(n)
+			s.mtx.Unlock()
+			return n, nil
+		}
+		if s.recv_err != nil {
+			err := s.recv_err
+			s.mtx.Unlock()
+			return 0, err
+		}
+		if s.recv_fin {
+			s.mtx.Unlock()
+			return 0, io.EOF
+		}
+		deadline := s.read_deadline
+		s.mtx.Unlock()
+
+		if deadline.IsZero() {
+			<-s.notify
+			continue
+		}
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return 0, os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-s.notify:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+func (s *muxStream) CancelRead(code quic.StreamErrorCode) {
+	s.mtx.Lock()
+	if s.recv_fin || s.recv_err != nil {
+		s.mtx.Unlock()
+		return
+	}
+	s.recv_err = &quic.StreamError{StreamID: s.id, ErrorCode: code, Remote: false}
+	s.consumed(s.recv_buf.Len())
+	s.recv_buf.Reset()
+	s.signal()
+	s.releaseIfDone()
+	s.mtx.Unlock()
+
+	s.conn.writeFrame(mux_frame_stop, s.id, binary.BigEndian.AppendUint64(nil, uint64(code)))
+}
+func (s *muxStream) SetReadDeadline(t time.Time) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.read_deadline = t
+	s.signal()
+	return nil
+}
+func (s *muxStream) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) != 0 {
+		s.mtx.Lock()
+		send_done, send_err, deadline := s.send_done, s.send_err, s.write_deadline
+		s.mtx.Unlock()
+		if send_err != nil {
+			return written, send_err
+		}
+		if send_done {
+			return written, errors.New("write on closed stream")
+		}
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			return written, os.ErrDeadlineExceeded
+		}
+
+		available, credit := s.conn.reserveSend(s, min(len(p), mux_max_frame_payload))
+		if available == 0 {
+			//the peer's window is full
+			if deadline.IsZero() {
+				select {
+				case <-credit:
+				case <-s.send_ctx.Done():
+				}
+				continue
+			}
+			timer := time.NewTimer(time.Until(deadline))
+			select {
+			case <-credit:
+			case <-s.send_ctx.Done():
+			case <-timer.C:
+			}
+			timer.Stop()
+			continue
+		}
+		chunk := p[:available]
+		if err := s.conn.writeFrame(mux_frame_stream, s.id, chunk); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
+func (s *muxStream) Close() error {
+	s.mtx.Lock()
+	if s.send_done {
+		s.mtx.Unlock()
+		return nil
+	}
+	s.send_done = true
+	s.send_cancel(nil)
+	s.releaseIfDone()
+	s.mtx.Unlock()
+
+	return s.conn.writeFrame(mux_frame_fin, s.id)
+}
+func (s *muxStream) CancelWrite(code quic.StreamErrorCode) {
+	s.mtx.Lock()
+	if s.send_done {
+		s.mtx.Unlock()
+		return
+	}
+	s.send_done = true
+	s.send_err = &quic.StreamError{StreamID: s.id, ErrorCode: code, Remote: false}
+	s.send_cancel(s.send_err)
+	s.releaseIfDone()
+	s.mtx.Unlock()
+
+	s.conn.writeFrame(mux_frame_reset, s.id, binary.BigEndian.AppendUint64(nil, uint64(code)))
+}
+func (s *muxStream) Context() context.Context {
+	return s.send_ctx
+}
+func (s *muxStream) SetWriteDeadline(t time.Time) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.write_deadline = t
+	return nil
+}
+func (s *muxStream) SetDeadline(t time.Time) error {
+	s.SetReadDeadline(t)
+	return s.SetWriteDeadline(t)
+}
+
+// TLS, the mux and the AHMP ID exchange over a byte stream, as the dialing side.
+// the context deadline, if any, bounds the whole handshake.
+func dialMuxTransmission(ctx context.Context, conn net.Conn, tls_conf *tls.Config, config NetCoreConfig, abyss_address atype.AbyssAddress, ahmp_init_msg []byte, local_hash string, local_signer crypto.Signer) (*Transmission, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	tls_conn := tls.Client(conn, tls_conf)
+	if err := tls_conn.HandshakeContext(ctx); err != nil {
+		tls_conn.Close()
+		return nil, err
+	}
+	connection := newMuxConnection(tls_conn, true, config)
+
+	ahmp_stream, err := connection.OpenStreamSync(ctx)
+	if err != nil {
+		connection.CloseWithError(0x42, err.Error())
+		return nil, err
+	}
+	transmission, err := NewTransmission(connection, ahmp_stream, ahmp_init_msg, local_hash, local_signer)
+	if err != nil {
+		connection.CloseWithError(0x42, err.Error())
+		return nil, err
+	}
+	if !transmission.IsKnownAs(abyss_address.Pubkey_hash) {
+		connection.CloseWithError(0x42, "hash mismatch")
+		return nil, errors.New("hash mismatch")
+	}
+	transmission.outbound = true
+	conn.SetDeadline(time.Time{})
+	return transmission, nil
+}
+
+// the accepting side of dialMuxTransmission.
+func acceptMuxTransmission(ctx context.Context, conn net.Conn, tls_conf *tls.Config, config NetCoreConfig, ahmp_init_msg []byte, local_hash string, local_signer crypto.Signer) (*Transmission, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	tls_conn := tls.Server(conn, tls_conf)
+	if err := tls_conn.HandshakeContext(ctx); err != nil {
+		tls_conn.Close()
+		return nil, err
+	}
+	connection := newMuxConnection(tls_conn, false, config)
+
+	ahmp_stream, err := connection.AcceptStream(ctx)
+	if err != nil {
+		connection.CloseWithError(0x42, "connection init failed")
+		return nil, err
+	}
+	transmission, err := NewTransmission(connection, ahmp_stream, ahmp_init_msg, local_hash, local_signer)
+	if err != nil {
+		connection.CloseWithError(0x42, "connection init failed")
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return transmission, nil
+}
+
+// completes TLS to tell the dialer why it is turned away. the dialer hangs up on the close frame;
+// we wait for that, since closing a TCP socket with unread data resets it and the reset can overtake the frame.
+func refuseMuxConnection(ctx context.Context, conn net.Conn, tls_conf *tls.Config, config NetCoreConfig, code quic.ApplicationErrorCode, reason string) {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	tls_conn := tls.Server(conn, tls_conf)
+	if err := tls_conn.HandshakeContext(ctx); err != nil {
+		tls_conn.Close()
+		return
+	}
+	connection := newMuxConnection(tls_conn, false, config)
+
+	var code_bytes [8]byte
+	binary.BigEndian.PutUint64(code_bytes[:], uint64(code))
+	connection.writeFrame(mux_frame_close, 0, code_bytes[:], []byte(reason))
+	select {
+	case <-connection.Context().Done():
+	case <-ctx.Done():
+	}
+	connection.terminate(&quic.ApplicationError{Remote: false, ErrorCode: code, ErrorMessage: reason})
+}
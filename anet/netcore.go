@@ -2,6 +2,23 @@ package anet
 
 import (
 	"abyss/atype"
+	"context"
+	"net"
+	"net/netip"
+
+	"github.com/quic-go/quic-go"
+)
+
+// close codes for connections we turn away, so the other side can tell a refusal from a failure.
+const (
+	CloseTooManyPeers      quic.ApplicationErrorCode = 0x50
+	CloseTooManyHandshakes quic.ApplicationErrorCode = 0x51
+	CloseTooManyFromIP     quic.ApplicationErrorCode = 0x52
+	CloseAddressRejected   quic.ApplicationErrorCode = 0x53
+	CloseIdentityRejected  quic.ApplicationErrorCode = 0x54
+	CloseTripleSession     quic.ApplicationErrorCode = 409  //we already have two sessions with the peer
+	CloseShutdown          quic.ApplicationErrorCode = 0x55 //the networker is shutting down (see Networker.Shutdown)
+	CloseSuperseded        quic.ApplicationErrorCode = 0x56 //another dial to the same address won the race; the dialer keeps that session
 )
 
 type INetCore interface {
@@ -14,3 +31,38 @@ type INetCore interface {
 
 	Close()
 }
+
+// net cores behind NAT can open a mapping toward a peer that is about to dial them (see PCH).
+type IHolePuncher interface {
+	Punch(address atype.AbyssAddress) //non-blocking
+}
+
+// a PCH target is a third host, given by IP endpoints only.
+func isPunchTarget(target atype.AbyssAddress, introducer_hash string, local_hash string) bool {
+	if target.Pubkey_hash == introducer_hash || target.Pubkey_hash == local_hash {
+		return false
+	}
+	for _, endpoint := range target.Endpoints {
+		if _, err := netip.ParseAddr(endpoint.Host); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// net cores that can run the TLS and AHMP ID handshake over an existing byte stream (see relay.go).
+// the resulting Transmission is authenticated end to end, whatever carries the bytes.
+type IConnHandshaker interface {
+	ConnectConn(conn net.Conn, address atype.AbyssAddress) (*Transmission, error)
+	AcceptConn(conn net.Conn) (*Transmission, error)
+}
+
+// net cores listening on a UDP port of this host, that can be announced on the local network.
+type IListenPort interface {
+	ListenPort() uint16
+}
+
+// hostname resolution for abyss addresses. *net.Resolver implements this.
+type IResolver interface {
+	LookupNetIP(ctx context.Context, network string, host string) ([]netip.Addr, error)
+}
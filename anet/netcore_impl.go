@@ -3,116 +3,395 @@ package anet
 import (
 	"abyss/atype"
 	"context"
-	"crypto/ed25519"
-	"crypto/rand"
+	"crypto"
 	"crypto/tls"
-	"crypto/x509"
 	"errors"
-	"math/big"
 	"net"
 	"net/netip"
-	"strconv"
-	"strings"
+	"slices"
 	"sync"
 	"time"
 
 	"github.com/quic-go/quic-go"
 )
 
+const connect_attempt_delay = time.Millisecond * 250
+
+// a reflexive address is advertised once reported over this many live connections from distinct source networks
+// (reflexive_reporter_prefix). identities are free, so a single attacker could otherwise make us advertise anything.
+const reflexive_confirmations = 2
+const reflexive_max_reporters = 32
+
+// hole punching: how long and how often to send punch packets, and how many targets at once.
+const punch_duration = time.Second * 3
+const punch_interval = time.Millisecond * 100
+const punch_max_ongoing = 8
+
+// not a QUIC packet (fixed bit unset), so the receiving transport drops it.
+var punch_packet = []byte("\x00abyss-punch")
+
+// how long QUIC has before the TCP fallback is dialed too.
+const tcp_fallback_delay = time.Second
+
+// GoQuicNetCore settings. zero fields take the default values.
+type NetCoreConfig struct {
+	BindAddress *net.UDPAddr   //default: all interfaces, random port (dual-stack where the OS supports it)
+	PacketConn  net.PacketConn //used instead of binding BindAddress when set, e.g. a socket wrapper. owned by the net core
+
+	DialTimeout      time.Duration //QUIC and TLS handshake of an endpoint; resolving the hostnames of an address takes at most one more. default 3s
+	HandshakeTimeout time.Duration //AHMP ID exchange after the QUIC handshake. default 3s
+	AcceptTimeout    time.Duration //single Accept wait. default 3s
+
+	MaxIdleTimeout        time.Duration //default 5min
+	KeepAlivePeriod       time.Duration //default 1min, negative disables
+	MaxIncomingStreams    int64         //default 1000
+	MaxIncomingUniStreams int64         //default 1000
+	SessionCacheSize      int           //session tickets kept for resumption, one per dialed peer. default 256, negative disables
+
+	//admission of incoming connections. zero limits: no limit. refused connections are closed with a Close* code.
+	MaxPeers             int                              //live connections, incoming and outgoing. counts pending handshakes
+	MaxPendingHandshakes int                              //incoming connections in the ID exchange at once. default 64
+	MaxConnectionsPerIP  int                              //live and pending incoming connections from one source IP
+	AdmitAddress         func(remote netip.AddrPort) bool //after the QUIC handshake, before the ID exchange. nil admits all
+	AdmitIdentity        func(hash string) bool           //after the ID exchange, with the verified identity hash. nil admits all
+
+	//NewNetworker also listens for TLS over TCP here, and dials TCP endpoints when QUIC fails (see FallbackNetCore).
+	//nil: QUIC only
+	TCPFallbackAddress *net.TCPAddr
+}
+
+func (c NetCoreConfig) withDefaults() NetCoreConfig {
+	if c.BindAddress == nil {
+		c.BindAddress = &net.UDPAddr{}
+	}
+	if c.DialTimeout == 0 {
+		c.DialTimeout = time.Second * 3
+	}
+	if c.HandshakeTimeout == 0 {
+		c.HandshakeTimeout = time.Second * 3
+	}
+	if c.AcceptTimeout == 0 {
+		c.AcceptTimeout = time.Second * 3
+	}
+	if c.MaxIdleTimeout == 0 {
+		c.MaxIdleTimeout = time.Minute * 5
+	}
+	if c.KeepAlivePeriod == 0 {
+		c.KeepAlivePeriod = time.Minute
+	}
+	if c.MaxIncomingStreams == 0 {
+		c.MaxIncomingStreams = 1000
+	}
+	if c.MaxIncomingUniStreams == 0 {
+		c.MaxIncomingUniStreams = 1000
+	}
+	if c.MaxPendingHandshakes == 0 {
+		c.MaxPendingHandshakes = 64
+	}
+	if c.SessionCacheSize == 0 {
+		c.SessionCacheSize = 256
+	}
+	return c
+}
+
 type GoQuicNetCore struct {
 	local_identity atype.AbyssIdentity
-	ahmp_init_msg  []byte
+	local_signer   crypto.Signer
+	resolver       IResolver
+	config         NetCoreConfig
+
+	interface_addrs func() ([]net.Addr, error) //net.InterfaceAddrs
+	reflexive_mtx   sync.Mutex
+	reflexive       map[netip.Prefix]reflexiveReport //reporter source network > our address as last seen from there
+	punch_slots     chan bool
 
-	tlsConf  tls.Config
-	quicConf quic.Config
-	tr       quic.Transport
-	ln       *quic.Listener
+	accepted  chan acceptResult
+	admission *admission
+	fallback  *TcpNetCore //nil without TCPFallbackAddress
+
+	tlsConf       tls.Config
+	quicConf      quic.Config
+	tr            quic.Transport
+	ln            *quic.EarlyListener
+	session_cache tls.ClientSessionCache //identity hash > ticket. nil if disabled
 
 	listen_ctx    context.Context
 	listen_cancel context.CancelFunc
+	close_mtx     sync.Mutex //orders close_wg.Add before the Wait in Close
 	close_wg      sync.WaitGroup
 }
 
-func NewGoQuicNetCore(local_identity atype.AbyssIdentity) (*GoQuicNetCore, error) {
+func NewGoQuicNetCore(local_private_identity atype.AbyssPrivateIdentity, config NetCoreConfig) (*GoQuicNetCore, error) {
 	result := new(GoQuicNetCore)
+	result.config = config.withDefaults()
+	local_identity := local_private_identity.Identity
+	local_signer := local_private_identity.Privatekey
 	result.local_identity = local_identity
+	result.local_signer = local_signer
+	result.resolver = net.DefaultResolver
+	result.interface_addrs = net.InterfaceAddrs
+	result.reflexive = make(map[netip.Prefix]reflexiveReport)
+	result.punch_slots = make(chan bool, punch_max_ongoing)
+	result.accepted = make(chan acceptResult, 32)
+	result.admission = newAdmission(result.config)
 
-	var sb strings.Builder
-	sb.WriteString("AHMP/1.0 ID " + local_identity.Name + "\n")
-	sb.WriteString("Content-Length: " + strconv.Itoa(len(local_identity.Publickey)) + "\n")
-	sb.WriteString("\n")
-	sb.Write(local_identity.Publickey)
-	result.ahmp_init_msg = []byte(sb.String())
+	if err := checkIdentityKey(local_private_identity); err != nil {
+		return nil, err
+	}
 
 	listen_ctx, cancelfunc := context.WithCancel(context.Background())
 	result.listen_ctx = listen_ctx
 	result.listen_cancel = cancelfunc
 
-	udpConn, err := net.ListenUDP("udp4", &net.UDPAddr{})
-	if err != nil {
-		return nil, err
-	}
-
-	ed25519_public_key, ed25519_private_key, err := ed25519.GenerateKey(rand.Reader)
-	if err != nil {
-		return nil, err
+	var err error
+	var udpConn net.PacketConn = result.config.PacketConn
+	if udpConn == nil {
+		udpConn, err = net.ListenUDP("udp", result.config.BindAddress)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	template := x509.Certificate{
-		SerialNumber:          big.NewInt(0),
-		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
-		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
-		BasicConstraintsValid: true,
-	}
-	derBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, ed25519_public_key, ed25519_private_key)
+	result.tlsConf, err = newIdentityTLSConfig(local_private_identity)
 	if err != nil {
 		return nil, err
 	}
-	result.tlsConf = tls.Config{
-		Certificates: []tls.Certificate{
-			{
-				Certificate: [][]byte{derBytes},
-				PrivateKey:  ed25519_private_key,
-			},
-		},
-		InsecureSkipVerify: true,
-	}
 	result.quicConf = quic.Config{
-		MaxIdleTimeout:                time.Minute * 5,
+		MaxIdleTimeout:                result.config.MaxIdleTimeout,
 		AllowConnectionWindowIncrease: func(conn quic.Connection, delta uint64) bool { return true },
-		MaxIncomingStreams:            1000,
-		MaxIncomingUniStreams:         1000,
-		KeepAlivePeriod:               time.Minute,
+		MaxIncomingStreams:            result.config.MaxIncomingStreams,
+		MaxIncomingUniStreams:         result.config.MaxIncomingUniStreams,
+		KeepAlivePeriod:               max(result.config.KeepAlivePeriod, 0),
 		Allow0RTT:                     true,
 		EnableDatagrams:               true,
+		Tracer:                        newCountingTracer,
+	}
+	if result.config.SessionCacheSize > 0 {
+		result.session_cache = tls.NewLRUClientSessionCache(result.config.SessionCacheSize)
 	}
 	result.tr = quic.Transport{
 		Conn: udpConn,
 	}
-	ln, err := result.tr.Listen(&result.tlsConf, &result.quicConf)
+	ln, err := result.tr.ListenEarly(&result.tlsConf, &result.quicConf)
 	if err != nil {
 		return nil, err
 	}
 	result.ln = ln
 
+	if result.config.TCPFallbackAddress != nil {
+		result.fallback, err = newTcpNetCore(local_private_identity, result.config.TCPFallbackAddress, result.config, result.admission)
+		if err != nil {
+			ln.Close()
+			return nil, err
+		}
+		result.fallback.local_addr = result.LocalAddr
+		result.fallback.start()
+		result.close_wg.Add(1)
+		go result.forwardFallback()
+	}
+
+	result.close_wg.Add(1)
+	go result.acceptLoop()
 	return result, nil
 }
 
-func (n *GoQuicNetCore) Connect(abyss_address atype.AbyssAddress) (*Transmission, error) {
+// call before any Connect.
+func (n *GoQuicNetCore) SetResolver(resolver IResolver) {
+	n.resolver = resolver
+}
+
+// false once the host is closed; otherwise the caller must call close_wg.Done.
+func (n *GoQuicNetCore) enter() bool {
+	n.close_mtx.Lock()
+	defer n.close_mtx.Unlock()
+	if n.listen_ctx.Err() != nil {
+		return false
+	}
 	n.close_wg.Add(1)
+	return true
+}
+
+func (n *GoQuicNetCore) resolveEndpoints(ctx context.Context, endpoints []atype.AbyssEndpoint) ([]netip.AddrPort, error) {
+	return resolveEndpoints(ctx, n.resolver, n.config.DialTimeout, endpoints, atype.TransportQUIC)
+}
+
+// endpoints of the transport; hostnames are expanded to every A/AAAA record, in place of the endpoint.
+// timeout bounds the lookups of all hostnames together.
+func resolveEndpoints(ctx context.Context, resolver IResolver, timeout time.Duration, endpoints []atype.AbyssEndpoint, transport atype.AbyssTransport) ([]netip.AddrPort, error) {
+	resolve_ctx, resolve_cancel := context.WithTimeout(ctx, timeout)
+	defer resolve_cancel()
+
+	var last_err error
+	result := make([]netip.AddrPort, 0, len(endpoints))
+	for _, endpoint := range endpoints {
+		if endpoint.Transport != transport {
+			continue
+		}
+		ip, err := netip.ParseAddr(endpoint.Host)
+		if err == nil {
+			result = append(result, netip.AddrPortFrom(ip, endpoint.Port))
+			continue
+		}
+
+		ips, err := resolver.LookupNetIP(resolve_ctx, "ip", endpoint.Host)
+		if err != nil {
+			last_err = err
+			continue
+		}
+		for _, ip := range ips {
+			result = append(result, netip.AddrPortFrom(ip.Unmap(), endpoint.Port))
+		}
+	}
+	if len(result) == 0 {
+		if last_err == nil {
+			last_err = errors.New("no endpoint resolved")
+		}
+		return nil, last_err
+	}
+	return result, nil
+}
+
+// with a TCP fallback, TCP endpoints are dialed when QUIC fails or has not connected within tcp_fallback_delay,
+// and the first session wins. a refusal over QUIC is final; the peer is reachable and said no.
+func (n *GoQuicNetCore) Connect(abyss_address atype.AbyssAddress) (*Transmission, error) {
+	if n.fallback == nil || !slices.ContainsFunc(abyss_address.Endpoints, func(endpoint atype.AbyssEndpoint) bool {
+		return endpoint.Transport == atype.TransportTCP
+	}) {
+		return n.connectQUIC(abyss_address)
+	}
+	if !n.enter() {
+		return nil, context.Canceled
+	}
 	defer n.close_wg.Done()
-	var err error
 
-	net_ipaddr, err := netip.ParseAddr(abyss_address.IP)
+	results := make(chan acceptResult, 2)
+	go func() {
+		transmission, err := n.connectQUIC(abyss_address)
+		results <- acceptResult{transmission, err}
+	}()
+	ongoing := 1
+	fallback_timer := time.NewTimer(tcp_fallback_delay)
+	defer fallback_timer.Stop()
+	fallback_started := false
+	StartFallback := func() {
+		fallback_started = true
+		ongoing++
+		go func() {
+			transmission, err := n.fallback.Connect(abyss_address)
+			results <- acceptResult{transmission, err}
+		}()
+	}
+
+	var errs []error
+	for ongoing != 0 {
+		select {
+		case result := <-results:
+			ongoing--
+			if result.err == nil {
+				if ongoing != 0 {
+					go func() {
+						if late := <-results; late.err == nil {
+							late.transmission.connection.CloseWithError(CloseSuperseded, "superseded")
+						}
+					}()
+				}
+				return result.transmission, nil
+			}
+			errs = append(errs, result.err)
+			var app_err *quic.ApplicationError
+			if !fallback_started && !(errors.As(result.err, &app_err) && app_err.Remote) {
+				StartFallback()
+			}
+		case <-fallback_timer.C:
+			if !fallback_started {
+				StartFallback()
+			}
+		}
+	}
+	return nil, errors.Join(errs...)
+}
+
+// happy eyeballs: endpoints are dialed in priority order, each one connect_attempt_delay after the previous
+// (or right away when the previous fails). the first endpoint to complete the identity handshake wins.
+func (n *GoQuicNetCore) connectQUIC(abyss_address atype.AbyssAddress) (*Transmission, error) {
+	if !n.enter() {
+		return nil, context.Canceled
+	}
+	defer n.close_wg.Done()
+
+	race_ctx, race_cancel := context.WithCancel(n.listen_ctx)
+	defer race_cancel()
+
+	endpoints, err := n.resolveEndpoints(race_ctx, abyss_address.Endpoints)
 	if err != nil {
 		return nil, err
 	}
 
-	dialctx, dialcancel := context.WithTimeout(n.listen_ctx, time.Second*3)
-	connection, err := n.tr.Dial(
+	type attemptResult struct {
+		transmission *Transmission
+		err          error
+	}
+	results := make(chan attemptResult, len(endpoints))
+	next_attempt := 0
+	ongoing := 0
+	StartAttempt := func() {
+		endpoint := endpoints[next_attempt]
+		next_attempt++
+		ongoing++
+		go func() {
+			transmission, err := n.connectEndpoint(race_ctx, abyss_address, endpoint)
+			results <- attemptResult{transmission, err}
+		}()
+	}
+
+	var last_err error
+	StartAttempt()
+	for ongoing != 0 {
+		var attempt_timer <-chan time.Time
+		if next_attempt < len(endpoints) {
+			attempt_timer = time.After(connect_attempt_delay)
+		}
+
+		select {
+		case result := <-results:
+			ongoing--
+			if result.err == nil {
+				//the losers are cancelled by race_cancel. late winners must be closed.
+				go func(remaining int) {
+					for ; remaining > 0; remaining-- {
+						late := <-results
+						if late.err == nil {
+							late.transmission.connection.CloseWithError(CloseSuperseded, "superseded")
+						}
+					}
+				}(ongoing)
+				return result.transmission, nil
+			}
+			last_err = result.err
+			if next_attempt < len(endpoints) {
+				StartAttempt()
+			}
+		case <-attempt_timer:
+			StartAttempt()
+		}
+	}
+	return nil, last_err
+}
+
+func (n *GoQuicNetCore) connectEndpoint(ctx context.Context, abyss_address atype.AbyssAddress, endpoint netip.AddrPort) (*Transmission, error) {
+	var err error
+
+	tls_conf := dialIdentityTLSConfig(&n.tlsConf, abyss_address.Pubkey_hash)
+	if n.session_cache != nil {
+		tls_conf.ClientSessionCache = identitySessionCache{n.session_cache, abyss_address.Pubkey_hash}
+	}
+
+	//with a ticket from an earlier connection, the ID exchange starts in 0-RTT (see NewTransmission).
+	dialctx, dialcancel := context.WithTimeout(ctx, n.config.DialTimeout)
+	connection, err := n.tr.DialEarly(
 		dialctx,
-		net.UDPAddrFromAddrPort(netip.AddrPortFrom(net_ipaddr, abyss_address.Port)),
-		&n.tlsConf,
+		net.UDPAddrFromAddrPort(endpoint),
+		tls_conf,
 		&n.quicConf,
 	)
 	dialcancel()
@@ -133,18 +412,19 @@ func (n *GoQuicNetCore) Connect(abyss_address atype.AbyssAddress) (*Transmission
 			fin <- err
 		}()
 
-		ahmp_stream, err := connection.OpenStream()
-		if err != nil {
-			return
+		new_peer, err = n.dialHandshake(connection)
+		if errors.Is(err, quic.Err0RTTRejected) {
+			//the peer did not take the ticket; the 0-RTT stream is gone, so start over after the handshake.
+			new_peer, err = n.dialHandshake(connection.NextConnection())
 		}
-		new_peer, err = NewTransmission(connection, ahmp_stream, n.ahmp_init_msg)
 		if err != nil {
 			return
 		}
-		if new_peer.identity.Hash != abyss_address.Pubkey_hash {
+		if !new_peer.IsKnownAs(abyss_address.Pubkey_hash) {
 			err = errors.New("hash mismatch")
 			return
 		}
+		n.recordReflexive(new_peer)
 	}()
 
 	//timeout
@@ -153,22 +433,134 @@ func (n *GoQuicNetCore) Connect(abyss_address atype.AbyssAddress) (*Transmission
 		if err != nil {
 			return nil, err
 		}
+		n.admission.trackLive(new_peer.connection)
 		return new_peer, nil
-	case <-time.After(time.Second * 3):
+	case <-ctx.Done():
+		if n.listen_ctx.Err() == nil {
+			//another endpoint won. the acceptor may have completed the ID exchange already
+			connection.CloseWithError(CloseSuperseded, "superseded")
+			return nil, ctx.Err()
+		}
+		err = ctx.Err()
+		return nil, err
+	case <-time.After(n.config.HandshakeTimeout):
 		err = context.DeadlineExceeded
 		return nil, err
 	}
 }
+
+func (n *GoQuicNetCore) dialHandshake(connection quic.Connection) (*Transmission, error) {
+	ahmp_stream, err := connection.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	transmission, err := NewTransmission(connection, ahmp_stream, makeAHMPInitMessage(n.local_identity, n.LocalAddr()), n.local_identity.Hash, n.local_signer)
+	if err != nil {
+		return nil, err
+	}
+	transmission.outbound = true
+	return transmission, nil
+}
+
+type acceptResult struct {
+	transmission *Transmission
+	err          error
+}
+
+// context.DeadlineExceeded when nothing arrives within AcceptTimeout, context.Canceled after Close.
 func (n *GoQuicNetCore) Accept() (*Transmission, error) {
+	select {
+	case result := <-n.accepted:
+		return result.transmission, result.err
+	case <-time.After(n.config.AcceptTimeout):
+		return nil, context.DeadlineExceeded
+	case <-n.listen_ctx.Done():
+		return nil, context.Canceled
+	}
+}
+
+// takes connections off the listener and runs their ID exchanges concurrently, within the admission limits.
+func (n *GoQuicNetCore) acceptLoop() {
+	defer n.close_wg.Done()
+	for {
+		connection, err := n.ln.Accept(n.listen_ctx)
+		if err != nil {
+			return
+		}
+		remote, _ := netip.ParseAddrPort(connection.RemoteAddr().String())
+		remote = netip.AddrPortFrom(remote.Addr().Unmap(), remote.Port())
+		if code, reason, ok := n.admission.admit(remote); !ok {
+			n.refuse(connection, code, reason)
+			n.deliverAccepted(acceptResult{nil, errors.New("refused " + remote.String() + ": " + reason)})
+			continue
+		}
+
+		n.close_wg.Add(1)
+		go func() {
+			defer n.close_wg.Done()
+			transmission, err := n.acceptHandshake(connection)
+
+			n.admission.handshakeDone()
+			if err != nil {
+				n.admission.release(remote.Addr())
+				n.deliverAccepted(acceptResult{nil, err})
+				return
+			}
+			context.AfterFunc(connection.Context(), func() { n.admission.release(remote.Addr()) })
+			n.deliverAccepted(acceptResult{transmission, nil})
+		}()
+	}
+}
+
+// the listener hands out connections before their handshake completes, for 0-RTT.
+// a close code sent before then reaches the client only as a generic error, so the refusal waits for it,
+// holding a handshake slot. without a free slot, the connection is closed at once.
+func (n *GoQuicNetCore) refuse(connection quic.EarlyConnection, code quic.ApplicationErrorCode, reason string) {
+	if code == CloseTooManyHandshakes || !n.admission.reserveHandshake() {
+		//waiting to tell why is what the limit saves
+		connection.CloseWithError(code, reason)
+		return
+	}
 	n.close_wg.Add(1)
+	go func() {
+		defer n.close_wg.Done()
+		defer n.admission.handshakeDone()
+		select {
+		case <-connection.HandshakeComplete():
+		case <-connection.Context().Done():
+		case <-n.listen_ctx.Done():
+		case <-time.After(n.config.HandshakeTimeout):
+		}
+		connection.CloseWithError(code, reason)
+	}()
+}
+
+// sessions accepted over TCP come out of Accept with the QUIC ones.
+func (n *GoQuicNetCore) forwardFallback() {
 	defer n.close_wg.Done()
+	for {
+		transmission, err := n.fallback.Accept()
+		if err == context.Canceled {
+			return
+		}
+		if err != context.DeadlineExceeded {
+			n.deliverAccepted(acceptResult{transmission, err})
+		}
+	}
+}
 
-	acceptctx, acceptcancel := context.WithTimeout(n.listen_ctx, time.Second*3)
-	connection, err := n.ln.Accept(acceptctx)
-	acceptcancel()
-	if err != nil {
-		return nil, err
+func (n *GoQuicNetCore) deliverAccepted(result acceptResult) {
+	select {
+	case n.accepted <- result:
+	case <-n.listen_ctx.Done():
+		if result.transmission != nil {
+			result.transmission.connection.CloseWithError(0, "host closed")
+		}
 	}
+}
+
+func (n *GoQuicNetCore) acceptHandshake(connection quic.Connection) (*Transmission, error) {
+	var err error
 	defer func() {
 		if err != nil {
 			connection.CloseWithError(0x42, "connection init failed")
@@ -187,10 +579,11 @@ func (n *GoQuicNetCore) Accept() (*Transmission, error) {
 		if err != nil {
 			return
 		}
-		new_peer, err = NewTransmission(connection, ahmp_stream, n.ahmp_init_msg)
+		new_peer, err = NewTransmission(connection, ahmp_stream, makeAHMPInitMessage(n.local_identity, n.LocalAddr()), n.local_identity.Hash, n.local_signer)
 		if err != nil {
 			return
 		}
+		n.recordReflexive(new_peer)
 	}()
 
 	//timeout
@@ -199,8 +592,14 @@ func (n *GoQuicNetCore) Accept() (*Transmission, error) {
 		if err != nil {
 			return nil, err
 		}
+		if err := n.admission.admitIdentity(new_peer); err != nil {
+			return nil, err
+		}
 		return new_peer, nil
-	case <-time.After(time.Second * 3):
+	case <-n.listen_ctx.Done():
+		err = n.listen_ctx.Err()
+		return nil, err
+	case <-time.After(n.config.HandshakeTimeout):
 		err = context.DeadlineExceeded
 		return nil, err
 	}
@@ -208,12 +607,339 @@ func (n *GoQuicNetCore) Accept() (*Transmission, error) {
 func (n *GoQuicNetCore) LocalIdentity() atype.AbyssIdentity {
 	return n.local_identity
 }
+
+func (n *GoQuicNetCore) ListenPort() uint16 {
+	return n.ln.Addr().(*net.UDPAddr).AddrPort().Port()
+}
+
+// interface addresses first, then reflexive addresses confirmed by peers, loopback last.
+// the loopback endpoint only serves peers on the same host; others drop it (see mergeAdvertisedAddress).
+// with a TCP fallback, its endpoints follow the QUIC ones.
 func (n *GoQuicNetCore) LocalAddr() atype.AbyssAddress {
-	localaddr, _ := n.ln.Addr().(*net.UDPAddr)
-	address, _ := atype.MakeAbyssAddress(n.local_identity.Hash, "127.0.0.1", localaddr.AddrPort().Port(), "")
+	endpoints := n.localEndpoints()
+	if n.fallback != nil {
+		endpoints = append(endpoints, n.fallback.localEndpoints()...)
+	}
+	address, ok := atype.MakeAbyssAddressMulti(n.local_identity.Hash, endpoints, "")
+	if !ok {
+		address, _ = atype.MakeAbyssAddress(n.local_identity.Hash, "127.0.0.1", n.ListenPort(), "")
+	}
 	return address
 }
+
+func (n *GoQuicNetCore) localEndpoints() []atype.AbyssEndpoint {
+	port := n.ListenPort()
+
+	bind_ip, _ := netip.AddrFromSlice(n.ln.Addr().(*net.UDPAddr).IP)
+	bind_ip = bind_ip.Unmap()
+	if bind_ip.IsValid() && !bind_ip.IsUnspecified() {
+		return []atype.AbyssEndpoint{{Host: bind_ip.String(), Port: port}}
+	}
+	ipv4_only := bind_ip.Is4() //0.0.0.0 does not accept IPv6
+
+	endpoints := interfaceEndpoints(n.interface_addrs, ipv4_only, port, atype.TransportQUIC)
+	loopback := slices.IndexFunc(endpoints, func(endpoint atype.AbyssEndpoint) bool {
+		return netip.MustParseAddr(endpoint.Host).IsLoopback()
+	})
+	if loopback == -1 {
+		loopback = len(endpoints)
+	}
+	endpoints = slices.Insert(endpoints, loopback, n.confirmedReflexive()...)
+	if len(endpoints) == 0 {
+		endpoints = append(endpoints, atype.AbyssEndpoint{Host: "127.0.0.1", Port: port})
+	}
+	return endpoints
+}
+
+// an endpoint for each interface address, loopback last.
+func interfaceEndpoints(interface_addrs func() ([]net.Addr, error), ipv4_only bool, port uint16, transport atype.AbyssTransport) []atype.AbyssEndpoint {
+	addrs, err := interface_addrs()
+	if err != nil {
+		return nil
+	}
+	var endpoints, loopback []atype.AbyssEndpoint
+	for _, addr := range addrs {
+		prefix, err := netip.ParsePrefix(addr.String())
+		if err != nil {
+			continue
+		}
+		ip := prefix.Addr().Unmap()
+		if (ipv4_only && !ip.Is4()) || ip.IsLinkLocalUnicast() || ip.IsMulticast() || ip.IsUnspecified() {
+			continue //link-local needs a zone, which abyss addresses do not carry
+		}
+		endpoint := atype.AbyssEndpoint{Host: ip.String(), Port: port, Transport: transport}
+		if ip.IsLoopback() {
+			loopback = append(loopback, endpoint)
+			continue
+		}
+		endpoints = append(endpoints, endpoint)
+	}
+	return append(endpoints, loopback...)
+}
+
+// opens our NAT mapping toward the address, for a peer that is about to dial us.
+// punch packets leave from the listening socket, so the mapping is the one the peer dials.
+// hostnames are not resolved. returns immediately; dropped when too many punches are ongoing.
+func (n *GoQuicNetCore) Punch(address atype.AbyssAddress) {
+	var targets []netip.AddrPort
+	for _, endpoint := range address.Endpoints {
+		ip, err := netip.ParseAddr(endpoint.Host)
+		if err == nil && endpoint.Transport == atype.TransportQUIC {
+			targets = append(targets, netip.AddrPortFrom(ip, endpoint.Port))
+		}
+	}
+	if len(targets) == 0 {
+		return
+	}
+	select {
+	case n.punch_slots <- true:
+	default:
+		return
+	}
+	if !n.enter() {
+		<-n.punch_slots
+		return
+	}
+	go func() {
+		defer n.close_wg.Done()
+		defer func() { <-n.punch_slots }()
+
+		punch_ctx, punch_cancel := context.WithTimeout(n.listen_ctx, punch_duration)
+		defer punch_cancel()
+		ticker := time.NewTicker(punch_interval)
+		defer ticker.Stop()
+		for {
+			for _, target := range targets {
+				n.tr.WriteTo(punch_packet, net.UDPAddrFromAddrPort(target))
+			}
+			select {
+			case <-ticker.C:
+			case <-punch_ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+type reflexiveReport struct {
+	observed netip.AddrPort
+	closed   context.Context //the reporting connection; the report is dropped when it closes
+}
+
+// reporters within one /24 (IPv4) or /48 (IPv6) count once.
+func reflexiveReporterPrefix(ip netip.Addr) netip.Prefix {
+	bits := 48
+	if ip.Is4() {
+		bits = 24
+	}
+	prefix, _ := ip.Prefix(bits)
+	return prefix
+}
+
+func (n *GoQuicNetCore) recordReflexive(transmission *Transmission) {
+	source, err := netip.ParseAddrPort(transmission.connection.RemoteAddr().String())
+	if err != nil {
+		return
+	}
+	n.addReflexiveReport(source.Addr().Unmap(), transmission.reflexive, transmission.connection.Context())
+}
+
+// the latest report from a network replaces the previous one. when full, new networks are ignored
+// rather than evicting others, so a flood of reporters cannot push out the honest ones.
+func (n *GoQuicNetCore) addReflexiveReport(source netip.Addr, observed netip.AddrPort, closed context.Context) {
+	prefix := reflexiveReporterPrefix(source)
+
+	n.reflexive_mtx.Lock()
+	defer n.reflexive_mtx.Unlock()
+	if _, ok := n.reflexive[prefix]; !ok && len(n.reflexive) >= reflexive_max_reporters {
+		return
+	}
+	n.reflexive[prefix] = reflexiveReport{observed, closed}
+	context.AfterFunc(closed, func() {
+		n.reflexive_mtx.Lock()
+		defer n.reflexive_mtx.Unlock()
+		if n.reflexive[prefix].closed == closed {
+			delete(n.reflexive, prefix)
+		}
+	})
+}
+
+// reflexive endpoints reported from enough distinct networks, most reported first.
+func (n *GoQuicNetCore) confirmedReflexive() []atype.AbyssEndpoint {
+	n.reflexive_mtx.Lock()
+	counts := make(map[netip.AddrPort]int)
+	for _, report := range n.reflexive {
+		counts[report.observed]++
+	}
+	n.reflexive_mtx.Unlock()
+
+	confirmed := make([]netip.AddrPort, 0, len(counts))
+	for observed, count := range counts {
+		if count >= reflexive_confirmations && !observed.Addr().IsLoopback() && observed.Addr().Zone() == "" {
+			confirmed = append(confirmed, observed)
+		}
+	}
+	slices.SortFunc(confirmed, func(a netip.AddrPort, b netip.AddrPort) int {
+		if counts[a] != counts[b] {
+			return counts[b] - counts[a]
+		}
+		return a.Compare(b)
+	})
+
+	result := make([]atype.AbyssEndpoint, len(confirmed))
+	for i, observed := range confirmed {
+		result[i] = atype.AbyssEndpoint{Host: observed.Addr().String(), Port: observed.Port()}
+	}
+	return result
+}
+func (n *GoQuicNetCore) ConnectConn(conn net.Conn, address atype.AbyssAddress) (*Transmission, error) {
+	if !n.enter() {
+		return nil, context.Canceled
+	}
+	defer n.close_wg.Done()
+
+	ctx, cancel := context.WithTimeout(n.listen_ctx, n.config.HandshakeTimeout)
+	defer cancel()
+	transmission, err := dialMuxTransmission(ctx, conn, dialIdentityTLSConfig(&n.tlsConf, address.Pubkey_hash), n.config, address, makeAHMPInitMessage(n.local_identity, n.LocalAddr()), n.local_identity.Hash, n.local_signer)
+	if err != nil {
+		return nil, err
+	}
+	n.admission.trackLive(transmission.connection)
+	return transmission, nil
+}
+func (n *GoQuicNetCore) AcceptConn(conn net.Conn) (*Transmission, error) {
+	if !n.enter() {
+		return nil, context.Canceled
+	}
+	defer n.close_wg.Done()
+
+	//the address is the relay's; only the peer count, the handshake limit and the identity apply
+	if _, reason, ok := n.admission.admitRelayed(); !ok {
+		conn.Close()
+		return nil, errors.New("refused relayed connection: " + reason)
+	}
+	ctx, cancel := context.WithTimeout(n.listen_ctx, n.config.HandshakeTimeout)
+	defer cancel()
+	transmission, err := acceptMuxTransmission(ctx, conn, &n.tlsConf, n.config, makeAHMPInitMessage(n.local_identity, n.LocalAddr()), n.local_identity.Hash, n.local_signer)
+	n.admission.handshakeDone()
+	if err == nil {
+		err = n.admission.admitIdentity(transmission)
+	}
+	if err != nil {
+		n.admission.releaseLive()
+		return nil, err
+	}
+	context.AfterFunc(transmission.connection.Context(), n.admission.releaseLive)
+	return transmission, nil
+}
 func (n *GoQuicNetCore) Close() {
+	n.close_mtx.Lock()
 	n.listen_cancel()
+	n.close_mtx.Unlock()
+	if n.fallback != nil {
+		n.fallback.Close()
+	}
 	n.close_wg.Wait()
 }
+
+// admission counters of a net core, for the limits in NetCoreConfig.
+type admission struct {
+	config  NetCoreConfig
+	mtx     sync.Mutex
+	live    int //connections handed out and not closed yet, and pending incoming ones
+	pending int
+	per_ip  map[netip.Addr]int
+}
+
+func newAdmission(config NetCoreConfig) *admission {
+	result := new(admission)
+	result.config = config
+	result.per_ip = make(map[netip.Addr]int)
+	return result
+}
+
+// reserves a live connection and a handshake slot for the remote, or tells why not.
+func (a *admission) admit(remote netip.AddrPort) (quic.ApplicationErrorCode, string, bool) {
+	if a.config.AdmitAddress != nil && !a.config.AdmitAddress(remote) {
+		return CloseAddressRejected, "address rejected", false
+	}
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	if a.config.MaxPeers > 0 && a.live >= a.config.MaxPeers {
+		return CloseTooManyPeers, "too many peers", false
+	}
+	if a.pending >= a.config.MaxPendingHandshakes {
+		return CloseTooManyHandshakes, "too many pending handshakes", false
+	}
+	if a.config.MaxConnectionsPerIP > 0 && a.per_ip[remote.Addr()] >= a.config.MaxConnectionsPerIP {
+		return CloseTooManyFromIP, "too many connections from this address", false
+	}
+	a.live++
+	a.pending++
+	a.per_ip[remote.Addr()]++
+	return 0, "", true
+}
+
+func (a *admission) release(ip netip.Addr) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	a.live--
+	if a.per_ip[ip]--; a.per_ip[ip] == 0 {
+		delete(a.per_ip, ip)
+	}
+}
+
+// reserves a live connection and a handshake slot for a relayed connection, where the address says nothing.
+func (a *admission) admitRelayed() (quic.ApplicationErrorCode, string, bool) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	if a.config.MaxPeers > 0 && a.live >= a.config.MaxPeers {
+		return CloseTooManyPeers, "too many peers", false
+	}
+	if a.pending >= a.config.MaxPendingHandshakes {
+		return CloseTooManyHandshakes, "too many pending handshakes", false
+	}
+	a.live++
+	a.pending++
+	return 0, "", true
+}
+
+// counts an outgoing connection toward MaxPeers until it closes.
+func (a *admission) trackLive(connection quic.Connection) {
+	a.mtx.Lock()
+	a.live++
+	a.mtx.Unlock()
+	context.AfterFunc(connection.Context(), a.releaseLive)
+}
+
+func (a *admission) releaseLive() {
+	a.mtx.Lock()
+	a.live--
+	a.mtx.Unlock()
+}
+
+// the verified identity hash against AdmitIdentity.
+func (a *admission) admitIdentity(transmission *Transmission) error {
+	if a.config.AdmitIdentity != nil && !a.config.AdmitIdentity(transmission.GetHash()) {
+		transmission.connection.CloseWithError(CloseIdentityRejected, "identity rejected")
+		return errors.New("refused " + transmission.GetHash() + ": identity rejected")
+	}
+	return nil
+}
+
+// a handshake slot alone, for telling a refused dialer why.
+func (a *admission) reserveHandshake() bool {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	if a.pending >= a.config.MaxPendingHandshakes {
+		return false
+	}
+	a.pending++
+	return true
+}
+
+func (a *admission) handshakeDone() {
+	a.mtx.Lock()
+	a.pending--
+	a.mtx.Unlock()
+}
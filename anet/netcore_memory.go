@@ -0,0 +1,217 @@
+package anet
+
+import (
+	"abyss/atype"
+	"context"
+	"crypto"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+)
+
+// in-process network for MemoryNetCore. each host gets its own 10.x.x.x address.
+type MemoryNetwork struct {
+	mtx   sync.Mutex
+	hosts map[netip.AddrPort]*MemoryNetCore
+	next  uint32
+}
+
+func NewMemoryNetwork() *MemoryNetwork {
+	result := new(MemoryNetwork)
+	result.hosts = make(map[netip.AddrPort]*MemoryNetCore)
+	result.next = 1
+	return result
+}
+
+func (m *MemoryNetwork) register(host *MemoryNetCore) netip.AddrPort {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	n := m.next
+	m.next++
+	endpoint := netip.AddrPortFrom(netip.AddrFrom4([4]byte{10, byte(n >> 16), byte(n >> 8), byte(n)}), 1605)
+	m.hosts[endpoint] = host
+	return endpoint
+}
+
+func (m *MemoryNetwork) unregister(endpoint netip.AddrPort) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	delete(m.hosts, endpoint)
+}
+
+func (m *MemoryNetwork) lookup(endpoint netip.AddrPort) (*MemoryNetCore, bool) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	host, ok := m.hosts[endpoint]
+	return host, ok
+}
+
+// net.Pipe end that reports network addresses, so the observed address works as with UDP.
+type memoryPipeConn struct {
+	net.Conn
+	local  net.Addr
+	remote net.Addr
+}
+
+func (c *memoryPipeConn) LocalAddr() net.Addr  { return c.local }
+func (c *memoryPipeConn) RemoteAddr() net.Addr { return c.remote }
+
+// INetCore over in-memory pipes. TLS and the AHMP ID exchange run exactly as over QUIC,
+// on top of a muxConnection; only the transport is replaced.
+type MemoryNetCore struct {
+	network        *MemoryNetwork
+	endpoint       netip.AddrPort
+	local_identity atype.AbyssIdentity
+	local_signer   crypto.Signer
+	ahmp_init_msg  []byte
+	tlsConf        tls.Config
+	config         NetCoreConfig //defaults; only the stream limits apply
+
+	accepted chan acceptResult
+
+	listen_ctx    context.Context
+	listen_cancel context.CancelFunc
+	close_mtx     sync.Mutex //orders close_wg.Add before the Wait in Close
+	close_wg      sync.WaitGroup
+}
+
+func NewMemoryNetCore(network *MemoryNetwork, local_private_identity atype.AbyssPrivateIdentity) (*MemoryNetCore, error) {
+	if err := checkIdentityKey(local_private_identity); err != nil {
+		return nil, err
+	}
+
+	result := new(MemoryNetCore)
+	result.network = network
+	result.local_identity = local_private_identity.Identity
+	result.local_signer = local_private_identity.Privatekey
+	result.config = NetCoreConfig{}.withDefaults()
+	result.accepted = make(chan acceptResult, 32)
+	result.listen_ctx, result.listen_cancel = context.WithCancel(context.Background())
+
+	var err error
+	result.tlsConf, err = newIdentityTLSConfig(local_private_identity)
+	if err != nil {
+		return nil, err
+	}
+
+	result.endpoint = network.register(result)
+	result.ahmp_init_msg = makeAHMPInitMessage(result.local_identity, result.LocalAddr())
+	return result, nil
+}
+
+// false once the host is closed; otherwise the caller must call close_wg.Done.
+func (n *MemoryNetCore) enter() bool {
+	n.close_mtx.Lock()
+	defer n.close_mtx.Unlock()
+	if n.listen_ctx.Err() != nil {
+		return false
+	}
+	n.close_wg.Add(1)
+	return true
+}
+
+// endpoints are tried in order. hostnames are not resolved in memory.
+func (n *MemoryNetCore) Connect(abyss_address atype.AbyssAddress) (*Transmission, error) {
+	if !n.enter() {
+		return nil, context.Canceled
+	}
+	defer n.close_wg.Done()
+
+	last_err := errors.New("no reachable endpoint")
+	for _, endpoint := range abyss_address.Endpoints {
+		ip, err := netip.ParseAddr(endpoint.Host)
+		if err != nil {
+			continue
+		}
+		transmission, err := n.connectEndpoint(abyss_address, netip.AddrPortFrom(ip, endpoint.Port))
+		if err == nil {
+			return transmission, nil
+		}
+		last_err = err
+	}
+	return nil, last_err
+}
+
+func (n *MemoryNetCore) connectEndpoint(abyss_address atype.AbyssAddress, endpoint netip.AddrPort) (*Transmission, error) {
+	if n.listen_ctx.Err() != nil {
+		return nil, n.listen_ctx.Err()
+	}
+	remote, ok := n.network.lookup(endpoint)
+	if !ok {
+		return nil, errors.New("host unreachable")
+	}
+
+	local_end, remote_end := net.Pipe()
+	local_addr := net.UDPAddrFromAddrPort(n.endpoint)
+	remote_addr := net.UDPAddrFromAddrPort(endpoint)
+	if !remote.deliver(&memoryPipeConn{remote_end, remote_addr, local_addr}) {
+		local_end.Close()
+		return nil, errors.New("host unreachable")
+	}
+
+	return dialMuxTransmission(n.listen_ctx, &memoryPipeConn{local_end, local_addr, remote_addr}, dialIdentityTLSConfig(&n.tlsConf, abyss_address.Pubkey_hash), n.config, abyss_address, n.ahmp_init_msg, n.local_identity.Hash, n.local_signer)
+}
+
+// runs the server side of an incoming pipe. false if the host is closed.
+func (n *MemoryNetCore) deliver(conn net.Conn) bool {
+	if !n.enter() {
+		return false
+	}
+	go func() {
+		defer n.close_wg.Done()
+
+		transmission, err := n.acceptConn(conn)
+		select {
+		case n.accepted <- acceptResult{transmission, err}:
+		case <-n.listen_ctx.Done():
+			if transmission != nil {
+				transmission.connection.CloseWithError(0, "host closed")
+			}
+		}
+	}()
+	return true
+}
+
+func (n *MemoryNetCore) acceptConn(conn net.Conn) (*Transmission, error) {
+	return acceptMuxTransmission(n.listen_ctx, conn, &n.tlsConf, n.config, n.ahmp_init_msg, n.local_identity.Hash, n.local_signer)
+}
+
+// context.Canceled after Close.
+func (n *MemoryNetCore) Accept() (*Transmission, error) {
+	select {
+	case result := <-n.accepted:
+		return result.transmission, result.err
+	case <-n.listen_ctx.Done():
+		return nil, context.Canceled
+	}
+}
+func (n *MemoryNetCore) LocalIdentity() atype.AbyssIdentity {
+	return n.local_identity
+}
+func (n *MemoryNetCore) LocalAddr() atype.AbyssAddress {
+	address, _ := atype.MakeAbyssAddress(n.local_identity.Hash, n.endpoint.Addr().String(), n.endpoint.Port(), "")
+	return address
+}
+func (n *MemoryNetCore) ConnectConn(conn net.Conn, address atype.AbyssAddress) (*Transmission, error) {
+	if !n.enter() {
+		return nil, context.Canceled
+	}
+	defer n.close_wg.Done()
+	return dialMuxTransmission(n.listen_ctx, conn, dialIdentityTLSConfig(&n.tlsConf, address.Pubkey_hash), n.config, address, n.ahmp_init_msg, n.local_identity.Hash, n.local_signer)
+}
+func (n *MemoryNetCore) AcceptConn(conn net.Conn) (*Transmission, error) {
+	if !n.enter() {
+		return nil, context.Canceled
+	}
+	defer n.close_wg.Done()
+	return n.acceptConn(conn)
+}
+func (n *MemoryNetCore) Close() {
+	n.network.unregister(n.endpoint)
+	n.close_mtx.Lock()
+	n.listen_cancel()
+	n.close_mtx.Unlock()
+	n.close_wg.Wait()
+}
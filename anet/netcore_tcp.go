@@ -0,0 +1,252 @@
+package anet
+
+import (
+	"abyss/atype"
+	"context"
+	"crypto"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// INetCore over TLS on TCP, for networks that block UDP. sessions run on a muxConnection with the same
+// identity certificates and AHMP ID exchange as QUIC, so Networker and Peer handle them alike.
+// there is no 0-RTT, hole punching or reflexive address; the endpoints are marked atype.TransportTCP,
+// and Connect dials only such endpoints.
+type TcpNetCore struct {
+	local_identity atype.AbyssIdentity
+	local_signer   crypto.Signer
+	resolver       IResolver
+	config         NetCoreConfig
+	tlsConf        tls.Config
+	ln             *net.TCPListener
+
+	interface_addrs func() ([]net.Addr, error) //net.InterfaceAddrs
+	local_addr      func() atype.AbyssAddress  //advertised in the ID exchange. set by GoQuicNetCore for its fallback
+	accepted        chan acceptResult
+	admission       *admission
+
+	listen_ctx    context.Context
+	listen_cancel context.CancelFunc
+	close_mtx     sync.Mutex //orders close_wg.Add before the Wait in Close
+	close_wg      sync.WaitGroup
+}
+
+// listens on bind_address; nil: all interfaces, random port.
+// the timeouts and admission limits of config apply, the QUIC and UDP settings do not.
+func NewTcpNetCore(local_private_identity atype.AbyssPrivateIdentity, bind_address *net.TCPAddr, config NetCoreConfig) (*TcpNetCore, error) {
+	config = config.withDefaults()
+	result, err := newTcpNetCore(local_private_identity, bind_address, config, newAdmission(config))
+	if err != nil {
+		return nil, err
+	}
+	result.start()
+	return result, nil
+}
+
+// the admission is shared with the QUIC net core when this is its fallback.
+func newTcpNetCore(local_private_identity atype.AbyssPrivateIdentity, bind_address *net.TCPAddr, config NetCoreConfig, admission *admission) (*TcpNetCore, error) {
+	if err := checkIdentityKey(local_private_identity); err != nil {
+		return nil, err
+	}
+
+	result := new(TcpNetCore)
+	result.local_identity = local_private_identity.Identity
+	result.local_signer = local_private_identity.Privatekey
+	result.resolver = net.DefaultResolver
+	result.config = config
+	result.interface_addrs = net.InterfaceAddrs
+	result.local_addr = result.LocalAddr
+	result.accepted = make(chan acceptResult, 32)
+	result.admission = admission
+
+	var err error
+	result.tlsConf, err = newIdentityTLSConfig(local_private_identity)
+	if err != nil {
+		return nil, err
+	}
+	if bind_address == nil {
+		bind_address = &net.TCPAddr{}
+	}
+	result.ln, err = net.ListenTCP("tcp", bind_address)
+	if err != nil {
+		return nil, err
+	}
+	result.listen_ctx, result.listen_cancel = context.WithCancel(context.Background())
+	return result, nil
+}
+
+func (n *TcpNetCore) start() {
+	n.close_wg.Add(1)
+	go n.acceptLoop()
+}
+
+// call before any Connect.
+func (n *TcpNetCore) SetResolver(resolver IResolver) {
+	n.resolver = resolver
+}
+
+// false once the host is closed; otherwise the caller must call close_wg.Done.
+func (n *TcpNetCore) enter() bool {
+	n.close_mtx.Lock()
+	defer n.close_mtx.Unlock()
+	if n.listen_ctx.Err() != nil {
+		return false
+	}
+	n.close_wg.Add(1)
+	return true
+}
+
+// TCP endpoints are tried in order.
+func (n *TcpNetCore) Connect(abyss_address atype.AbyssAddress) (*Transmission, error) {
+	if !n.enter() {
+		return nil, context.Canceled
+	}
+	defer n.close_wg.Done()
+
+	endpoints, err := resolveEndpoints(n.listen_ctx, n.resolver, n.config.DialTimeout, abyss_address.Endpoints, atype.TransportTCP)
+	if err != nil {
+		return nil, err
+	}
+	var last_err error
+	for _, endpoint := range endpoints {
+		transmission, err := n.connectEndpoint(abyss_address, endpoint)
+		if err == nil {
+			return transmission, nil
+		}
+		last_err = err
+	}
+	return nil, last_err
+}
+
+func (n *TcpNetCore) connectEndpoint(abyss_address atype.AbyssAddress, endpoint netip.AddrPort) (*Transmission, error) {
+	dial_ctx, dial_cancel := context.WithTimeout(n.listen_ctx, n.config.DialTimeout)
+	defer dial_cancel()
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(dial_ctx, "tcp", endpoint.String())
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(n.listen_ctx, n.config.DialTimeout+n.config.HandshakeTimeout)
+	defer cancel()
+	transmission, err := dialMuxTransmission(ctx, conn, dialIdentityTLSConfig(&n.tlsConf, abyss_address.Pubkey_hash), n.config, abyss_address, makeAHMPInitMessage(n.local_identity, n.local_addr()), n.local_identity.Hash, n.local_signer)
+	if err != nil {
+		return nil, err
+	}
+	transmission.setOverTCP()
+	n.admission.trackLive(transmission.connection)
+	return transmission, nil
+}
+
+// runs the TLS and ID handshakes concurrently, within the admission limits.
+func (n *TcpNetCore) acceptLoop() {
+	defer n.close_wg.Done()
+	for {
+		conn, err := n.ln.Accept()
+		if err != nil {
+			return
+		}
+		remote := conn.RemoteAddr().(*net.TCPAddr).AddrPort()
+		remote = netip.AddrPortFrom(remote.Addr().Unmap(), remote.Port())
+		code, reason, ok := n.admission.admit(remote)
+		if !ok && (code == CloseTooManyHandshakes || !n.admission.reserveHandshake()) {
+			//no TLS handshake to tell why; that is what the limit saves
+			conn.Close()
+			n.deliverAccepted(acceptResult{nil, errors.New("refused " + remote.String() + ": " + reason)})
+			continue
+		}
+
+		n.close_wg.Add(1)
+		go func() {
+			defer n.close_wg.Done()
+			if !ok {
+				//telling why costs a TLS handshake too; it holds a handshake slot, for HandshakeTimeout at most
+				ctx, cancel := context.WithTimeout(n.listen_ctx, n.config.HandshakeTimeout)
+				refuseMuxConnection(ctx, conn, &n.tlsConf, n.config, code, reason)
+				cancel()
+				n.admission.handshakeDone()
+				n.deliverAccepted(acceptResult{nil, errors.New("refused " + remote.String() + ": " + reason)})
+				return
+			}
+
+			ctx, cancel := context.WithTimeout(n.listen_ctx, n.config.DialTimeout+n.config.HandshakeTimeout)
+			defer cancel()
+			transmission, err := acceptMuxTransmission(ctx, conn, &n.tlsConf, n.config, makeAHMPInitMessage(n.local_identity, n.local_addr()), n.local_identity.Hash, n.local_signer)
+			n.admission.handshakeDone()
+			if err == nil {
+				err = n.admission.admitIdentity(transmission)
+			}
+			if err != nil {
+				n.admission.release(remote.Addr())
+				n.deliverAccepted(acceptResult{nil, err})
+				return
+			}
+			transmission.setOverTCP()
+			context.AfterFunc(transmission.connection.Context(), func() { n.admission.release(remote.Addr()) })
+			n.deliverAccepted(acceptResult{transmission, nil})
+		}()
+	}
+}
+
+func (n *TcpNetCore) deliverAccepted(result acceptResult) {
+	select {
+	case n.accepted <- result:
+	case <-n.listen_ctx.Done():
+		if result.transmission != nil {
+			result.transmission.connection.CloseWithError(0, "host closed")
+		}
+	}
+}
+
+// context.DeadlineExceeded when nothing arrives within AcceptTimeout, context.Canceled after Close.
+func (n *TcpNetCore) Accept() (*Transmission, error) {
+	select {
+	case result := <-n.accepted:
+		return result.transmission, result.err
+	case <-time.After(n.config.AcceptTimeout):
+		return nil, context.DeadlineExceeded
+	case <-n.listen_ctx.Done():
+		return nil, context.Canceled
+	}
+}
+func (n *TcpNetCore) LocalIdentity() atype.AbyssIdentity {
+	return n.local_identity
+}
+func (n *TcpNetCore) LocalAddr() atype.AbyssAddress {
+	address, ok := atype.MakeAbyssAddressMulti(n.local_identity.Hash, n.localEndpoints(), "")
+	if !ok {
+		address, _ = atype.MakeAbyssAddressMulti(n.local_identity.Hash, []atype.AbyssEndpoint{{Host: "127.0.0.1", Port: n.listenPort(), Transport: atype.TransportTCP}}, "")
+	}
+	return address
+}
+
+// not ListenPort: LAN discovery announces a UDP port (see IListenPort).
+func (n *TcpNetCore) listenPort() uint16 {
+	return n.ln.Addr().(*net.TCPAddr).AddrPort().Port()
+}
+
+func (n *TcpNetCore) localEndpoints() []atype.AbyssEndpoint {
+	port := n.listenPort()
+
+	bind_ip, _ := netip.AddrFromSlice(n.ln.Addr().(*net.TCPAddr).IP)
+	bind_ip = bind_ip.Unmap()
+	if bind_ip.IsValid() && !bind_ip.IsUnspecified() {
+		return []atype.AbyssEndpoint{{Host: bind_ip.String(), Port: port, Transport: atype.TransportTCP}}
+	}
+	endpoints := interfaceEndpoints(n.interface_addrs, bind_ip.Is4(), port, atype.TransportTCP)
+	if len(endpoints) == 0 {
+		endpoints = append(endpoints, atype.AbyssEndpoint{Host: "127.0.0.1", Port: port, Transport: atype.TransportTCP})
+	}
+	return endpoints
+}
+func (n *TcpNetCore) Close() {
+	n.close_mtx.Lock()
+	n.listen_cancel()
+	n.close_mtx.Unlock()
+	n.ln.Close()
+	n.close_wg.Wait()
+}
@@ -2,33 +2,35 @@ package anet
 
 import (
 	"abyss/atype"
+	"bytes"
+	"context"
 	"crypto/ed25519"
 	"crypto/rand"
-	"crypto/x509"
-	"encoding/pem"
+	"errors"
 	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
 )
 
 func CreateRandomHost() (ed25519.PrivateKey, ed25519.PublicKey, INetCore, error) {
-	pub_key1, priv_key, err := ed25519.GenerateKey(rand.Reader)
-	if err != nil {
-		return nil, nil, nil, err
-	}
-	pubkey1, err := x509.MarshalPKIXPublicKey(pub_key1)
+	id1, err := atype.GenerateAbyssPrivateIdentity("host1")
 	if err != nil {
 		return nil, nil, nil, err
 	}
-	pemfile1 := pem.EncodeToMemory(&pem.Block{Type: "OPENSSH PUBLIC KEY", Bytes: pubkey1})
-	id1, err := atype.MakeAbyssIdentity(pemfile1, "host1")
+	nc1, err := NewGoQuicNetCore(id1, NetCoreConfig{})
 	if err != nil {
 		return nil, nil, nil, err
 	}
-	nc1, err := NewGoQuicNetCore(id1)
-	if err != nil {
-		return nil, nil, nil, err
-	}
-	return priv_key, pub_key1, nc1, nil
+	priv_key := id1.Privatekey.(ed25519.PrivateKey)
+	return priv_key, priv_key.Public().(ed25519.PublicKey), nc1, nil
 }
 
 func TestNetCoreSimple(t *testing.T) {
@@ -134,3 +136,1480 @@ func TestSimultaneousConnect(t *testing.T) {
 		t.Error(err2.Error())
 	}
 }
+
+func TestNetCoreImpersonation(t *testing.T) {
+	_, _, nc1, err := CreateRandomHost()
+	if err != nil {
+		t.Fatal("failed to generate net core: " + err.Error())
+	}
+	_, _, nc2, err := CreateRandomHost()
+	if err != nil {
+		t.Fatal("failed to generate net core: " + err.Error())
+	}
+
+	//nc2 advertises its public key, but signs with an unrelated private key.
+	_, other_priv_key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nc2.(*GoQuicNetCore).local_signer = other_priv_key
+
+	//the impostor may finish its side of the handshake, but the honest side must reject it.
+	accept_err := make(chan error, 1)
+	go func() {
+		_, err := nc1.Accept()
+		accept_err <- err
+	}()
+	nc2.Connect(nc1.LocalAddr())
+	if <-accept_err == nil {
+		t.Fatal("impostor accepted")
+	}
+
+	go func() {
+		_, err := nc2.Accept()
+		accept_err <- err
+	}()
+	_, err = nc1.Connect(nc2.LocalAddr())
+	if err == nil {
+		t.Fatal("connected to impostor")
+	}
+	<-accept_err
+}
+
+func TestIdentityProofDirection(t *testing.T) {
+	binding := []byte("binding")
+	nonce_a := bytes.Repeat([]byte{1}, ahmp_id_nonce_size)
+	nonce_b := bytes.Repeat([]byte{2}, ahmp_id_nonce_size)
+
+	//a host sharing the peer's identity cannot echo the peer's proof as its own
+	a_proves := makeIdentityProofPayload(binding, nonce_b, nonce_a, "hash")
+	b_proves := makeIdentityProofPayload(binding, nonce_a, nonce_b, "hash")
+	if bytes.Equal(a_proves, b_proves) {
+		t.Fatal("proof payload does not depend on direction")
+	}
+}
+
+// reads the same bytes each time, so both ends of a handshake pick the same nonce.
+type testFixedReader struct{}
+
+func (testFixedReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 7
+	}
+	return len(p), nil
+}
+
+func TestIdentityChallengeEcho(t *testing.T) {
+	network := NewMemoryNetwork()
+	nc1, _ := CreateMemoryHost(network, "host1")
+	nc2, _ := CreateMemoryHost(network, "host2")
+	defer nc1.Close()
+	defer nc2.Close()
+
+	//each end sees its own challenge come back
+	id_nonce_source = testFixedReader{}
+	defer func() { id_nonce_source = rand.Reader }()
+	accept_err := make(chan error, 1)
+	go func() {
+		_, err := nc1.Accept()
+		accept_err <- err
+	}()
+	if _, err := nc2.Connect(nc1.LocalAddr()); err == nil || !strings.Contains(err.Error(), "invalid id challenge") {
+		t.Fatal("echoed challenge accepted: " + fmt.Sprint(err))
+	}
+	if <-accept_err == nil {
+		t.Fatal("echoed challenge accepted on the accepting side")
+	}
+}
+
+func TestNetCoreCertificateHashMismatch(t *testing.T) {
+	_, _, nc1, err := CreateRandomHost()
+	if err != nil {
+		t.Fatal("failed to generate net core: " + err.Error())
+	}
+	_, _, nc2, err := CreateRandomHost()
+	if err != nil {
+		t.Fatal("failed to generate net core: " + err.Error())
+	}
+	_, _, nc3, err := CreateRandomHost()
+	if err != nil {
+		t.Fatal("failed to generate net core: " + err.Error())
+	}
+
+	//nc1 is reachable at this address, but nc2 expects nc3 there.
+	wrong_address := nc1.LocalAddr()
+	wrong_address.Pubkey_hash = nc3.LocalIdentity().Hash
+
+	accept_err := make(chan error, 1)
+	go func() {
+		_, err := nc1.Accept()
+		accept_err <- err
+	}()
+	_, err = nc2.Connect(wrong_address)
+	if err == nil {
+		t.Fatal("connected to wrong host")
+	}
+	if <-accept_err == nil {
+		t.Fatal("accepted aborted handshake")
+	}
+}
+
+func TestNetCoreIpv6(t *testing.T) {
+	probe, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback})
+	if err != nil {
+		t.Skip("no IPv6 loopback")
+	}
+	probe.Close()
+
+	_, _, nc1, err := CreateRandomHost()
+	if err != nil {
+		t.Fatal("failed to generate net core: " + err.Error())
+	}
+	_, _, nc2, err := CreateRandomHost()
+	if err != nil {
+		t.Fatal("failed to generate net core: " + err.Error())
+	}
+
+	address, ok := atype.MakeAbyssAddress(nc1.LocalIdentity().Hash, "::1", nc1.LocalAddr().Port, "")
+	if !ok {
+		t.Fatal("failed to make address")
+	}
+
+	accept_err := make(chan error, 1)
+	go func() {
+		_, err := nc1.Accept()
+		accept_err <- err
+	}()
+	if _, err := nc2.Connect(address); err != nil {
+		t.Fatal("failed to connect: " + err.Error())
+	}
+	if err := <-accept_err; err != nil {
+		t.Fatal("failed to accept: " + err.Error())
+	}
+}
+
+func TestNetCoreEndpointRace(t *testing.T) {
+	_, _, nc1, err := CreateRandomHost()
+	if err != nil {
+		t.Fatal("failed to generate net core: " + err.Error())
+	}
+	_, _, nc2, err := CreateRandomHost()
+	if err != nil {
+		t.Fatal("failed to generate net core: " + err.Error())
+	}
+
+	//a black hole endpoint first; the dial must not wait for it to time out.
+	black_hole, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer black_hole.Close()
+	address, ok := atype.MakeAbyssAddressMulti(nc1.LocalIdentity().Hash, []atype.AbyssEndpoint{
+		{Host: "127.0.0.1", Port: uint16(black_hole.LocalAddr().(*net.UDPAddr).Port)},
+		{Host: "127.0.0.1", Port: nc1.LocalAddr().Port},
+	}, "")
+	if !ok {
+		t.Fatal("failed to make address")
+	}
+
+	accept_err := make(chan error, 1)
+	go func() {
+		_, err := nc1.Accept()
+		accept_err <- err
+	}()
+	start := time.Now()
+	if _, err := nc2.Connect(address); err != nil {
+		t.Fatal("failed to connect: " + err.Error())
+	}
+	if time.Since(start) > time.Second*2 {
+		t.Fatal("endpoint race waited for the dead endpoint")
+	}
+	if err := <-accept_err; err != nil {
+		t.Fatal("failed to accept: " + err.Error())
+	}
+}
+
+// forwards UDP datagrams from one client to target and back, each delayed, like a long path.
+func startDelayProxy(t *testing.T, target netip.AddrPort, delay time.Duration) (uint16, func()) {
+	front, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	back, err := net.DialUDP("udp4", nil, net.UDPAddrFromAddrPort(target))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := make(chan *net.UDPAddr, 1)
+	go func() {
+		buf := make([]byte, 2048)
+		for first := true; ; first = false {
+			n, addr, err := front.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			if first {
+				client <- addr
+			}
+			packet := bytes.Clone(buf[:n])
+			time.AfterFunc(delay, func() { back.Write(packet) })
+		}
+	}()
+	go func() {
+		buf := make([]byte, 2048)
+		var addr *net.UDPAddr
+		for {
+			n, err := back.Read(buf)
+			if err != nil {
+				return
+			}
+			if addr == nil {
+				addr = <-client
+			}
+			packet := bytes.Clone(buf[:n])
+			time.AfterFunc(delay, func() { front.WriteToUDP(packet, addr) })
+		}
+	}()
+	return uint16(front.LocalAddr().(*net.UDPAddr).Port), func() {
+		front.Close()
+		back.Close()
+	}
+}
+
+func isSuperseded(err error) bool {
+	var app_err *quic.ApplicationError
+	return errors.As(err, &app_err) && app_err.Remote && app_err.ErrorCode == CloseSuperseded
+}
+
+func TestNetCoreEndpointRaceSuperseded(t *testing.T) {
+	_, _, nc1, err := CreateRandomHost()
+	if err != nil {
+		t.Fatal("failed to generate net core: " + err.Error())
+	}
+	identity, _ := atype.GenerateAbyssPrivateIdentity("host2")
+	nc2, err := NewGoQuicNetCore(identity, NetCoreConfig{AcceptTimeout: time.Second})
+	if err != nil {
+		t.Fatal("failed to generate net core: " + err.Error())
+	}
+	defer nc1.Close()
+	defer nc2.Close()
+
+	//the first endpoint is slow: still in the ID exchange when the second one wins
+	proxy_port, stop := startDelayProxy(t, netip.AddrPortFrom(netip.MustParseAddr("127.0.0.1"), nc1.LocalAddr().Port), time.Millisecond*100)
+	defer stop()
+	address, _ := atype.MakeAbyssAddressMulti(nc1.LocalIdentity().Hash, []atype.AbyssEndpoint{
+		{Host: "127.0.0.1", Port: proxy_port},
+		{Host: "127.0.0.1", Port: nc1.LocalAddr().Port},
+	}, "")
+
+	accepted := make(chan acceptResult, 4)
+	go func() {
+		for {
+			session, err := nc1.Accept()
+			if err == context.Canceled {
+				return
+			}
+			if err != context.DeadlineExceeded {
+				accepted <- acceptResult{session, err}
+			}
+		}
+	}()
+	winner, err := nc2.Connect(address)
+	if err != nil {
+		t.Fatal("failed to connect: " + err.Error())
+	}
+	if winner.connection.RemoteAddr().(*net.UDPAddr).Port != int(nc1.LocalAddr().Port) {
+		t.Fatal("slow endpoint won")
+	}
+
+	//the acceptor sees the slow attempt end as superseded, whether or not it finished the ID exchange
+	superseded := false
+	for !superseded {
+		select {
+		case result := <-accepted:
+			if result.err != nil {
+				superseded = isSuperseded(result.err)
+				break
+			}
+			if result.transmission.connection.RemoteAddr().(*net.UDPAddr).Port == int(nc2.LocalAddr().Port) {
+				continue //the winner
+			}
+			select {
+			case <-result.transmission.connection.Context().Done():
+			case <-time.After(time.Second * 3):
+				t.Fatal("late session not closed")
+			}
+			superseded = isSuperseded(context.Cause(result.transmission.connection.Context()))
+		case <-time.After(time.Second * 3):
+			t.Fatal("slow attempt not closed as superseded")
+		}
+	}
+	//and the dialer does not get it as an inbound session
+	if session, err := nc2.Accept(); err != context.DeadlineExceeded {
+		t.Fatal("extra session on the dialer: " + fmt.Sprint(session, err))
+	}
+}
+
+func TestMergeAdvertisedAddress(t *testing.T) {
+	hash := "fJa6v71dbjNvQfoBNMdLqtflUIZNLvd4Q3XUl67Ypi0i"
+	observed, _ := atype.MakeAbyssAddress(hash, "203.0.113.5", 21605, "")
+	advertised, _ := atype.MakeAbyssAddressMulti(hash, []atype.AbyssEndpoint{
+		{Host: "127.0.0.1", Port: 1605},
+		{Host: "192.168.0.2", Port: 1605},
+		{Host: "203.0.113.5", Port: 21605},
+	}, "")
+
+	merged := mergeAdvertisedAddress(observed, advertised)
+	if merged.Text != "abyss:"+hash+":203.0.113.5:21605,192.168.0.2:1605" {
+		t.Fatal("unexpected merge result: " + merged.Text)
+	}
+}
+
+type FakeResolver struct {
+	records map[string][]netip.Addr
+}
+
+func (r *FakeResolver) LookupNetIP(ctx context.Context, network string, host string) ([]netip.Addr, error) {
+	ips, ok := r.records[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return ips, nil
+}
+
+func TestNetCoreHostname(t *testing.T) {
+	_, _, nc1, err := CreateRandomHost()
+	if err != nil {
+		t.Fatal("failed to generate net core: " + err.Error())
+	}
+	_, _, nc2, err := CreateRandomHost()
+	if err != nil {
+		t.Fatal("failed to generate net core: " + err.Error())
+	}
+	_, _, nc3, err := CreateRandomHost()
+	if err != nil {
+		t.Fatal("failed to generate net core: " + err.Error())
+	}
+
+	//the first record is a dead address; the next one must be tried.
+	nc2.(*GoQuicNetCore).SetResolver(&FakeResolver{records: map[string][]netip.Addr{
+		"world.example.org": {netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("127.0.0.1")},
+	}})
+	address, ok := atype.MakeAbyssAddress(nc1.LocalIdentity().Hash, "world.example.org", nc1.LocalAddr().Port, "/lobby")
+	if !ok {
+		t.Fatal("failed to make address")
+	}
+
+	accept_err := make(chan error, 1)
+	go func() {
+		_, err := nc1.Accept()
+		accept_err <- err
+	}()
+	if _, err := nc2.Connect(address); err != nil {
+		t.Fatal("failed to connect: " + err.Error())
+	}
+	if err := <-accept_err; err != nil {
+		t.Fatal("failed to accept: " + err.Error())
+	}
+
+	//the hash check still applies after resolution
+	wrong_address, _ := atype.MakeAbyssAddress(nc3.LocalIdentity().Hash, "world.example.org", nc1.LocalAddr().Port, "/lobby")
+	if _, err := nc2.Connect(wrong_address); err == nil {
+		t.Fatal("connected to wrong host")
+	}
+
+	unknown_address, _ := atype.MakeAbyssAddress(nc1.LocalIdentity().Hash, "nowhere.example.org", nc1.LocalAddr().Port, "/lobby")
+	if _, err := nc2.Connect(unknown_address); err == nil {
+		t.Fatal("connected to unresolvable host")
+	}
+}
+
+func TestNetCoreRotatedIdentity(t *testing.T) {
+	old_identity, err := atype.GenerateAbyssPrivateIdentity("host1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, new_key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	new_identity, err := atype.RotateAbyssPrivateIdentity(old_identity, new_key, "host1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nc1, err := NewGoQuicNetCore(new_identity, NetCoreConfig{})
+	if err != nil {
+		t.Fatal("failed to generate net core: " + err.Error())
+	}
+	_, _, nc2, err := CreateRandomHost()
+	if err != nil {
+		t.Fatal("failed to generate net core: " + err.Error())
+	}
+
+	//nc2 only knows the old hash
+	old_address := nc1.LocalAddr()
+	old_address.Pubkey_hash = old_identity.Identity.Hash
+
+	go nc1.Accept()
+	remote, err := nc2.Connect(old_address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if remote.GetHash() != new_identity.Identity.Hash {
+		t.Fatal("rotated identity not presented")
+	}
+	if !remote.IsKnownAs(old_identity.Identity.Hash) {
+		t.Fatal("previous hash not recorded")
+	}
+}
+
+func CreateMemoryHost(network *MemoryNetwork, name string) (*MemoryNetCore, error) {
+	identity, err := atype.GenerateAbyssPrivateIdentity(name)
+	if err != nil {
+		return nil, err
+	}
+	return NewMemoryNetCore(network, identity)
+}
+
+func TestMemoryNetCore(t *testing.T) {
+	network := NewMemoryNetwork()
+	nc1, err := CreateMemoryHost(network, "host1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nc2, err := CreateMemoryHost(network, "host2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nc3, err := CreateMemoryHost(network, "host3")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	accepted := make(chan *Transmission, 1)
+	go func() {
+		remote, err := nc1.Accept()
+		if err != nil {
+			t.Error(err)
+		}
+		accepted <- remote
+	}()
+	nc1_remote, err := nc2.Connect(nc1.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	nc2_remote := <-accepted
+	if nc1_remote.GetHash() != nc1.LocalIdentity().Hash || nc2_remote.GetHash() != nc2.LocalIdentity().Hash {
+		t.Fatal("hash mismatch")
+	}
+	if nc2_remote.address.Text != nc2.LocalAddr().Text {
+		t.Fatal("observed address mismatch: " + nc2_remote.address.Text)
+	}
+
+	//AHMP flows over the session
+	go nc1_remote.ahmp_stream.Write([]byte("AHMP/1.0 JN /home\n\n"))
+	msg, err := nc2_remote.ahmp_parser.Read(nc2_remote.ahmp_stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if jn, ok := msg.(AHMPRaw_JN); !ok || string(jn.path) != "/home" {
+		t.Fatal("unexpected message")
+	}
+
+	//close code reaches the peer
+	nc1_remote.connection.CloseWithError(409, "bye")
+	<-nc2_remote.connection.Context().Done()
+	var app_err *quic.ApplicationError
+	if !errors.As(context.Cause(nc2_remote.connection.Context()), &app_err) || app_err.ErrorCode != 409 || !app_err.Remote {
+		t.Fatal("close code lost")
+	}
+
+	//wrong hash at the address
+	wrong_address := nc1.LocalAddr()
+	wrong_address.Pubkey_hash = nc3.LocalIdentity().Hash
+	go nc1.Accept()
+	if _, err := nc2.Connect(wrong_address); err == nil {
+		t.Fatal("connected to wrong host")
+	}
+
+	//closed host is unreachable
+	nc3_address := nc3.LocalAddr()
+	nc3.Close()
+	if _, err := nc2.Connect(nc3_address); err == nil {
+		t.Fatal("connected to closed host")
+	}
+	if _, err := nc3.Accept(); err != context.Canceled {
+		t.Fatal("accept after close")
+	}
+
+	nc1.Close()
+	nc2.Close()
+}
+
+func TestMemoryNetCoreCloseRace(t *testing.T) {
+	network := NewMemoryNetwork()
+	for range 20 {
+		nc1, _ := CreateMemoryHost(network, "host1")
+		nc2, _ := CreateMemoryHost(network, "host2")
+		address := nc1.LocalAddr()
+		done := make(chan bool)
+		for range 4 {
+			go func() {
+				nc2.Connect(address)
+				done <- true
+			}()
+		}
+		nc1.Close()
+		for range 4 {
+			<-done
+		}
+		nc2.Close()
+	}
+}
+
+func TestMuxConnectionStreams(t *testing.T) {
+	network := NewMemoryNetwork()
+	nc1, _ := CreateMemoryHost(network, "host1")
+	nc2, _ := CreateMemoryHost(network, "host2")
+	accepted := make(chan *Transmission, 1)
+	go func() {
+		remote, _ := nc1.Accept()
+		accepted <- remote
+	}()
+	client, err := nc2.Connect(nc1.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := (<-accepted).connection
+	client_conn := client.connection
+
+	//bidirectional, larger than a frame, with fin
+	payload := make([]byte, mux_max_frame_payload*3+7)
+	rand.Read(payload)
+	stream, err := client_conn.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		stream.Write(payload)
+		stream.Close()
+	}()
+	remote_stream, err := server.AcceptStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	received, err := io.ReadAll(remote_stream)
+	if err != nil || !bytes.Equal(received, payload) {
+		t.Fatal("stream payload mismatch")
+	}
+
+	//unidirectional from the server
+	uni, err := server.OpenUniStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		uni.Write([]byte("uni"))
+		uni.Close()
+	}()
+	remote_uni, err := client_conn.AcceptUniStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	received, _ = io.ReadAll(remote_uni)
+	if string(received) != "uni" {
+		t.Fatal("uni stream payload mismatch")
+	}
+
+	//reset
+	reset_stream, _ := client_conn.OpenStream()
+	reset_stream.Write([]byte("x"))
+	remote_reset, _ := server.AcceptStream(context.Background())
+	reset_stream.CancelWrite(7)
+	remote_reset.Read(make([]byte, 1))
+	var stream_err *quic.StreamError
+	if _, err := remote_reset.Read(make([]byte, 1)); !errors.As(err, &stream_err) || stream_err.ErrorCode != 7 {
+		t.Fatal("reset not delivered")
+	}
+
+	//datagram
+	if err := client_conn.SendDatagram([]byte("dg")); err != nil {
+		t.Fatal(err)
+	}
+	datagram, err := server.ReceiveDatagram(context.Background())
+	if err != nil || string(datagram) != "dg" {
+		t.Fatal("datagram mismatch")
+	}
+	var too_large *quic.DatagramTooLargeError
+	if err := client_conn.SendDatagram(make([]byte, mux_max_frame_payload+1)); !errors.As(err, &too_large) {
+		t.Fatal("oversized datagram not refused as too large:", err)
+	}
+
+	//read deadline
+	idle_stream, _ := server.OpenStream()
+	idle_stream.SetReadDeadline(time.Now().Add(time.Millisecond * 10))
+	if _, err := idle_stream.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatal("deadline not applied")
+	}
+
+	nc1.Close()
+	nc2.Close()
+}
+
+func TestMuxConnectionStreamLimit(t *testing.T) {
+	network := NewMemoryNetwork()
+	nc1, _ := CreateMemoryHost(network, "host1")
+	nc2, _ := CreateMemoryHost(network, "host2")
+	Connect := func() (*muxConnection, quic.Connection) {
+		accepted := make(chan *Transmission, 1)
+		go func() {
+			remote, _ := nc1.Accept()
+			accepted <- remote
+		}()
+		client, err := nc2.Connect(nc1.LocalAddr())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return client.connection.(*muxConnection), (<-accepted).connection
+	}
+	WaitClosed := func(server quic.Connection) {
+		select {
+		case <-server.Context().Done():
+		case <-time.After(time.Second * 3):
+			t.Fatal("connection not closed")
+		}
+	}
+
+	//a single frame must not open 2^60 streams
+	client, server := Connect()
+	client.writeFrame(mux_frame_stream, 1<<62, []byte("x"))
+	WaitClosed(server)
+
+	//the AHMP stream and 999 more fill the limit; one more closes the connection
+	client, server = Connect()
+	client.writeFrame(mux_frame_stream, 4*999, []byte("x"))
+	client.SendDatagram([]byte("alive"))
+	if datagram, err := server.ReceiveDatagram(context.Background()); err != nil || string(datagram) != "alive" {
+		t.Fatal("connection closed within the stream limit")
+	}
+	client.writeFrame(mux_frame_stream, 4*1000, []byte("x"))
+	WaitClosed(server)
+
+	nc1.Close()
+	nc2.Close()
+}
+
+func TestMuxConnectionFlowControl(t *testing.T) {
+	network := NewMemoryNetwork()
+	nc1, _ := CreateMemoryHost(network, "host1")
+	nc2, _ := CreateMemoryHost(network, "host2")
+	nc1.config.MaxIncomingStreams = 2 //the AHMP stream and one more
+	accepted := make(chan *Transmission, 1)
+	go func() {
+		remote, _ := nc1.Accept()
+		accepted <- remote
+	}()
+	client, err := nc2.Connect(nc1.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := (<-accepted).connection
+	client_conn := client.connection
+
+	//a writer more than the connection window ahead of a slow reader blocks instead of failing
+	payload := make([]byte, mux_connection_window+mux_stream_window*3)
+	rand.Read(payload)
+	stream, err := client_conn.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	write_done := make(chan error, 1)
+	go func() {
+		_, err := stream.Write(payload)
+		stream.Close()
+		write_done <- err
+	}()
+	remote_stream, err := server.AcceptStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * 200)
+	select {
+	case <-write_done:
+		t.Fatal("write not blocked by the window")
+	default:
+	}
+	received, err := io.ReadAll(remote_stream)
+	if err != nil || !bytes.Equal(received, payload) {
+		t.Fatal("stream payload mismatch")
+	}
+	if err := <-write_done; err != nil {
+		t.Fatal(err)
+	}
+
+	//past the stream limit, OpenStream fails and OpenStreamSync waits for a stream to be released
+	if _, err := client_conn.OpenStream(); err == nil {
+		t.Fatal("opened a stream past the limit")
+	}
+	opened := make(chan quic.Stream, 1)
+	go func() {
+		next, err := client_conn.OpenStreamSync(context.Background())
+		if err != nil {
+			t.Error(err)
+		}
+		opened <- next
+	}()
+	time.Sleep(time.Millisecond * 100)
+	select {
+	case <-opened:
+		t.Fatal("OpenStreamSync did not wait for the stream limit")
+	default:
+	}
+	remote_stream.Close()
+	next := <-opened
+	if next == nil {
+		t.FailNow()
+	}
+	next.Write([]byte("next"))
+	remote_next, err := server.AcceptStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(remote_next, buf); err != nil || string(buf) != "next" {
+		t.Fatal("stream after the limit mismatch")
+	}
+	if client_conn.Context().Err() != nil || server.Context().Err() != nil {
+		t.Fatal("session closed")
+	}
+
+	nc1.Close()
+	nc2.Close()
+}
+
+func TestNetCoreConfig(t *testing.T) {
+	defaults := NetCoreConfig{}.withDefaults()
+	if defaults.DialTimeout != time.Second*3 || defaults.MaxIdleTimeout != time.Minute*5 || defaults.MaxIncomingStreams != 1000 {
+		t.Fatal("unexpected defaults")
+	}
+
+	//pick a free port, then pin the net core to it
+	probe, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := probe.LocalAddr().(*net.UDPAddr).Port
+	probe.Close()
+
+	identity, err := atype.GenerateAbyssPrivateIdentity("host1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nc1, err := NewGoQuicNetCore(identity, NetCoreConfig{
+		BindAddress:        &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port},
+		AcceptTimeout:      time.Millisecond * 100,
+		MaxIncomingStreams: 10,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nc1.LocalAddr().Port != uint16(port) || nc1.LocalAddr().Host != "127.0.0.1" {
+		t.Fatal("bind address not applied: " + nc1.LocalAddr().Text)
+	}
+	if nc1.quicConf.MaxIncomingStreams != 10 || nc1.quicConf.KeepAlivePeriod != time.Minute {
+		t.Fatal("quic config not applied")
+	}
+	no_keepalive, err := NewGoQuicNetCore(identity, NetCoreConfig{KeepAlivePeriod: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if no_keepalive.quicConf.KeepAlivePeriod != 0 {
+		t.Fatal("keep-alive not disabled")
+	}
+	no_keepalive.Close()
+
+	//accept gives up after the configured wait
+	start := time.Now()
+	if _, err := nc1.Accept(); err == nil || time.Since(start) > time.Second {
+		t.Fatal("accept timeout not applied")
+	}
+
+	_, _, nc2, err := CreateRandomHost()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go nc1.Accept()
+	if _, err := nc2.Connect(nc1.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	nc1.Close()
+	nc2.Close()
+}
+
+func TestNetCoreLocalAddr(t *testing.T) {
+	_, _, nc, err := CreateRandomHost()
+	if err != nil {
+		t.Fatal(err)
+	}
+	nc1 := nc.(*GoQuicNetCore)
+	nc1.interface_addrs = func() ([]net.Addr, error) {
+		return []net.Addr{
+			&net.IPNet{IP: net.ParseIP("127.0.0.1"), Mask: net.CIDRMask(8, 32)},
+			&net.IPNet{IP: net.ParseIP("fe80::1"), Mask: net.CIDRMask(64, 128)},
+			&net.IPNet{IP: net.ParseIP("192.0.2.7"), Mask: net.CIDRMask(24, 32)},
+			&net.IPNet{IP: net.ParseIP("2001:db8::7"), Mask: net.CIDRMask(64, 128)},
+		}, nil
+	}
+	port := nc1.LocalAddr().Port
+	hosts := func() []string {
+		var result []string
+		for _, endpoint := range nc1.LocalAddr().Endpoints {
+			result = append(result, endpoint.Host)
+			if endpoint.Port != port {
+				t.Fatal("port mismatch")
+			}
+		}
+		return result
+	}
+	if fmt.Sprint(hosts()) != "[192.0.2.7 2001:db8::7 127.0.0.1]" {
+		t.Fatal("unexpected interface endpoints: " + fmt.Sprint(hosts()))
+	}
+
+	//a reflexive address is advertised only once confirmed from distinct networks, after the interface addresses
+	public := netip.AddrPortFrom(netip.MustParseAddr("203.0.113.5"), port)
+	peer1, peer1_close := context.WithCancel(context.Background())
+	nc1.addReflexiveReport(netip.MustParseAddr("198.51.100.1"), public, context.Background())
+	nc1.addReflexiveReport(netip.MustParseAddr("198.51.100.2"), public, context.Background())
+	if slices.Contains(hosts(), "203.0.113.5") {
+		t.Fatal("reflexive address confirmed by a single network")
+	}
+	nc1.addReflexiveReport(netip.MustParseAddr("192.0.2.200"), public, peer1)
+	if fmt.Sprint(hosts()) != "[192.0.2.7 2001:db8::7 203.0.113.5 127.0.0.1]" {
+		t.Fatal("reflexive address not advertised: " + fmt.Sprint(hosts()))
+	}
+
+	//a report is gone with its connection
+	peer1_close()
+	time.Sleep(time.Millisecond * 10)
+	if slices.Contains(hosts(), "203.0.113.5") {
+		t.Fatal("report outlived its connection")
+	}
+	nc1.Close()
+}
+
+func TestNetCoreObservedAddress(t *testing.T) {
+	network := NewMemoryNetwork()
+	nc1, _ := CreateMemoryHost(network, "host1")
+	nc2, _ := CreateMemoryHost(network, "host2")
+	accepted := make(chan *Transmission, 1)
+	go func() {
+		remote, _ := nc1.Accept()
+		accepted <- remote
+	}()
+	nc1_remote, err := nc2.Connect(nc1.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	nc2_remote := <-accepted
+
+	//each side learns how the other sees it
+	if nc1_remote.reflexive != nc2.endpoint || nc2_remote.reflexive != nc1.endpoint {
+		t.Fatal("observed address not echoed")
+	}
+	nc1.Close()
+	nc2.Close()
+}
+
+func refusedWith(err error, code quic.ApplicationErrorCode) bool {
+	var app_err *quic.ApplicationError
+	return errors.As(err, &app_err) && app_err.Remote && app_err.ErrorCode == code
+}
+
+func TestAdmissionRelayed(t *testing.T) {
+	admission := newAdmission(NetCoreConfig{MaxPeers: 2, MaxPendingHandshakes: 1}.withDefaults())
+	if _, _, ok := admission.admitRelayed(); !ok {
+		t.Fatal("relayed handshake refused")
+	}
+	if code, _, ok := admission.admitRelayed(); ok || code != CloseTooManyHandshakes {
+		t.Fatal("relayed handshake not counted as pending")
+	}
+	admission.handshakeDone()
+	if _, _, ok := admission.admitRelayed(); !ok {
+		t.Fatal("relayed handshake refused after the first finished")
+	}
+	admission.handshakeDone()
+	if code, _, ok := admission.admitRelayed(); ok || code != CloseTooManyPeers {
+		t.Fatal("relayed sessions not counted as peers")
+	}
+	admission.releaseLive()
+	if _, _, ok := admission.admitRelayed(); !ok {
+		t.Fatal("released peer slot not reusable")
+	}
+}
+
+func TestNetCoreRefusalLimit(t *testing.T) {
+	identity, _ := atype.GenerateAbyssPrivateIdentity("host1")
+	nc, err := NewGoQuicNetCore(identity, NetCoreConfig{
+		BindAddress:          &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)},
+		MaxPendingHandshakes: 1,
+		AdmitAddress:         func(remote netip.AddrPort) bool { return false },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			if _, err := nc.Accept(); err == context.Canceled {
+				return
+			}
+		}
+	}()
+	_, _, client, err := CreateRandomHost()
+	if err != nil {
+		t.Fatal(err)
+	}
+	Pending := func() int {
+		nc.admission.mtx.Lock()
+		defer nc.admission.mtx.Unlock()
+		return nc.admission.pending
+	}
+
+	//with a free slot, the refusal waits for the handshake and tells why
+	if _, err := client.Connect(nc.LocalAddr()); !refusedWith(err, CloseAddressRejected) {
+		t.Fatal("address not rejected: " + fmt.Sprint(err))
+	}
+
+	//with every slot taken, refused dialers are closed at once and hold nothing
+	reserved := false
+	for range 20 {
+		if reserved = nc.admission.reserveHandshake(); reserved {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	if !reserved {
+		t.Fatal("handshake slot not released after the refusal")
+	}
+	for range 4 {
+		if _, err := client.Connect(nc.LocalAddr()); err == nil {
+			t.Fatal("refused dialer connected")
+		}
+		if Pending() != 1 {
+			t.Fatal("refusal took a handshake slot over the limit")
+		}
+	}
+	nc.admission.handshakeDone()
+	client.Close()
+	nc.Close()
+}
+
+func TestNetCoreAdmission(t *testing.T) {
+	NewAdmissionHost := func(config NetCoreConfig) *GoQuicNetCore {
+		identity, err := atype.GenerateAbyssPrivateIdentity("host1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		config.BindAddress = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+		nc, err := NewGoQuicNetCore(identity, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			for {
+				if _, err := nc.Accept(); err == context.Canceled {
+					return
+				}
+			}
+		}()
+		return nc
+	}
+	_, _, client, err := CreateRandomHost()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//by address, before the ID exchange
+	nc1 := NewAdmissionHost(NetCoreConfig{AdmitAddress: func(remote netip.AddrPort) bool {
+		return !remote.Addr().IsLoopback()
+	}})
+	if _, err := client.Connect(nc1.LocalAddr()); !refusedWith(err, CloseAddressRejected) {
+		t.Fatal("address not rejected: " + fmt.Sprint(err))
+	}
+	nc1.Close()
+
+	//connections from one IP; the slot frees when the connection closes
+	nc2 := NewAdmissionHost(NetCoreConfig{MaxConnectionsPerIP: 1})
+	first, err := client.Connect(nc2.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Connect(nc2.LocalAddr()); !refusedWith(err, CloseTooManyFromIP) {
+		t.Fatal("per-IP limit not applied: " + fmt.Sprint(err))
+	}
+	first.connection.CloseWithError(0, "connection close")
+	admitted := false
+	for range 20 {
+		if second, err := client.Connect(nc2.LocalAddr()); err == nil {
+			second.connection.CloseWithError(0, "connection close")
+			admitted = true
+			break
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+	if !admitted {
+		t.Fatal("per-IP slot not released")
+	}
+	nc2.Close()
+
+	//total peers, outgoing connections included
+	_, _, other, err := CreateRandomHost()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go other.Accept()
+	nc3 := NewAdmissionHost(NetCoreConfig{MaxPeers: 1})
+	if _, err := nc3.Connect(other.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Connect(nc3.LocalAddr()); !refusedWith(err, CloseTooManyPeers) {
+		t.Fatal("peer limit not applied: " + fmt.Sprint(err))
+	}
+	nc3.Close()
+	other.Close()
+
+	//by identity, after the ID exchange: the dialer sees the session closed
+	nc4 := NewAdmissionHost(NetCoreConfig{AdmitIdentity: func(hash string) bool {
+		return hash != client.LocalIdentity().Hash
+	}})
+	refused, err := client.Connect(nc4.LocalAddr())
+	if err == nil {
+		<-refused.connection.Context().Done()
+		err = context.Cause(refused.connection.Context())
+	}
+	if !refusedWith(err, CloseIdentityRejected) {
+		t.Fatal("identity not rejected: " + fmt.Sprint(err))
+	}
+	nc4.Close()
+	client.Close()
+}
+
+func TestNetCoreResumption(t *testing.T) {
+	identity, err := atype.GenerateAbyssPrivateIdentity("host1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	NewResumptionHost := func() *GoQuicNetCore {
+		nc, err := NewGoQuicNetCore(identity, NetCoreConfig{BindAddress: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			for {
+				if _, err := nc.Accept(); err == context.Canceled {
+					return
+				}
+			}
+		}()
+		return nc
+	}
+	_, _, client, err := CreateRandomHost()
+	if err != nil {
+		t.Fatal(err)
+	}
+	nc1 := NewResumptionHost()
+
+	first, err := client.Connect(nc1.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.connection.ConnectionState().TLS.DidResume {
+		t.Fatal("resumed without a ticket")
+	}
+	first.connection.CloseWithError(0, "connection close")
+
+	//the ID exchange starts in 0-RTT
+	second, err := client.Connect(nc1.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := second.connection.ConnectionState()
+	if !state.TLS.DidResume || !state.Used0RTT {
+		t.Fatal("session not resumed with 0-RTT")
+	}
+	if second.GetHash() != identity.Identity.Hash {
+		t.Fatal("resumed session with the wrong identity")
+	}
+	second.connection.CloseWithError(0, "connection close")
+
+	//same identity at another endpoint, unaware of the ticket: full handshake after the rejected 0-RTT
+	nc2 := NewResumptionHost()
+	third, err := client.Connect(nc2.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if third.connection.ConnectionState().Used0RTT {
+		t.Fatal("0-RTT accepted by a host without the ticket")
+	}
+	third.connection.CloseWithError(0, "connection close")
+
+	nc1.Close()
+	nc2.Close()
+	client.Close()
+}
+
+func TestTcpNetCore(t *testing.T) {
+	loopback := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	identity1, _ := atype.GenerateAbyssPrivateIdentity("host1")
+	identity2, _ := atype.GenerateAbyssPrivateIdentity("host2")
+	nc1, err := NewTcpNetCore(identity1, loopback, NetCoreConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	nc2, err := NewTcpNetCore(identity2, loopback, NetCoreConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if endpoint := nc1.LocalAddr().Endpoints[0]; endpoint.Transport != atype.TransportTCP || endpoint.Host != "127.0.0.1" {
+		t.Fatal("local address not a TCP endpoint: " + nc1.LocalAddr().Text)
+	}
+
+	accepted := make(chan *Transmission, 1)
+	go func() {
+		session, _ := nc1.Accept()
+		accepted <- session
+	}()
+	session, err := nc2.Connect(nc1.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote := <-accepted
+	if remote == nil || remote.GetHash() != nc2.LocalIdentity().Hash || session.GetHash() != nc1.LocalIdentity().Hash {
+		t.Fatal("identity exchange failed")
+	}
+	if _, ok := session.connection.(*muxConnection); !ok {
+		t.Fatal("not a mux session")
+	}
+	if remote.address.Text != nc2.LocalAddr().Text {
+		t.Fatal("observed address used over TCP: " + remote.address.Text)
+	}
+
+	//QUIC has no endpoint to dial in a TCP address
+	_, _, quic_core, err := CreateRandomHost()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := quic_core.Connect(nc1.LocalAddr()); err == nil {
+		t.Fatal("QUIC dialed a TCP endpoint")
+	}
+	quic_core.Close()
+
+	//refusals reach the dialer with their code
+	identity3, _ := atype.GenerateAbyssPrivateIdentity("host3")
+	nc3, err := NewTcpNetCore(identity3, loopback, NetCoreConfig{AdmitAddress: func(remote netip.AddrPort) bool {
+		return !remote.Addr().IsLoopback()
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go nc3.Accept()
+	if _, err := nc2.Connect(nc3.LocalAddr()); !refusedWith(err, CloseAddressRejected) {
+		t.Fatal("address not rejected: " + fmt.Sprint(err))
+	}
+
+	session.connection.CloseWithError(0, "connection close")
+	nc1.Close()
+	nc2.Close()
+	nc3.Close()
+}
+
+func TestTcpNetCoreStreamLimit(t *testing.T) {
+	loopback := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	identity1, _ := atype.GenerateAbyssPrivateIdentity("host1")
+	identity2, _ := atype.GenerateAbyssPrivateIdentity("host2")
+	nc1, err := NewTcpNetCore(identity1, loopback, NetCoreConfig{MaxIncomingStreams: 3}) //the AHMP stream and two more
+	if err != nil {
+		t.Fatal(err)
+	}
+	nc2, err := NewTcpNetCore(identity2, loopback, NetCoreConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted := make(chan *Transmission, 1)
+	go func() {
+		session, _ := nc1.Accept()
+		accepted <- session
+	}()
+	session, err := nc2.Connect(nc1.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote := <-accepted
+
+	//bulk streams beyond the limit wait their turn; none of them takes the session down
+	payload := make([]byte, mux_stream_window*2)
+	rand.Read(payload)
+	write_errs := make(chan error, 5)
+	for range 5 {
+		go func() {
+			stream, err := session.connection.OpenStreamSync(context.Background())
+			if err == nil {
+				_, err = stream.Write(payload)
+				stream.Close()
+			}
+			write_errs <- err
+		}()
+	}
+	for range 5 {
+		stream, err := remote.connection.AcceptStream(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond * 50) //a slow reader
+		received, err := io.ReadAll(stream)
+		if err != nil || !bytes.Equal(received, payload) {
+			t.Fatal("stream payload mismatch")
+		}
+		stream.Close()
+	}
+	for range 5 {
+		if err := <-write_errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if session.connection.Context().Err() != nil || remote.connection.Context().Err() != nil {
+		t.Fatal("session closed")
+	}
+
+	session.connection.CloseWithError(0, "connection close")
+	nc1.Close()
+	nc2.Close()
+}
+
+func TestTcpNetCoreRefusalLimit(t *testing.T) {
+	identity, _ := atype.GenerateAbyssPrivateIdentity("host1")
+	nc, err := NewTcpNetCore(identity, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}, NetCoreConfig{
+		HandshakeTimeout:     time.Millisecond * 500,
+		MaxPendingHandshakes: 1,
+		AdmitAddress:         func(remote netip.AddrPort) bool { return false },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			if _, err := nc.Accept(); err == context.Canceled {
+				return
+			}
+		}
+	}()
+	address := net.JoinHostPort("127.0.0.1", fmt.Sprint(nc.listenPort()))
+	WaitClosed := func(conn net.Conn, within time.Duration) bool {
+		conn.SetReadDeadline(time.Now().Add(within))
+		_, err := conn.Read(make([]byte, 1))
+		return err != nil && !errors.Is(err, os.ErrDeadlineExceeded)
+	}
+
+	//a refused dialer that never speaks TLS holds the only handshake slot
+	stalled, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * 100)
+	flood, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !WaitClosed(flood, time.Millisecond*300) {
+		t.Fatal("refusal handshake not counted as pending")
+	}
+	if !WaitClosed(stalled, time.Second*2) {
+		t.Fatal("refusal handshake not bounded by HandshakeTimeout")
+	}
+	stalled.Close()
+	flood.Close()
+	nc.Close()
+}
+
+func TestNetCoreTCPFallback(t *testing.T) {
+	NewFallbackHost := func(name string) *GoQuicNetCore {
+		identity, err := atype.GenerateAbyssPrivateIdentity(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nc, err := NewGoQuicNetCore(identity, NetCoreConfig{
+			BindAddress:        &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)},
+			TCPFallbackAddress: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return nc
+	}
+	server := NewFallbackHost("host1")
+	client := NewFallbackHost("host2")
+	accepted := make(chan *Transmission, 2)
+	go func() {
+		for {
+			session, err := server.Accept()
+			if err == context.Canceled {
+				return
+			}
+			if err == nil {
+				accepted <- session
+			}
+		}
+	}()
+
+	//both transports advertised, QUIC first
+	endpoints := server.LocalAddr().Endpoints
+	if len(endpoints) != 2 || endpoints[0].Transport != atype.TransportQUIC || endpoints[1].Transport != atype.TransportTCP {
+		t.Fatal("transports not advertised: " + server.LocalAddr().Text)
+	}
+	direct, err := client.Connect(server.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := direct.connection.(*muxConnection); ok {
+		t.Fatal("fell back while QUIC works")
+	}
+	if remote := <-accepted; len(remote.advertised.Endpoints) != 2 {
+		t.Fatal("TCP endpoint not advertised to the peer: " + remote.advertised.Text)
+	}
+	direct.connection.CloseWithError(0, "connection close")
+
+	//UDP black hole
+	blackhole, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blackhole.Close()
+	blocked, _ := atype.MakeAbyssAddressMulti(server.LocalIdentity().Hash, []atype.AbyssEndpoint{
+		{Host: "127.0.0.1", Port: uint16(blackhole.LocalAddr().(*net.UDPAddr).Port)},
+		endpoints[1],
+	}, "")
+	fallback, err := client.Connect(blocked)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fallback.connection.(*muxConnection); !ok {
+		t.Fatal("not connected over TCP")
+	}
+	if remote := <-accepted; remote.GetHash() != client.LocalIdentity().Hash {
+		t.Fatal("TCP session not accepted")
+	}
+	fallback.connection.CloseWithError(0, "connection close")
+
+	server.Close()
+	client.Close()
+}
+
+func TestNetCoreTCPFallbackSuperseded(t *testing.T) {
+	NewFallbackHost := func(name string) *GoQuicNetCore {
+		identity, err := atype.GenerateAbyssPrivateIdentity(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nc, err := NewGoQuicNetCore(identity, NetCoreConfig{
+			BindAddress:        &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)},
+			TCPFallbackAddress: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)},
+			AcceptTimeout:      time.Second,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return nc
+	}
+	server := NewFallbackHost("host1")
+	client := NewFallbackHost("host2")
+	defer server.Close()
+	defer client.Close()
+	accepted := make(chan acceptResult, 4)
+	go func() {
+		for {
+			session, err := server.Accept()
+			if err == context.Canceled {
+				return
+			}
+			if err != context.DeadlineExceeded {
+				accepted <- acceptResult{session, err}
+			}
+		}
+	}()
+
+	//QUIC is slow enough for TCP to start, and finishes after TCP won
+	endpoints := server.LocalAddr().Endpoints
+	proxy_port, stop := startDelayProxy(t, netip.AddrPortFrom(netip.MustParseAddr("127.0.0.1"), endpoints[0].Port), time.Millisecond*400)
+	defer stop()
+	slow, _ := atype.MakeAbyssAddressMulti(server.LocalIdentity().Hash, []atype.AbyssEndpoint{
+		{Host: "127.0.0.1", Port: proxy_port},
+		endpoints[1],
+	}, "")
+	session, err := client.Connect(slow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := session.connection.(*muxConnection); !ok {
+		t.Fatal("not connected over TCP")
+	}
+
+	superseded := false
+	for !superseded {
+		select {
+		case result := <-accepted:
+			if result.err != nil {
+				superseded = isSuperseded(result.err)
+				break
+			}
+			if _, ok := result.transmission.connection.(*muxConnection); ok {
+				continue //the winner
+			}
+			select {
+			case <-result.transmission.connection.Context().Done():
+			case <-time.After(time.Second * 3):
+				t.Fatal("late session not closed")
+			}
+			superseded = isSuperseded(context.Cause(result.transmission.connection.Context()))
+		case <-time.After(time.Second * 5):
+			t.Fatal("late QUIC session not closed as superseded")
+		}
+	}
+	//no extra session appears on the dialer
+	if extra, err := client.Accept(); err != context.DeadlineExceeded {
+		t.Fatal("extra session on the dialer: " + fmt.Sprint(extra, err))
+	}
+}
+func TestNetCoreCloseRace(t *testing.T) {
+	server_identity, _ := atype.GenerateAbyssPrivateIdentity("host1")
+	server, err := NewGoQuicNetCore(server_identity, NetCoreConfig{
+		BindAddress:        &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)},
+		TCPFallbackAddress: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	address := server.LocalAddr()
+
+	client_identity, _ := atype.GenerateAbyssPrivateIdentity("host2")
+	for range 10 {
+		client, err := NewGoQuicNetCore(client_identity, NetCoreConfig{
+			BindAddress:        &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)},
+			TCPFallbackAddress: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		done := make(chan bool)
+		for range 4 {
+			go func() {
+				client.Connect(address)
+				client.fallback.Connect(address)
+				client.Punch(address)
+				done <- true
+			}()
+		}
+		client.Close()
+		for range 4 {
+			<-done
+		}
+	}
+}
@@ -5,8 +5,11 @@ import (
 	"abyss/atype"
 	"context"
 	"errors"
+	"fmt"
+	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -25,6 +28,17 @@ type ConnectFail struct {
 	err  error
 }
 
+// returned by peer queries once Shutdown has begun.
+var ErrNetworkerClosed = errors.New("networker closed")
+
+// how long WaitClose lets peers hang up before closing them.
+const shutdown_timeout = time.Second * 3
+
+type shutdownCall struct {
+	ctx        context.Context
+	peers_done chan bool //closed when no peer is left, or at ctx end after closing the rest
+}
+
 type Networker struct {
 	//internal thread access only
 	netcore      INetCore
@@ -32,45 +46,86 @@ type Networker struct {
 	ndh_lock     sync.Mutex
 	peers        map[string]*Peer
 	ongoing_dial map[string][]chan PeerQueryReturn
+	rotated      map[string]string        //previous identity hash > current identity hash, learned from peer certificates
+	suspended    map[string]suspendedPeer //identity hash > peer being reconnected
 
-	fin_wg sync.WaitGroup
+	claimed_names map[string]string //identity hash > name the peer claims. ndh_lock
+	open_paths    map[string]bool   //local paths registered with OpenWorld. ndh_lock
+
+	fin_wg        sync.WaitGroup
+	shutdown_ch   chan shutdownCall
+	shutdown_once sync.Once
+	closed        chan bool //closed when the main worker ends
+	errlog_mtx    sync.Mutex
+	errlog_closed bool //ErrRaise is dropped from then on. errlog_mtx
 
 	//access from external thread
 	callq      chan PeerQueryCall
+	listq      chan chan []*Peer
 	NdhEventCh chan and.NeighborDiscoveryEvent
-	ErrLog     chan error
+	ErrLog     chan error              //closed at the end of Shutdown
+	Contacts   *atype.AbyssContactBook //our names for peers. fill with Contacts.Load
+
+	relay            *relayState
+	datagrams        *datagramState
+	stream_handlers  *streamHandlers
+	reconnect_policy atomic.Pointer[ReconnectPolicy]
+
+	LanEventCh chan LanDiscoveryEvent
+	lan        *lanDiscovery //nil unless StartLanDiscovery
+	lan_mtx    sync.Mutex
 }
 
+// safe from any goroutine, also after Shutdown.
 func (n *Networker) ErrRaise(err error) {
+	n.errlog_mtx.Lock()
+	defer n.errlog_mtx.Unlock()
+	if n.errlog_closed {
+		return
+	}
 	select {
 	case n.ErrLog <- err:
 	default:
 	}
 }
 
-func NewNetworker(pubkey_pem []byte, name string) (*Networker, error) {
-	result := new(Networker)
-	id, err := atype.MakeAbyssIdentity(pubkey_pem, name)
+func NewNetworker(local_identity atype.AbyssPrivateIdentity, config NetCoreConfig) (*Networker, error) {
+	netcore, err := NewGoQuicNetCore(local_identity, config)
 	if err != nil {
 		return nil, err
 	}
+	return NewNetworkerWithNetCore(netcore)
+}
 
-	result.netcore, err = NewGoQuicNetCore(id)
-	if err != nil {
-		return nil, err
-	}
+// the networker owns the net core from here; it is closed by WaitClose.
+func NewNetworkerWithNetCore(netcore INetCore) (*Networker, error) {
+	result := new(Networker)
+	result.netcore = netcore
 
-	result.ndh = and.NewNeighborDiscoveryHandler(id.Hash)
+	result.ndh = and.NewNeighborDiscoveryHandler(netcore.LocalIdentity().Hash)
 
 	result.peers = make(map[string]*Peer)
 	result.ongoing_dial = make(map[string][]chan PeerQueryReturn)
+	result.rotated = make(map[string]string)
+	result.suspended = make(map[string]suspendedPeer)
+	result.claimed_names = make(map[string]string)
+	result.open_paths = make(map[string]bool)
+	result.Contacts = atype.NewAbyssContactBook()
+	result.relay = newRelayState()
+	result.datagrams = newDatagramState()
+	result.stream_handlers = newStreamHandlers()
 
 	result.callq = make(chan PeerQueryCall, 32)
+	result.listq = make(chan chan []*Peer, 8)
+	result.shutdown_ch = make(chan shutdownCall)
+	result.closed = make(chan bool)
 	result.NdhEventCh = make(chan and.NeighborDiscoveryEvent, 64)
 	result.ErrLog = make(chan error, 32)
+	result.LanEventCh = make(chan LanDiscoveryEvent, 32)
 
 	result.ndh.ReserveEventListener(result.NdhEventCh)
 	result.ndh.ReserveErrorListener(result.ErrLog)
+	result.ndh.ReservePeerNamer(result.peerName)
 
 	snb_timeout_ch := make(chan string, 16)
 	result.ndh.ReserveSNBTimer(func(duration time.Duration, world_uuid string) {
@@ -87,11 +142,12 @@ func NewNetworker(pubkey_pem []byte, name string) (*Networker, error) {
 	accept_done := make(chan bool, 1)
 	new_session_ch := make(chan *Transmission, 32)
 	connect_fail_ch := make(chan ConnectFail, 32)
+	reconnect_expired_ch := make(chan string, 8)
 
 	ConnectAsync := func(_address any) {
 		address, _ := _address.(atype.AbyssAddress)
 		go func() {
-			session, err := result.netcore.Connect(address)
+			session, err := result.connect(address)
 			if err != nil {
 				connect_fail_ch <- ConnectFail{address.Pubkey_hash, err}
 			} else {
@@ -121,11 +177,27 @@ func NewNetworker(pubkey_pem []byte, name string) (*Networker, error) {
 	result.fin_wg.Add(1)
 	go func() { //Peer query/connect handler
 		defer result.fin_wg.Done()
+		defer close(result.closed)
+
+		shutting_down := false
+		var peers_done chan bool
+		var shutdown_deadline <-chan struct{}
+		PeersDone := func() {
+			if peers_done != nil {
+				close(peers_done)
+				peers_done = nil
+				shutdown_deadline = nil
+			}
+		}
 		for {
 			//fmt.Println("jj")
 			select {
 			case query_call := <-result.callq:
 				//fmt.Println("h")
+				if shutting_down {
+					query_call.ret_ch <- PeerQueryReturn{nil, ErrNetworkerClosed}
+					break
+				}
 				var hash string
 				switch ct := query_call.arg.(type) {
 				case string:
@@ -133,6 +205,9 @@ func NewNetworker(pubkey_pem []byte, name string) (*Networker, error) {
 				case atype.AbyssAddress:
 					hash = ct.Pubkey_hash
 				}
+				if current_hash, ok := result.rotated[hash]; ok {
+					hash = current_hash
+				}
 
 				peer, ok := result.peers[hash]
 				if ok { //peer found
@@ -155,7 +230,7 @@ func NewNetworker(pubkey_pem []byte, name string) (*Networker, error) {
 				case atype.AbyssAddress:
 					result.ongoing_dial[hash] = []chan PeerQueryReturn{query_call.ret_ch}
 					go func() {
-						session, err := result.netcore.Connect(ct)
+						session, err := result.connect(ct)
 						if err != nil {
 							connect_fail_ch <- ConnectFail{ct.Pubkey_hash, err}
 						} else {
@@ -163,32 +238,64 @@ func NewNetworker(pubkey_pem []byte, name string) (*Networker, error) {
 						}
 					}()
 				}
+			case ret_ch := <-result.listq:
+				peers := make([]*Peer, 0, len(result.peers))
+				for _, peer := range result.peers {
+					peers = append(peers, peer)
+				}
+				ret_ch <- peers
 			case new_session := <-new_session_ch:
 				//fmt.Println("q")
+				if shutting_down {
+					new_session.connection.CloseWithError(CloseShutdown, "networker shutdown")
+					break
+				}
 				peer, ok := result.peers[new_session.GetHash()]
 				if ok { //session already exists, duplicate connection
 					if !peer.TryAddSession(new_session) {
 						//triple connection
 						result.ErrRaise(errors.New("triple session"))
-						new_session.connection.CloseWithError(409, "triple session")
+						new_session.connection.CloseWithError(CloseTripleSession, "triple session")
+						break
 					}
+					go result.serveStreams(new_session, new_session_ch)
+					go result.serveDatagrams(new_session)
 					break
 				}
 
-				//new peer
-				peer = NewPeer(new_session, AHMP_channel)
+				//new peer, or a suspended one coming back
+				if suspended, ok := result.suspended[new_session.GetHash()]; ok {
+					suspended.cancel()
+					delete(result.suspended, new_session.GetHash())
+					peer = suspended.peer
+					peer.resume(new_session)
+				} else {
+					peer = NewPeer(new_session, AHMP_channel)
+				}
 				result.peers[new_session.GetHash()] = peer
+				go result.serveStreams(new_session, new_session_ch)
+				go result.serveDatagrams(new_session)
 
+				//the peer may have been dialed or referred to by a previous identity
 				result.ndh_lock.Lock()
+				for _, previous_hash := range new_session.GetPreviousHashes() {
+					result.rotated[previous_hash] = new_session.GetHash()
+					result.Contacts.Rotate(previous_hash, new_session.GetHash())
+					result.ndh.IdentityRotated(previous_hash, new_session.GetHash())
+				}
+				result.claimed_names[new_session.GetHash()] = new_session.identity.Name
+				result.Contacts.UpdateAddress(new_session.address)
 				result.ndh.Connected(peer)
 				result.ndh_lock.Unlock()
 
-				ret_list, ok := result.ongoing_dial[new_session.GetHash()]
-				if ok { //there was ongoing dial
-					for _, ret_ch := range ret_list {
-						ret_ch <- PeerQueryReturn{peer, nil}
+				for _, hash := range append([]string{new_session.GetHash()}, new_session.GetPreviousHashes()...) {
+					ret_list, ok := result.ongoing_dial[hash]
+					if ok { //there was ongoing dial
+						for _, ret_ch := range ret_list {
+							ret_ch <- PeerQueryReturn{peer, nil}
+						}
+						delete(result.ongoing_dial, hash)
 					}
-					delete(result.ongoing_dial, new_session.GetHash())
 				}
 				//fmt.Println("qe")
 			case conn_fail := <-connect_fail_ch:
@@ -205,17 +312,45 @@ func NewNetworker(pubkey_pem []byte, name string) (*Networker, error) {
 					break
 				}
 
+				if shutting_down {
+					//the peer hung up after reading our RSTs
+					if _, ok := ahmp_read.msg.(AHMPExit); ok {
+						ahmp_read.peer.closeWithError(CloseShutdown, "networker shutdown")
+						delete(result.peers, ahmp_read.peer.GetHash())
+						if len(result.peers) == 0 {
+							PeersDone()
+						}
+					}
+					break
+				}
+
 				switch msg := ahmp_read.msg.(type) {
 				case AHMPExit:
 					ahmp_read.peer.Close()
 					delete(result.peers, ahmp_read.peer.GetHash())
+					policy := result.reconnect_policy.Load()
 
 					result.ndh_lock.Lock()
-					result.ndh.Disconnected(ahmp_read.peer.GetHash())
+					peer_name := result.peerName(ahmp_read.peer.GetHash())
+					is_suspended := policy != nil && result.ndh.Suspend(ahmp_read.peer.GetHash())
+					if !is_suspended {
+						result.ndh.Disconnected(ahmp_read.peer.GetHash())
+						delete(result.claimed_names, ahmp_read.peer.GetHash())
+					}
 					result.ndh_lock.Unlock()
 
-					result.ErrRaise(msg.exitcode)
-				case AHMPRaw_ID:
+					if is_suspended {
+						reconnect_ctx, reconnect_cancel := context.WithCancel(context.Background())
+						result.suspended[ahmp_read.peer.GetHash()] = suspendedPeer{ahmp_read.peer, reconnect_cancel}
+						go result.reconnect(reconnect_ctx, ahmp_read.peer.session().address, *policy, new_session_ch, reconnect_expired_ch)
+					}
+
+					exit_err := msg.exitcode
+					if exit_err != nil {
+						exit_err = fmt.Errorf("%s (%s): %w", peer_name, ahmp_read.peer.GetHash(), exit_err)
+					}
+					result.ErrRaise(exit_err)
+				case AHMPRaw_ID, AHMPRaw_IDC, AHMPRaw_IDA, AHMPRaw_IDO, AHMPRaw_IDS:
 					result.ErrRaise(errors.New("duplicate AHMP ID"))
 				case AHMPRaw_JN:
 					result.ndh_lock.Lock()
@@ -259,6 +394,26 @@ func NewNetworker(pubkey_pem []byte, name string) (*Networker, error) {
 					result.ndh_lock.Lock()
 					result.ndh.OnCRR(ahmp_read.peer, string(msg.world_uuid), string(msg.missing_hash))
 					result.ndh_lock.Unlock()
+				case AHMPRaw_PCH:
+					target, ok := atype.ParseAbyssAddress(string(msg.address))
+					if !ok {
+						ahmp_read.peer.Signal(errors.New("ahmp corrupted"))
+						break
+					}
+					//only the peer introducing us to a world, or introducing a member of it to us, has a reason to ask.
+					//punch traffic goes to literal addresses only; a PCH must not make us look up or flood arbitrary hosts
+					result.ndh_lock.Lock()
+					is_introducer := result.ndh.IsJoining(ahmp_read.peer.GetHash()) || result.ndh.IsMember(string(msg.world_uuid), ahmp_read.peer.GetHash())
+					result.ndh_lock.Unlock()
+					if !is_introducer || !isPunchTarget(target, ahmp_read.peer.GetHash(), result.netcore.LocalIdentity().Hash) {
+						break
+					}
+					if _, ok := result.peers[target.Pubkey_hash]; ok {
+						break //already connected
+					}
+					if puncher, ok := result.netcore.(IHolePuncher); ok {
+						puncher.Punch(target)
+					}
 				case AHMPRaw_RST:
 					result.ndh_lock.Lock()
 					result.ndh.OnRST(ahmp_read.peer, string(msg.world_uuid))
@@ -266,14 +421,68 @@ func NewNetworker(pubkey_pem []byte, name string) (*Networker, error) {
 				default:
 					result.ErrRaise(errors.New("unknown message type"))
 				}
+			case hash := <-reconnect_expired_ch:
+				if _, ok := result.suspended[hash]; !ok {
+					break //came back meanwhile
+				}
+				delete(result.suspended, hash)
+
+				result.ndh_lock.Lock()
+				result.ndh.Disconnected(hash)
+				delete(result.claimed_names, hash)
+				result.ndh_lock.Unlock()
 			case world_uuid := <-snb_timeout_ch:
 				result.ndh_lock.Lock()
 				result.ndh.OnSNBTimeout(world_uuid)
 				result.ndh_lock.Unlock()
+			case call := <-result.shutdown_ch:
+				shutting_down = true
+				result.ndh_lock.Lock()
+				result.ndh.CloseAll()
+				clear(result.open_paths)
+				result.ndh_lock.Unlock()
+
+				for _, suspended := range result.suspended {
+					suspended.cancel()
+				}
+				clear(result.suspended)
+				for hash, ret_list := range result.ongoing_dial {
+					for _, ret_ch := range ret_list {
+						ret_ch <- PeerQueryReturn{nil, ErrNetworkerClosed}
+					}
+					delete(result.ongoing_dial, hash)
+				}
+				for _, peer := range result.peers {
+					peer.finish()
+				}
+				peers_done = call.peers_done
+				shutdown_deadline = call.ctx.Done()
+				if len(result.peers) == 0 {
+					PeersDone()
+				}
+			case <-shutdown_deadline:
+				for hash, peer := range result.peers {
+					peer.closeWithError(CloseShutdown, "networker shutdown")
+					delete(result.peers, hash)
+				}
+				PeersDone()
 			case <-accept_done:
 				//fmt.Println("a")
-				//TODO: disconnect all
+				for _, suspended := range result.suspended {
+					suspended.cancel()
+				}
+				for _, peer := range result.peers {
+					peer.closeWithError(CloseShutdown, "networker shutdown")
+				}
+				for _, ret_list := range result.ongoing_dial {
+					for _, ret_ch := range ret_list {
+						ret_ch <- PeerQueryReturn{nil, ErrNetworkerClosed}
+					}
+				}
+				result.errlog_mtx.Lock()
+				result.errlog_closed = true
 				close(result.ErrLog)
+				result.errlog_mtx.Unlock()
 				return
 			}
 		}
@@ -282,42 +491,149 @@ func NewNetworker(pubkey_pem []byte, name string) (*Networker, error) {
 	return result, nil
 }
 
+// our petname for the peer, or the name it claims. ndh_lock must be held.
+func (n *Networker) peerName(hash string) string {
+	return n.Contacts.DisplayName(hash, n.claimed_names[hash])
+}
+
+// our current address, to share with others.
+func (n *Networker) LocalAddr() atype.AbyssAddress {
+	return n.netcore.LocalAddr()
+}
+
+// Shutdown with a short deadline.
 func (n *Networker) WaitClose() {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdown_timeout)
+	defer cancel()
+	n.Shutdown(ctx)
+}
+
+// orderly shutdown: every world session is RST and our AHMP streams are finished, so peers read
+// everything we sent; peers are closed with CloseShutdown as they hang up, the rest when ctx ends (ctx.Err() is returned).
+// pending and later peer queries fail with ErrNetworkerClosed. events emitted meanwhile are drained, as the
+// caller may have stopped reading; ErrLog is closed at the end. later calls wait for the first one to finish.
+func (n *Networker) Shutdown(ctx context.Context) error {
+	n.StopLanDiscovery()
+
+	first := false
+	n.shutdown_once.Do(func() { first = true })
+	if !first {
+		<-n.closed
+		return nil
+	}
+
+	call := shutdownCall{ctx, make(chan bool)}
+	shutdown_ch := n.shutdown_ch
+	ctx_done := ctx.Done()
+	var err error
+	for peers_done := call.peers_done; peers_done != nil; {
+		select {
+		case shutdown_ch <- call:
+			shutdown_ch = nil
+		case <-peers_done:
+			peers_done = nil
+		case <-ctx_done:
+			//the main worker closes the remaining peers, unless it never got the call
+			if shutdown_ch != nil {
+				peers_done = nil
+			}
+			ctx_done = nil
+			err = ctx.Err()
+		case <-n.NdhEventCh:
+		case <-n.LanEventCh:
+		}
+	}
+
 	n.netcore.Close()
-	n.fin_wg.Wait()
+	for {
+		select {
+		case <-n.closed:
+			n.fin_wg.Wait()
+			return err
+		case <-n.NdhEventCh:
+		case <-n.LanEventCh:
+		}
+	}
+}
+
+func (n *Networker) connectedPeers() []*Peer {
+	ret_ch := make(chan []*Peer, 1)
+	select {
+	case n.listq <- ret_ch:
+	case <-n.closed:
+		return nil
+	}
+	select {
+	case peers := <-ret_ch:
+		return peers
+	case <-n.closed:
+		return nil
+	}
 }
 
 // this may take long - connect
 func (n *Networker) GetPeerByAddress(address atype.AbyssAddress) (*Peer, error) {
-	return_ch := make(chan PeerQueryReturn)
-	n.callq <- PeerQueryCall{return_ch, address}
-
-	result := <-return_ch
-	return result.result, result.err
+	return n.query(address)
 }
 
 func (n *Networker) GetPeerByHash(hash string) (*Peer, error) {
-	return_ch := make(chan PeerQueryReturn)
-	n.callq <- PeerQueryCall{return_ch, hash}
+	return n.query(hash)
+}
 
-	result := <-return_ch
-	return result.result, result.err
+func (n *Networker) query(arg any) (*Peer, error) {
+	return_ch := make(chan PeerQueryReturn, 1)
+	select {
+	case n.callq <- PeerQueryCall{return_ch, arg}:
+	case <-n.closed:
+		return nil, ErrNetworkerClosed
+	}
+
+	select {
+	case result := <-return_ch:
+		return result.result, result.err
+	case <-n.closed:
+		return nil, ErrNetworkerClosed
+	}
 }
 
 func (n *Networker) OpenWorld(path string, world *World) bool {
 	n.ndh_lock.Lock()
 	defer n.ndh_lock.Unlock()
-	return n.ndh.OpenWorld(path, world)
+	if !n.ndh.OpenWorld(path, world) {
+		return false
+	}
+	n.open_paths[path] = true
+	return true
 }
 func (n *Networker) CloseWorld(path string) {
 	n.ndh_lock.Lock()
 	defer n.ndh_lock.Unlock()
 	n.ndh.CloseWorld(path)
+	delete(n.open_paths, path)
 }
 func (n *Networker) ChangeWorldPath(prev_path string, new_path string) bool {
 	n.ndh_lock.Lock()
 	defer n.ndh_lock.Unlock()
-	return n.ndh.ChangeWorldPath(prev_path, new_path)
+	if !n.ndh.ChangeWorldPath(prev_path, new_path) {
+		return false
+	}
+	if n.open_paths[prev_path] {
+		delete(n.open_paths, prev_path)
+		n.open_paths[new_path] = true
+	}
+	return true
+}
+
+// local paths of the worlds we opened, sorted.
+func (n *Networker) openPaths() []string {
+	n.ndh_lock.Lock()
+	defer n.ndh_lock.Unlock()
+	result := make([]string, 0, len(n.open_paths))
+	for path := range n.open_paths {
+		result = append(result, path)
+	}
+	slices.Sort(result)
+	return result
 }
 func (n *Networker) GetWorld(path string) (*World, bool) {
 	n.ndh_lock.Lock()
@@ -2,20 +2,77 @@ package anet
 
 import (
 	"abyss/and"
-	"crypto/ed25519"
-	"crypto/rand"
-	"crypto/x509"
-	"encoding/pem"
+	"abyss/atype"
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
+
+	"github.com/quic-go/quic-go"
 )
 
-func NewPemBytes() []byte {
-	pub_key, _, _ := ed25519.GenerateKey(rand.Reader)
-	pubkey_x509, _ := x509.MarshalPKIXPublicKey(pub_key)
-	return pem.EncodeToMemory(&pem.Block{Type: "OPENSSH PUBLIC KEY", Bytes: pubkey_x509})
+func NewTestNetworker(name string) (*Networker, error) {
+	identity, err := atype.GenerateAbyssPrivateIdentity(name)
+	if err != nil {
+		return nil, err
+	}
+	return NewNetworker(identity, NetCoreConfig{})
+}
+
+func NewTestMemoryNetworker(network *MemoryNetwork, name string) (*Networker, error) {
+	netcore, err := CreateMemoryHost(network, name)
+	if err != nil {
+		return nil, err
+	}
+	return NewNetworkerWithNetCore(netcore)
+}
+
+// drops inbound packets from addresses the host never sent to, like a port-restricted cone NAT.
+// the host keeps its address, so only the filtering is emulated.
+type testNATConn struct {
+	net.PacketConn
+	mtx    sync.Mutex
+	opened map[string]bool
+}
+
+func (c *testNATConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.mtx.Lock()
+	c.opened[addr.String()] = true
+	c.mtx.Unlock()
+	return c.PacketConn.WriteTo(b, addr)
+}
+func (c *testNATConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(b)
+		if err != nil {
+			return n, addr, err
+		}
+		c.mtx.Lock()
+		opened := c.opened[addr.String()]
+		c.mtx.Unlock()
+		if opened {
+			return n, addr, nil
+		}
+	}
+}
+
+func NewTestNATNetworker(name string, config NetCoreConfig) (*Networker, error) {
+	identity, err := atype.GenerateAbyssPrivateIdentity(name)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return nil, err
+	}
+	config.PacketConn = &testNATConn{PacketConn: conn, opened: make(map[string]bool)}
+	return NewNetworker(identity, config)
 }
 
 func CompareNDE(target and.NeighborDiscoveryEvent, correct and.NeighborDiscoveryEvent) (bool, string) {
@@ -54,6 +111,9 @@ func TimeoutCheckNDE(networker1 *Networker, correct and.NeighborDiscoveryEvent)
 	}
 }
 func TimeoutCheckNDEMultiple(networker1 *Networker, correct []and.NeighborDiscoveryEvent) (bool, string) {
+	return TimeoutCheckNDEMultipleWithin(networker1, correct, time.Second)
+}
+func TimeoutCheckNDEMultipleWithin(networker1 *Networker, correct []and.NeighborDiscoveryEvent, timeout time.Duration) (bool, string) {
 	if len(correct) == 0 {
 		return true, ""
 	}
@@ -71,18 +131,18 @@ func TimeoutCheckNDEMultiple(networker1 *Networker, correct []and.NeighborDiscov
 	select {
 	case <-done:
 		return ok, msg
-	case <-time.After(time.Second):
+	case <-time.After(timeout):
 		return false, "timeout"
 	}
 }
 
 func TestNetworkerCreation(t *testing.T) {
-	networker1, err := NewNetworker(NewPemBytes(), "hostA")
+	networker1, err := NewTestNetworker("hostA")
 	if err != nil {
 		t.Fatal(err)
 	}
-	networker2, _ := NewNetworker(NewPemBytes(), "hostB")
-	networker3, _ := NewNetworker(NewPemBytes(), "hostC")
+	networker2, _ := NewTestNetworker("hostB")
+	networker3, _ := NewTestNetworker("hostC")
 
 	networker1.WaitClose()
 	networker2.WaitClose()
@@ -90,13 +150,13 @@ func TestNetworkerCreation(t *testing.T) {
 }
 
 func TestNetworkerJoin(t *testing.T) {
-	networker1, _ := NewNetworker(NewPemBytes(), "hostA")
+	networker1, _ := NewTestNetworker("hostA")
 	w1 := NewWorld("https://www.abyssium.com/some_world.aml")
 	networker1.OpenWorld("/home", w1)
 
 	time.Sleep(time.Second)
 
-	networker2, _ := NewNetworker(NewPemBytes(), "hostB")
+	networker2, _ := NewTestNetworker("hostB")
 	networker2.JoinAny("/host1_home", networker1.netcore.LocalAddr(), networker1.netcore.LocalAddr().Pubkey_hash, "/home")
 
 	fmt.Println("waiting...")
@@ -141,17 +201,59 @@ func TestNetworkerJoin(t *testing.T) {
 	networker2.WaitClose()
 }
 
+func TestNetworkerPetname(t *testing.T) {
+	networker1, _ := NewTestNetworker("hostA")
+	w1 := NewWorld("https://www.abyssium.com/some_world.aml")
+	networker1.OpenWorld("/home", w1)
+
+	networker2, _ := NewTestNetworker("hostB")
+	h1 := networker1.netcore.LocalIdentity().Hash
+	h2 := networker2.netcore.LocalIdentity().Hash
+	if err := networker1.Contacts.Set(atype.AbyssContact{Hash: h2, Petname: "bob"}); err != nil {
+		t.Fatal(err)
+	}
+
+	networker2.JoinAny("/host1_home", networker1.netcore.LocalAddr(), h1, "/home")
+
+	//networker1 knows the joiner by petname, networker2 only has the claimed name
+	select {
+	case ev := <-networker1.NdhEventCh:
+		if ev.EventType != and.PeerJoin || ev.Peer_name != "bob" {
+			t.Fatal("unexpected event: " + ev.Stringify())
+		}
+	case <-time.After(time.Second * 2):
+		t.Fatal("timeout")
+	}
+	select {
+	case ev := <-networker2.NdhEventCh:
+		if ev.EventType != and.JoinSuccess || ev.Peer_name != "hostA" {
+			t.Fatal("unexpected event: " + ev.Stringify())
+		}
+	case <-time.After(time.Second * 2):
+		t.Fatal("timeout")
+	}
+
+	//last known address is recorded for contacts
+	contact, _ := networker1.Contacts.Get(h2)
+	if contact.Address.Pubkey_hash != h2 {
+		t.Fatal("contact address not updated")
+	}
+
+	networker1.WaitClose()
+	networker2.WaitClose()
+}
+
 func TestNetworkerJoinDouble(t *testing.T) {
-	networker1, _ := NewNetworker(NewPemBytes(), "hostA")
+	networker1, _ := NewTestNetworker("hostA")
 	w1 := NewWorld("https://www.abyssium.com/some_world.aml")
 	networker1.OpenWorld("/home", w1)
 
 	time.Sleep(time.Second)
 
-	networker2, _ := NewNetworker(NewPemBytes(), "hostB")
+	networker2, _ := NewTestNetworker("hostB")
 	networker2.JoinAny("/B_host1_home", networker1.netcore.LocalAddr(), networker1.netcore.LocalAddr().Pubkey_hash, "/home")
 
-	networker3, _ := NewNetworker(NewPemBytes(), "hostC")
+	networker3, _ := NewTestNetworker("hostC")
 	networker3.JoinAny("/C_host1_home", networker1.netcore.LocalAddr(), networker1.netcore.LocalAddr().Pubkey_hash, "/home")
 
 	fmt.Println("waiting...")
@@ -234,3 +336,1202 @@ func TestNetworkerJoinDouble(t *testing.T) {
 	networker1.WaitClose()
 	networker2.WaitClose()
 }
+
+func TestNetworkerMemoryJoin(t *testing.T) {
+	network := NewMemoryNetwork()
+	networker1, _ := NewTestMemoryNetworker(network, "hostA")
+	w1 := NewWorld("https://www.abyssium.com/some_world.aml")
+	networker1.OpenWorld("/home", w1)
+
+	networker2, _ := NewTestMemoryNetworker(network, "hostB")
+	networker3, _ := NewTestMemoryNetworker(network, "hostC")
+
+	h1 := networker1.netcore.LocalIdentity().Hash
+	h2 := networker2.netcore.LocalIdentity().Hash
+	h3 := networker3.netcore.LocalIdentity().Hash
+
+	networker2.JoinAny("/B_host1_home", networker1.netcore.LocalAddr(), h1, "/home")
+	if ok, msg := TimeoutCheckNDEMultiple(networker2,
+		[]and.NeighborDiscoveryEvent{
+			{EventType: and.JoinSuccess, Localpath: "/B_host1_home", Peer_hash: h1, Path: "/home", World: w1, Status: 200, Message: "OK"},
+			{EventType: and.PeerJoin, Peer_hash: h1, World: w1},
+		}); !ok {
+		t.Fatal(msg)
+	}
+	if ok, msg := TimeoutCheckNDE(networker1,
+		and.NeighborDiscoveryEvent{EventType: and.PeerJoin, Peer_hash: h2, World: w1}); !ok {
+		t.Fatal(msg)
+	}
+
+	//hostC learns hostB through hostA, and connects to it over the memory network
+	networker3.JoinAny("/C_host1_home", networker1.netcore.LocalAddr(), h1, "/home")
+	if ok, msg := TimeoutCheckNDEMultiple(networker3,
+		[]and.NeighborDiscoveryEvent{
+			{EventType: and.JoinSuccess, Localpath: "/C_host1_home", Peer_hash: h1, Path: "/home", World: w1, Status: 200, Message: "OK"},
+			{EventType: and.PeerJoin, Peer_hash: h1, World: w1},
+			{EventType: and.PeerJoin, Peer_hash: h2, World: w1},
+		}); !ok {
+		t.Fatal(msg)
+	}
+	if ok, msg := TimeoutCheckNDE(networker2,
+		and.NeighborDiscoveryEvent{EventType: and.PeerJoin, Peer_hash: h3, World: w1}); !ok {
+		t.Fatal(msg)
+	}
+
+	networker1.WaitClose()
+	networker2.WaitClose()
+	networker3.WaitClose()
+}
+
+func TestNetworkerHolePunch(t *testing.T) {
+	identity1, err := atype.GenerateAbyssPrivateIdentity("hostA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	networker1, _ := NewNetworker(identity1, NetCoreConfig{DialTimeout: time.Second})
+	w1 := NewWorld("https://www.abyssium.com/some_world.aml")
+	networker1.OpenWorld("/home", w1)
+
+	networker2, err := NewTestNATNetworker("hostB", NetCoreConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	networker3, _ := NewTestNATNetworker("hostC", NetCoreConfig{})
+
+	h1 := networker1.netcore.LocalIdentity().Hash
+	h2 := networker2.netcore.LocalIdentity().Hash
+	h3 := networker3.netcore.LocalIdentity().Hash
+
+	//unsolicited dial into the NAT fails
+	if _, err := networker1.netcore.Connect(networker3.netcore.LocalAddr()); err == nil {
+		t.Fatal("dial through NAT succeeded without punching")
+	}
+
+	networker2.JoinAny("/B_host1_home", networker1.netcore.LocalAddr(), h1, "/home")
+	if ok, msg := TimeoutCheckNDEMultiple(networker2,
+		[]and.NeighborDiscoveryEvent{
+			{EventType: and.JoinSuccess, Localpath: "/B_host1_home", Peer_hash: h1, Path: "/home", World: w1, Status: 200, Message: "OK"},
+			{EventType: and.PeerJoin, Peer_hash: h1, World: w1},
+		}); !ok {
+		t.Fatal(msg)
+	}
+	if ok, msg := TimeoutCheckNDE(networker1,
+		and.NeighborDiscoveryEvent{EventType: and.PeerJoin, Peer_hash: h2, World: w1}); !ok {
+		t.Fatal(msg)
+	}
+
+	//hostB dials hostC on JNI; hostA tells hostC to punch toward hostB
+	networker3.JoinAny("/C_host1_home", networker1.netcore.LocalAddr(), h1, "/home")
+	if ok, msg := TimeoutCheckNDEMultipleWithin(networker3,
+		[]and.NeighborDiscoveryEvent{
+			{EventType: and.JoinSuccess, Localpath: "/C_host1_home", Peer_hash: h1, Path: "/home", World: w1, Status: 200, Message: "OK"},
+			{EventType: and.PeerJoin, Peer_hash: h1, World: w1},
+			{EventType: and.PeerJoin, Peer_hash: h2, World: w1},
+		}, time.Second*5); !ok {
+		t.Fatal(msg)
+	}
+	if ok, msg := TimeoutCheckNDEMultipleWithin(networker2,
+		[]and.NeighborDiscoveryEvent{
+			{EventType: and.PeerJoin, Peer_hash: h3, World: w1},
+		}, time.Second*5); !ok {
+		t.Fatal(msg)
+	}
+
+	networker1.WaitClose()
+	networker2.WaitClose()
+	networker3.WaitClose()
+}
+
+func TestNetworkerRelay(t *testing.T) {
+	networker1, err := NewTestNetworker("relay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	networker2, err := NewTestNATNetworker("hostB", NetCoreConfig{DialTimeout: time.Millisecond * 500})
+	if err != nil {
+		t.Fatal(err)
+	}
+	networker3, _ := NewTestNATNetworker("hostC", NetCoreConfig{})
+	w3 := NewWorld("https://www.abyssium.com/some_world.aml")
+	networker3.OpenWorld("/home", w3)
+
+	h1 := networker1.netcore.LocalIdentity().Hash
+	h2 := networker2.netcore.LocalIdentity().Hash
+	h3 := networker3.netcore.LocalIdentity().Hash
+
+	if _, err := networker2.GetPeerByAddress(networker1.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := networker3.GetPeerByAddress(networker1.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	networker2.SetRelay(h3, h1)
+
+	//hostA does not relay yet
+	if _, err := networker2.GetPeerByAddress(networker3.LocalAddr()); err == nil {
+		t.Fatal("connected without relay")
+	}
+
+	networker1.EnableRelay(RelayConfig{MaxCircuits: 4})
+	peer3, err := networker2.GetPeerByAddress(networker3.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if relay_hash, ok := peer3.GetRelay(); !ok || relay_hash != h1 {
+		t.Fatal("connection not relayed")
+	}
+	//the accepting side registers the peer on its own
+	peer2, err := networker3.GetPeerByHash(h2)
+	for i := 0; err != nil && i < 10; i++ {
+		time.Sleep(time.Millisecond * 100)
+		peer2, err = networker3.GetPeerByHash(h2)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if relay_hash, ok := peer2.GetRelay(); !ok || relay_hash != h1 {
+		t.Fatal("connection not relayed on the accepting side")
+	}
+
+	//AHMP over the relayed connection
+	networker2.JoinConnected("/B_host3_home", peer3, "/home")
+	if ok, msg := TimeoutCheckNDEMultiple(networker2,
+		[]and.NeighborDiscoveryEvent{
+			{EventType: and.JoinSuccess, Localpath: "/B_host3_home", Peer_hash: h3, Path: "/home", World: w3, Status: 200, Message: "OK"},
+			{EventType: and.PeerJoin, Peer_hash: h3, World: w3},
+		}); !ok {
+		t.Fatal(msg)
+	}
+	if ok, msg := TimeoutCheckNDE(networker3,
+		and.NeighborDiscoveryEvent{EventType: and.PeerJoin, Peer_hash: h2, World: w3}); !ok {
+		t.Fatal(msg)
+	}
+
+	networker1.WaitClose()
+	networker2.WaitClose()
+	networker3.WaitClose()
+}
+
+func TestNetworkerShutdownRelayedHandshake(t *testing.T) {
+	network := NewMemoryNetwork()
+	networker1, _ := NewTestMemoryNetworker(network, "hostA")
+	nc2, _ := CreateMemoryHost(network, "hostB")
+	defer nc2.Close()
+	h2 := nc2.LocalIdentity().Hash
+	RelayedCount := func() int {
+		networker1.relay.mtx.Lock()
+		defer networker1.relay.mtx.Unlock()
+		return networker1.relay.relayed[h2]
+	}
+
+	//hostB carries a relayed handshake to hostA and never sends the TLS hello
+	session, err := nc2.Connect(networker1.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream, err := session.connection.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	third, _ := atype.GenerateAbyssPrivateIdentity("hostC")
+	writeStreamHeader(stream, relayed_protocol, third.Identity.Hash)
+	for start := time.Now(); RelayedCount() == 0; time.Sleep(time.Millisecond * 10) {
+		if time.Since(start) > time.Second*3 {
+			t.Fatal("relayed handshake not started")
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*200)
+	defer cancel()
+	networker1.Shutdown(ctx)
+	for range networker1.ErrLog {
+	}
+	//the handshake fails after ErrLog is closed, and gives its slot back
+	for start := time.Now(); RelayedCount() != 0; time.Sleep(time.Millisecond * 10) {
+		if time.Since(start) > time.Second*3 {
+			t.Fatal("relayed slot leaked")
+		}
+	}
+}
+
+func TestRelayCapacity(t *testing.T) {
+	relay := newRelayState()
+	relay.config = RelayConfig{MaxCircuits: 2, MaxCircuitsPerPeer: 1}
+
+	if !relay.acquire("a", "b") {
+		t.Fatal("first circuit refused")
+	}
+	if relay.acquire("a", "c") {
+		t.Fatal("per-peer limit not applied")
+	}
+	if !relay.acquire("c", "d") {
+		t.Fatal("second circuit refused")
+	}
+	if relay.acquire("e", "f") {
+		t.Fatal("circuit limit not applied")
+	}
+	relay.release("a", "b")
+	if !relay.acquire("a", "e") {
+		t.Fatal("released circuit not reusable")
+	}
+
+	//relayed sessions toward us, per carrying peer
+	for range relayed_max_per_carrier {
+		if !relay.acquireRelayed("a") {
+			t.Fatal("relayed session refused below the limit")
+		}
+	}
+	if relay.acquireRelayed("a") || !relay.acquireRelayed("b") {
+		t.Fatal("relayed limit not applied per carrier")
+	}
+	relay.releaseRelayed("a")
+	if !relay.acquireRelayed("a") {
+		t.Fatal("released relayed session not reusable")
+	}
+}
+
+func WaitLanEvent(networker *Networker, event_type LanDiscoveryEventType, hash string) (LanHost, bool) {
+	timeout := time.After(time.Second * 2)
+	for {
+		select {
+		case event := <-networker.LanEventCh:
+			if event.EventType == event_type && event.Host.Address.Pubkey_hash == hash {
+				return event.Host, true
+			}
+		case <-timeout:
+			return LanHost{}, false
+		}
+	}
+}
+
+func TestNetworkerLanDiscovery(t *testing.T) {
+	loopback, err := net.InterfaceByName("lo")
+	if err != nil {
+		t.Skip("no loopback interface")
+	}
+	config := LanDiscoveryConfig{
+		Group:     &net.UDPAddr{IP: net.IPv4(239, 255, 65, 83), Port: 16061},
+		Interface: loopback,
+		Interval:  time.Millisecond * 100,
+		Expiry:    time.Millisecond * 400,
+	}
+
+	networker1, _ := NewTestNetworker("hostA")
+	w1 := NewWorld("https://www.abyssium.com/some_world.aml")
+	networker1.OpenWorld("/home", w1)
+	networker2, _ := NewTestNetworker("hostB")
+
+	h1 := networker1.netcore.LocalIdentity().Hash
+	h2 := networker2.netcore.LocalIdentity().Hash
+
+	if err := networker1.StartLanDiscovery(config); err != nil {
+		t.Skip("multicast unavailable: " + err.Error())
+	}
+	if err := networker2.StartLanDiscovery(config); err != nil {
+		t.Fatal(err)
+	}
+
+	host1, ok := WaitLanEvent(networker2, LanHostFound, h1)
+	if !ok {
+		t.Fatal("hostA not found")
+	}
+	if len(host1.Paths) != 1 || host1.Paths[0] != "/home" {
+		t.Fatal("announced paths not match")
+	}
+	if _, ok := WaitLanEvent(networker1, LanHostFound, h2); !ok {
+		t.Fatal("hostB not found")
+	}
+	if hosts := networker2.LanHosts(); len(hosts) != 1 || hosts[0].Address.Pubkey_hash != h1 {
+		t.Fatal("lan host list not match")
+	}
+
+	//join through the announcement
+	networker2.JoinAny("/B_lan_home", host1.Address, h1, host1.Paths[0])
+	if ok, msg := TimeoutCheckNDEMultiple(networker2,
+		[]and.NeighborDiscoveryEvent{
+			{EventType: and.JoinSuccess, Localpath: "/B_lan_home", Peer_hash: h1, Path: "/home", World: w1, Status: 200, Message: "OK"},
+			{EventType: and.PeerJoin, Peer_hash: h1, World: w1},
+		}); !ok {
+		t.Fatal(msg)
+	}
+
+	//a newly opened world shows up in the next announcement
+	networker1.OpenWorld("/other", NewWorld("https://www.abyssium.com/other_world.aml"))
+	host1, ok = WaitLanEvent(networker2, LanHostChanged, h1)
+	if !ok || len(host1.Paths) != 2 || host1.Paths[1] != "/other" {
+		t.Fatal("path change not announced")
+	}
+
+	networker1.StopLanDiscovery()
+	if _, ok := WaitLanEvent(networker2, LanHostLost, h1); !ok {
+		t.Fatal("hostA not lost")
+	}
+
+	networker1.WaitClose()
+	networker2.WaitClose()
+}
+
+func TestReconnectPolicyDefaults(t *testing.T) {
+	networker, _ := NewTestNetworker("hostA")
+	networker.SetReconnectPolicy(&ReconnectPolicy{InitialBackoff: -time.Second * 2, MaxBackoff: -1, GraceWindow: time.Second})
+	policy := networker.reconnect_policy.Load()
+	if policy.InitialBackoff != time.Millisecond*500 || policy.MaxBackoff != time.Second*10 || policy.GraceWindow != time.Second {
+		t.Fatal("non-positive values not defaulted")
+	}
+
+	//the first backoff is drawn before anything is dialed
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	address, _ := atype.MakeAbyssAddress(networker.netcore.LocalIdentity().Hash, "127.0.0.1", 1, "")
+	networker.reconnect(ctx, address, *policy, nil, nil)
+	networker.WaitClose()
+}
+
+func TestNetworkerReconnect(t *testing.T) {
+	network := NewMemoryNetwork()
+	networker1, _ := NewTestMemoryNetworker(network, "hostA")
+	w1 := NewWorld("https://www.abyssium.com/some_world.aml")
+	networker1.OpenWorld("/home", w1)
+	networker2, _ := NewTestMemoryNetworker(network, "hostB")
+	networker3, _ := NewTestMemoryNetworker(network, "hostC")
+
+	h1 := networker1.netcore.LocalIdentity().Hash
+	h2 := networker2.netcore.LocalIdentity().Hash
+	h3 := networker3.netcore.LocalIdentity().Hash
+
+	policy := &ReconnectPolicy{InitialBackoff: time.Millisecond * 50, GraceWindow: time.Second}
+	networker1.SetReconnectPolicy(policy)
+	networker2.SetReconnectPolicy(policy)
+
+	networker2.JoinAny("/B_host1_home", networker1.LocalAddr(), h1, "/home")
+	if ok, msg := TimeoutCheckNDEMultiple(networker2,
+		[]and.NeighborDiscoveryEvent{
+			{EventType: and.JoinSuccess, Localpath: "/B_host1_home", Peer_hash: h1, Path: "/home", World: w1, Status: 200, Message: "OK"},
+			{EventType: and.PeerJoin, Peer_hash: h1, World: w1},
+		}); !ok {
+		t.Fatal(msg)
+	}
+	if ok, msg := TimeoutCheckNDE(networker1,
+		and.NeighborDiscoveryEvent{EventType: and.PeerJoin, Peer_hash: h2, World: w1}); !ok {
+		t.Fatal(msg)
+	}
+	peer2, _ := networker1.GetPeerByHash(h2)
+
+	//drop the connection; both sides redial, and hostB stays a member without events
+	dropped := peer2.session()
+	dropped.connection.CloseWithError(0, "dropped")
+	for i := 0; i < 40; i++ {
+		if resumed, err := networker1.GetPeerByHash(h2); err == nil && resumed.session() != dropped {
+			break
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+	resumed, err := networker1.GetPeerByHash(h2)
+	if err != nil || resumed.session() == dropped {
+		t.Fatal("not reconnected")
+	}
+	if resumed != peer2 {
+		t.Fatal("peer replaced on reconnect")
+	}
+	select {
+	case event := <-networker1.NdhEventCh:
+		t.Fatal("unexpected event on reconnect: " + event.Stringify())
+	case event := <-networker2.NdhEventCh:
+		t.Fatal("unexpected event on reconnect: " + event.Stringify())
+	case <-time.After(time.Millisecond * 300):
+	}
+
+	//the world keeps working over the new connection
+	networker3.JoinAny("/C_host1_home", networker1.LocalAddr(), h1, "/home")
+	if ok, msg := TimeoutCheckNDEMultiple(networker3,
+		[]and.NeighborDiscoveryEvent{
+			{EventType: and.JoinSuccess, Localpath: "/C_host1_home", Peer_hash: h1, Path: "/home", World: w1, Status: 200, Message: "OK"},
+			{EventType: and.PeerJoin, Peer_hash: h1, World: w1},
+			{EventType: and.PeerJoin, Peer_hash: h2, World: w1},
+		}); !ok {
+		t.Fatal(msg)
+	}
+	if ok, msg := TimeoutCheckNDE(networker2,
+		and.NeighborDiscoveryEvent{EventType: and.PeerJoin, Peer_hash: h3, World: w1}); !ok {
+		t.Fatal(msg)
+	}
+	if ok, msg := TimeoutCheckNDE(networker1,
+		and.NeighborDiscoveryEvent{EventType: and.PeerJoin, Peer_hash: h3, World: w1}); !ok {
+		t.Fatal(msg)
+	}
+
+	//hostB becomes unreachable; it leaves once the grace window ends
+	networker2.SetReconnectPolicy(nil)
+	network.unregister(networker2.netcore.(*MemoryNetCore).endpoint)
+	peer2.session().connection.CloseWithError(0, "dropped")
+	if ok, msg := TimeoutCheckNDEMultipleWithin(networker1,
+		[]and.NeighborDiscoveryEvent{
+			{EventType: and.PeerLeave, Peer_hash: h2, World: w1},
+		}, time.Second*3); !ok {
+		t.Fatal(msg)
+	}
+
+	networker1.WaitClose()
+	networker2.WaitClose()
+	networker3.WaitClose()
+}
+
+func TestNetworkerShutdown(t *testing.T) {
+	networker1, _ := NewTestNetworker("hostA")
+	w1 := NewWorld("https://www.abyssium.com/some_world.aml")
+	networker1.OpenWorld("/home", w1)
+	networker2, _ := NewTestNetworker("hostB")
+	h1 := networker1.netcore.LocalIdentity().Hash
+	h2 := networker2.netcore.LocalIdentity().Hash
+
+	//had hostB just vanished, it would stay in the world for the grace window
+	networker1.SetReconnectPolicy(&ReconnectPolicy{GraceWindow: time.Minute})
+
+	networker2.JoinAny("/B_host1_home", networker1.LocalAddr(), h1, "/home")
+	if ok, msg := TimeoutCheckNDEMultiple(networker2,
+		[]and.NeighborDiscoveryEvent{
+			{EventType: and.JoinSuccess, Localpath: "/B_host1_home", Peer_hash: h1, Path: "/home", World: w1, Status: 200, Message: "OK"},
+			{EventType: and.PeerJoin, Peer_hash: h1, World: w1},
+		}); !ok {
+		t.Fatal(msg)
+	}
+	if ok, msg := TimeoutCheckNDE(networker1,
+		and.NeighborDiscoveryEvent{EventType: and.PeerJoin, Peer_hash: h2, World: w1}); !ok {
+		t.Fatal(msg)
+	}
+
+	//a dial to a host that never answers, in flight during the shutdown
+	silent, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	silent_identity, _ := atype.GenerateAbyssPrivateIdentity("silent")
+	silent_address, _ := atype.MakeAbyssAddress(silent_identity.Identity.Hash, "127.0.0.1", uint16(silent.LocalAddr().(*net.UDPAddr).Port), "")
+	query_err := make(chan error, 1)
+	go func() {
+		_, err := networker2.GetPeerByAddress(silent_address)
+		query_err <- err
+	}()
+	time.Sleep(time.Millisecond * 100)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+	defer cancel()
+	if err := networker2.Shutdown(ctx); err != nil {
+		t.Fatal("peers did not hang up: " + err.Error())
+	}
+	select {
+	case err := <-query_err:
+		if err != ErrNetworkerClosed {
+			t.Fatal("pending query not failed: " + fmt.Sprint(err))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("pending query still blocked")
+	}
+	if _, err := networker2.GetPeerByHash(h1); err != ErrNetworkerClosed {
+		t.Fatal("query after shutdown: " + fmt.Sprint(err))
+	}
+
+	//hostA learns through the RST, without waiting for the grace window
+	if ok, msg := TimeoutCheckNDE(networker1,
+		and.NeighborDiscoveryEvent{EventType: and.PeerLeave, Peer_hash: h2, World: w1}); !ok {
+		t.Fatal(msg)
+	}
+	networker1.WaitClose()
+	networker2.WaitClose()
+}
+
+func TestNetworkerPeerStats(t *testing.T) {
+	networker1, _ := NewTestNetworker("hostA")
+	w1 := NewWorld("https://www.abyssium.com/some_world.aml")
+	networker1.OpenWorld("/home", w1)
+	networker2, _ := NewTestNetworker("hostB")
+	h1 := networker1.netcore.LocalIdentity().Hash
+	h2 := networker2.netcore.LocalIdentity().Hash
+
+	networker2.JoinAny("/B_host1_home", networker1.LocalAddr(), h1, "/home")
+	if ok, msg := TimeoutCheckNDEMultiple(networker2,
+		[]and.NeighborDiscoveryEvent{
+			{EventType: and.JoinSuccess, Localpath: "/B_host1_home", Peer_hash: h1, Path: "/home", World: w1, Status: 200, Message: "OK"},
+			{EventType: and.PeerJoin, Peer_hash: h1, World: w1},
+		}); !ok {
+		t.Fatal(msg)
+	}
+
+	all_stats := networker2.PeerStats()
+	if len(all_stats) != 1 || all_stats[0].Hash != h1 {
+		t.Fatal("unexpected peers: " + fmt.Sprint(all_stats))
+	}
+	stats := all_stats[0].Primary
+	if stats.RTT <= 0 || stats.PacketsSent == 0 || stats.PacketsReceived == 0 || stats.BytesSent == 0 || stats.BytesReceived == 0 {
+		t.Fatal("no QUIC metrics: " + fmt.Sprint(stats))
+	}
+	//JN sent, JOK received
+	if stats.AHMPSent == 0 || stats.AHMPReceived == 0 {
+		t.Fatal("no AHMP counts: " + fmt.Sprint(stats))
+	}
+	if stats.LossRate() < 0 || stats.LossRate() > 1 || all_stats[0].SecondaryInUse {
+		t.Fatal("unexpected stats: " + fmt.Sprint(all_stats[0]))
+	}
+
+	peer2, err := networker1.GetPeerByHash(h2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if peer2.Stats().Primary.AHMPReceived == 0 {
+		t.Fatal("JN not counted")
+	}
+	networker1.WaitClose()
+	networker2.WaitClose()
+}
+
+func WaitDatagram(ch <-chan WorldDatagram, peer_hash string, payload string) bool {
+	select {
+	case datagram := <-ch:
+		return datagram.Peer_hash == peer_hash && string(datagram.Payload) == payload
+	case <-time.After(time.Second):
+		return false
+	}
+}
+
+func TestNetworkerWorldDatagram(t *testing.T) {
+	networker1, _ := NewTestNetworker("hostA")
+	w1 := NewWorld("https://www.abyssium.com/some_world.aml")
+	networker1.OpenWorld("/home", w1)
+	networker2, _ := NewTestNetworker("hostB")
+	networker3, _ := NewTestNetworker("hostC")
+	h1 := networker1.netcore.LocalIdentity().Hash
+	h2 := networker2.netcore.LocalIdentity().Hash
+	h3 := networker3.netcore.LocalIdentity().Hash
+
+	networker2.JoinAny("/B_host1_home", networker1.LocalAddr(), h1, "/home")
+	if ok, msg := TimeoutCheckNDEMultiple(networker2,
+		[]and.NeighborDiscoveryEvent{
+			{EventType: and.JoinSuccess, Localpath: "/B_host1_home", Peer_hash: h1, Path: "/home", World: w1, Status: 200, Message: "OK"},
+			{EventType: and.PeerJoin, Peer_hash: h1, World: w1},
+		}); !ok {
+		t.Fatal(msg)
+	}
+	networker3.JoinAny("/C_host1_home", networker1.LocalAddr(), h1, "/home")
+	if ok, msg := TimeoutCheckNDEMultiple(networker3,
+		[]and.NeighborDiscoveryEvent{
+			{EventType: and.JoinSuccess, Localpath: "/C_host1_home", Peer_hash: h1, Path: "/home", World: w1, Status: 200, Message: "OK"},
+			{EventType: and.PeerJoin, Peer_hash: h1, World: w1},
+			{EventType: and.PeerJoin, Peer_hash: h2, World: w1},
+		}); !ok {
+		t.Fatal(msg)
+	}
+	if ok, msg := TimeoutCheckNDE(networker2,
+		and.NeighborDiscoveryEvent{EventType: and.PeerJoin, Peer_hash: h3, World: w1}); !ok {
+		t.Fatal(msg)
+	}
+
+	ch1 := networker1.WorldDatagrams(w1.GetUUID())
+	ch3 := networker3.WorldDatagrams(w1.GetUUID())
+	if err := networker2.BroadcastWorldDatagram(w1.GetUUID(), []byte("x=1,y=2")); err != nil {
+		t.Fatal(err)
+	}
+	if !WaitDatagram(ch1, h2, "x=1,y=2") || !WaitDatagram(ch3, h2, "x=1,y=2") {
+		t.Fatal("broadcast not delivered")
+	}
+	if err := networker1.SendWorldDatagram(w1.GetUUID(), h3, []byte("hello C")); err != nil {
+		t.Fatal(err)
+	}
+	if !WaitDatagram(ch3, h1, "hello C") {
+		t.Fatal("datagram not delivered")
+	}
+
+	//each member that fails is reported on its own
+	err := networker2.BroadcastWorldDatagram(w1.GetUUID(), make([]byte, 64*1024))
+	if err == nil {
+		t.Fatal("oversized broadcast sent")
+	}
+	failed := map[string]bool{}
+	for _, joined := range err.(interface{ Unwrap() []error }).Unwrap() {
+		var datagram_err *WorldDatagramError
+		var too_large *quic.DatagramTooLargeError
+		if !errors.As(joined, &datagram_err) || !errors.As(joined, &too_large) {
+			t.Fatal("unexpected broadcast failure:", joined)
+		}
+		failed[datagram_err.Peer_hash] = true
+	}
+	if len(failed) != 2 || !failed[h1] || !failed[h3] {
+		t.Fatal("failures not reported per member:", err)
+	}
+
+	//only to members, and only of worlds we are in
+	if err := networker1.SendWorldDatagram(NewWorld("https://www.abyssium.com/other.aml").GetUUID(), h3, []byte("?")); err == nil {
+		t.Fatal("sent to a non-member")
+	}
+	if err := networker1.SendWorldDatagram("not a uuid", h3, []byte("?")); err == nil {
+		t.Fatal("sent with an invalid world UUID")
+	}
+	networker3.CloseWorldDatagrams(w1.GetUUID())
+	if _, ok := <-ch3; ok {
+		t.Fatal("channel not closed")
+	}
+
+	networker1.WaitClose()
+	networker2.WaitClose()
+	networker3.WaitClose()
+}
+
+func TestNetworkerAppStream(t *testing.T) {
+	networker1, _ := NewTestNetworker("hostA")
+	networker2, _ := NewTestNetworker("hostB")
+	h2 := networker2.netcore.LocalIdentity().Hash
+
+	callers := make(chan string, 1)
+	err := networker1.HandleStream("echo/1", func(peer *Peer, stream quic.Stream) {
+		defer stream.Close()
+		callers <- peer.GetHash()
+		io.Copy(stream, stream)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if networker1.HandleStream("abyss-relay", func(*Peer, quic.Stream) {}) == nil {
+		t.Fatal("reserved protocol registered")
+	}
+
+	peer1, err := networker2.GetPeerByAddress(networker1.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	stream, err := peer1.OpenStream(ctx, "echo/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.Write([]byte("ping"))
+	stream.Close()
+	echoed, err := io.ReadAll(stream)
+	if err != nil || string(echoed) != "ping" {
+		t.Fatal("echo failed: " + string(echoed) + fmt.Sprint(err))
+	}
+	if <-callers != h2 {
+		t.Fatal("handler got the wrong peer")
+	}
+	if peer1.Stats().Primary.StreamsOpened != 1 {
+		t.Fatal("stream not counted")
+	}
+
+	//no handler on the other side
+	unknown, err := peer1.OpenStream(ctx, "nope")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = io.ReadAll(unknown)
+	var stream_err *quic.StreamError
+	if !errors.As(err, &stream_err) || stream_err.ErrorCode != StreamErrorUnknownProtocol {
+		t.Fatal("unknown protocol not reset: " + fmt.Sprint(err))
+	}
+
+	networker1.WaitClose()
+	networker2.WaitClose()
+}
+
+func TestNetworkerOverTCP(t *testing.T) {
+	NewTcpNetworker := func(name string) *Networker {
+		identity, err := atype.GenerateAbyssPrivateIdentity(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		netcore, err := NewTcpNetCore(identity, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}, NetCoreConfig{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		networker, err := NewNetworkerWithNetCore(netcore)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return networker
+	}
+	networker1 := NewTcpNetworker("hostA")
+	networker2 := NewTcpNetworker("hostB")
+
+	err := networker1.HandleStream("echo/1", func(peer *Peer, stream quic.Stream) {
+		defer stream.Close()
+		io.Copy(stream, stream)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer1, err := networker2.GetPeerByAddress(networker1.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream, err := peer1.OpenStream(context.Background(), "echo/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.Write([]byte("ping"))
+	stream.Close()
+	if echoed, err := io.ReadAll(stream); err != nil || string(echoed) != "ping" {
+		t.Fatal("echo failed over TCP: " + fmt.Sprint(err))
+	}
+	if stats := peer1.Stats().Primary; stats.BytesSent == 0 || stats.PacketsSent != 0 {
+		t.Fatal("unexpected stats over TCP")
+	}
+
+	networker1.WaitClose()
+	networker2.WaitClose()
+}
+
+func TestPeerDuplicateSession(t *testing.T) {
+	_, _, nc1, err := CreateRandomHost()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, nc2, err := CreateRandomHost()
+	if err != nil {
+		t.Fatal(err)
+	}
+	//x dialed by nc1, y by nc2; each end of either
+	Dial := func(dialer INetCore, acceptor INetCore) (*Transmission, *Transmission) {
+		accepted := make(chan *Transmission, 1)
+		go func() {
+			session, _ := acceptor.Accept()
+			accepted <- session
+		}()
+		session, err := dialer.Connect(acceptor.LocalAddr())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return session, <-accepted
+	}
+	x1, x2 := Dial(nc1, nc2)
+	y2, y1 := Dial(nc2, nc1)
+
+	//each host saw its own dial first: the worst case
+	ch1 := make(chan AHMPReadRes, 1024)
+	ch2 := make(chan AHMPReadRes, 1024)
+	peer2 := NewPeer(x1, ch1) //nc1's view of nc2
+	peer1 := NewPeer(y2, ch2)
+
+	const count = 200
+	Send := func(peer *Peer, prefix string, done chan bool) {
+		for i := range count {
+			peer.SendJN(prefix + strconv.Itoa(i))
+		}
+		done <- true
+	}
+	done := make(chan bool, 2)
+	go Send(peer2, "/from1/", done)
+	go Send(peer1, "/from2/", done)
+	if !peer2.TryAddSession(y1) || !peer1.TryAddSession(x2) {
+		t.Fatal("duplicate session not added")
+	}
+	<-done
+	<-done
+
+	//both keep the session dialed by the lower hash
+	kept, dropped := x1, y1
+	if nc2.LocalIdentity().Hash < nc1.LocalIdentity().Hash {
+		kept, dropped = y1, x1
+	}
+	select {
+	case <-dropped.connection.Context().Done():
+	case <-time.After(time.Second * 3):
+		t.Fatal("duplicate not closed")
+	}
+	if peer2.session() != kept || (peer1.session() == x2) != (kept == x1) {
+		t.Fatal("hosts kept different sessions")
+	}
+
+	Receive := func(ch chan AHMPReadRes, prefix string) {
+		seen := make(map[string]bool)
+		for len(seen) < count {
+			select {
+			case read := <-ch:
+				jn, ok := read.msg.(AHMPRaw_JN)
+				if !ok {
+					t.Fatal("unexpected message: " + fmt.Sprint(read.msg))
+				}
+				if seen[string(jn.path)] || !strings.HasPrefix(string(jn.path), prefix) {
+					t.Fatal("duplicated or foreign message: " + string(jn.path))
+				}
+				seen[string(jn.path)] = true
+			case <-time.After(time.Second * 3):
+				t.Fatal("messages lost: " + strconv.Itoa(count-len(seen)))
+			}
+		}
+		select {
+		case read := <-ch:
+			t.Fatal("extra message: " + fmt.Sprint(read.msg))
+		case <-time.After(time.Millisecond * 100):
+		}
+	}
+	Receive(ch1, "/from2/")
+	Receive(ch2, "/from1/")
+	if peer1.Stats().SecondaryInUse || peer2.Stats().SecondaryInUse {
+		t.Fatal("duplicate still in use")
+	}
+
+	peer1.Close()
+	peer2.Close()
+	nc1.Close()
+	nc2.Close()
+}
+
+// records punch requests instead of sending packets.
+type testPunchNetCore struct {
+	*MemoryNetCore
+	punched chan atype.AbyssAddress
+}
+
+func (n *testPunchNetCore) Punch(address atype.AbyssAddress) {
+	n.punched <- address
+}
+
+func TestNetworkerPunchIntroducer(t *testing.T) {
+	network := NewMemoryNetwork()
+	networker1, _ := NewTestMemoryNetworker(network, "hostA")
+	w1 := NewWorld("https://www.abyssium.com/some_world.aml")
+	networker1.OpenWorld("/home", w1)
+	netcore2, _ := CreateMemoryHost(network, "hostB")
+	punched := make(chan atype.AbyssAddress, 8)
+	networker2, _ := NewNetworkerWithNetCore(&testPunchNetCore{netcore2, punched})
+	h1 := networker1.netcore.LocalIdentity().Hash
+
+	third, _ := atype.GenerateAbyssPrivateIdentity("hostC")
+	target, _ := atype.MakeAbyssAddress(third.Identity.Hash, "10.9.9.9", 1605, "")
+	hostname_target, _ := atype.MakeAbyssAddress(third.Identity.Hash, "victim.example.org", 1605, "")
+	ExpectPunch := func(expected bool) {
+		select {
+		case address := <-punched:
+			if !expected {
+				t.Fatal("punched for a stranger: " + address.Text)
+			}
+		case <-time.After(time.Millisecond * 300):
+			if expected {
+				t.Fatal("introduced punch not sent")
+			}
+		}
+	}
+
+	//a connected peer sharing no world with us cannot make us send traffic
+	peer2, err := networker1.GetPeerByAddress(networker2.netcore.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer2.SendPCH(w1, target)
+	ExpectPunch(false)
+
+	networker2.JoinAny("/B_host1_home", networker1.netcore.LocalAddr(), h1, "/home")
+	if ok, msg := TimeoutCheckNDEMultiple(networker2,
+		[]and.NeighborDiscoveryEvent{
+			{EventType: and.JoinSuccess, Localpath: "/B_host1_home", Peer_hash: h1, Path: "/home", World: w1, Status: 200, Message: "OK"},
+			{EventType: and.PeerJoin, Peer_hash: h1, World: w1},
+		}); !ok {
+		t.Fatal(msg)
+	}
+
+	//a co-member may introduce, but never makes us resolve a hostname
+	peer2.SendPCH(w1, hostname_target)
+	ExpectPunch(false)
+	peer2.SendPCH(w1, target)
+	ExpectPunch(true)
+
+	networker1.WaitClose()
+	networker2.WaitClose()
+}
+
+func TestPeerDuplicateSessionRelayed(t *testing.T) {
+	network := NewMemoryNetwork()
+	nc1, _ := CreateMemoryHost(network, "host1")
+	nc2, _ := CreateMemoryHost(network, "host2")
+	Dial := func(dialer INetCore, acceptor INetCore) (*Transmission, *Transmission) {
+		accepted := make(chan *Transmission, 1)
+		go func() {
+			session, _ := acceptor.Accept()
+			accepted <- session
+		}()
+		session, err := dialer.Connect(acceptor.LocalAddr())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return session, <-accepted
+	}
+	//the session the hash tie-break would keep goes through a relay; the direct one must win on both hosts
+	relayed1, relayed2 := Dial(nc1, nc2)
+	direct2, direct1 := Dial(nc2, nc1)
+	if nc2.LocalIdentity().Hash < nc1.LocalIdentity().Hash {
+		relayed1, relayed2, direct1, direct2 = direct1, direct2, relayed1, relayed2
+	}
+	relayed1.setRelayed("relay")
+	relayed2.setRelayed("relay")
+
+	peer2 := NewPeer(relayed1, make(chan AHMPReadRes, 64)) //nc1's view of nc2
+	peer1 := NewPeer(direct2, make(chan AHMPReadRes, 64))
+	if !peer2.TryAddSession(direct1) || !peer1.TryAddSession(relayed2) {
+		t.Fatal("duplicate session not added")
+	}
+	select {
+	case <-relayed1.connection.Context().Done():
+	case <-time.After(time.Second * 3):
+		t.Fatal("relayed duplicate not closed")
+	}
+	if peer2.session() != direct1 || peer1.session() != direct2 {
+		t.Fatal("relayed session kept over a direct one")
+	}
+
+	peer1.Close()
+	peer2.Close()
+	nc1.Close()
+	nc2.Close()
+}
+
+// dials through a pair of memory hosts; low is the one with the lower hash, whose dial the tie-break keeps.
+func dialDuplicateSessions(t *testing.T) (low_kept, high_kept, low_dropped, high_dropped *Transmission, closeAll func()) {
+	network := NewMemoryNetwork()
+	low, _ := CreateMemoryHost(network, "host1")
+	high, _ := CreateMemoryHost(network, "host2")
+	if high.LocalIdentity().Hash < low.LocalIdentity().Hash {
+		low, high = high, low
+	}
+	Dial := func(dialer INetCore, acceptor INetCore) (*Transmission, *Transmission) {
+		accepted := make(chan *Transmission, 1)
+		go func() {
+			session, _ := acceptor.Accept()
+			accepted <- session
+		}()
+		session, err := dialer.Connect(acceptor.LocalAddr())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return session, <-accepted
+	}
+	low_kept, high_kept = Dial(low, high)
+	high_dropped, low_dropped = Dial(high, low)
+	return low_kept, high_kept, low_dropped, high_dropped, func() {
+		low.Close()
+		high.Close()
+	}
+}
+
+func expectJN(t *testing.T, ch chan AHMPReadRes, paths ...string) {
+	for _, path := range paths {
+		select {
+		case read := <-ch:
+			jn, ok := read.msg.(AHMPRaw_JN)
+			if !ok || string(jn.path) != path {
+				t.Fatal("expected " + path + ", got " + fmt.Sprint(read.msg))
+			}
+		case <-time.After(time.Second * 3):
+			t.Fatal("message lost: " + path)
+		}
+	}
+}
+
+func TestPeerDuplicateSessionLateAdoption(t *testing.T) {
+	low_kept, high_kept, low_dropped, high_dropped, closeAll := dialDuplicateSessions(t)
+	defer closeAll()
+	ch_low := make(chan AHMPReadRes, 64)
+	ch_high := make(chan AHMPReadRes, 64)
+	peer_high := NewPeer(low_dropped, ch_low) //the low host's view of the high one
+	peer_low := NewPeer(high_dropped, ch_high)
+
+	//the low host switches at once; its DUP reaches the high host before the kept session does
+	if !peer_high.TryAddSession(low_kept) {
+		t.Fatal("duplicate session not added")
+	}
+	peer_high.SendJN("/a")
+	for start := time.Now(); ; time.Sleep(time.Millisecond * 10) {
+		peer_low.session_mtx.Lock()
+		received := high_dropped.dup_received
+		peer_low.session_mtx.Unlock()
+		if received {
+			break
+		}
+		if time.Since(start) > time.Second*3 {
+			t.Fatal("DUP not received")
+		}
+	}
+	if peer_low.session() != high_dropped {
+		t.Fatal("switched to a session not held yet")
+	}
+	peer_low.SendJN("/b")
+	expectJN(t, ch_low, "/b")
+
+	if !peer_low.TryAddSession(high_kept) {
+		t.Fatal("duplicate session not added")
+	}
+	peer_low.SendJN("/c")
+	peer_high.SendJN("/d")
+	select {
+	case <-low_dropped.connection.Context().Done():
+	case <-time.After(time.Second * 3):
+		t.Fatal("duplicate not closed")
+	}
+	if peer_high.session() != low_kept || peer_low.session() != high_kept {
+		t.Fatal("hosts kept different sessions")
+	}
+	expectJN(t, ch_low, "/c")
+	expectJN(t, ch_high, "/a", "/d")
+	select {
+	case read := <-ch_low:
+		t.Fatal("unexpected message: " + fmt.Sprint(read.msg))
+	case read := <-ch_high:
+		t.Fatal("unexpected message: " + fmt.Sprint(read.msg))
+	case <-time.After(time.Millisecond * 100):
+	}
+
+	peer_low.Close()
+	peer_high.Close()
+}
+
+func TestPeerDuplicateSessionOrder(t *testing.T) {
+	//the high host starts on the dropped session, or on the kept one before the dropped one reaches it
+	for _, high_starts_kept := range []bool{false, true} {
+		low_kept, high_kept, low_dropped, high_dropped, closeAll := dialDuplicateSessions(t)
+		ch_low := make(chan AHMPReadRes, 1024)
+		ch_high := make(chan AHMPReadRes, 1024)
+		peer_high := NewPeer(low_dropped, ch_low)
+		high_first, high_second := high_dropped, high_kept
+		if high_starts_kept {
+			high_first, high_second = high_kept, high_dropped
+		}
+		peer_low := NewPeer(high_first, ch_high)
+
+		const count = 200
+		done := make(chan bool, 2)
+		Send := func(peer *Peer, prefix string) {
+			for i := range count {
+				peer.SendJN(prefix + strconv.Itoa(i))
+				if i%20 == 0 {
+					time.Sleep(time.Millisecond)
+				}
+			}
+			done <- true
+		}
+		go Send(peer_high, "/from_low/")
+		go Send(peer_low, "/from_high/")
+		time.Sleep(time.Millisecond * 5)
+		if !peer_high.TryAddSession(low_kept) {
+			t.Fatal("duplicate session not added")
+		}
+		time.Sleep(time.Millisecond * 5)
+		if !peer_low.TryAddSession(high_second) {
+			t.Fatal("duplicate session not added")
+		}
+		<-done
+		<-done
+
+		Receive := func(ch chan AHMPReadRes, prefix string) {
+			for i := range count {
+				select {
+				case read := <-ch:
+					jn, ok := read.msg.(AHMPRaw_JN)
+					if !ok || string(jn.path) != prefix+strconv.Itoa(i) {
+						t.Fatal("expected " + prefix + strconv.Itoa(i) + ", got " + fmt.Sprint(read.msg))
+					}
+				case <-time.After(time.Second * 3):
+					t.Fatal("message lost: " + prefix + strconv.Itoa(i))
+				}
+			}
+		}
+		Receive(ch_low, "/from_high/")
+		Receive(ch_high, "/from_low/")
+		select {
+		case <-low_dropped.connection.Context().Done():
+		case <-time.After(time.Second * 3):
+			t.Fatal("duplicate not closed")
+		}
+		if peer_high.session() != low_kept || peer_low.session() != high_kept {
+			t.Fatal("hosts kept different sessions")
+		}
+
+		peer_low.Close()
+		peer_high.Close()
+		closeAll()
+	}
+}
+
+func TestPeerSupersededSession(t *testing.T) {
+	network := NewMemoryNetwork()
+	dialer, _ := CreateMemoryHost(network, "host1")
+	acceptor, _ := CreateMemoryHost(network, "host2")
+	defer dialer.Close()
+	defer acceptor.Close()
+	Dial := func() (*Transmission, *Transmission) {
+		accepted := make(chan *Transmission, 1)
+		go func() {
+			session, _ := acceptor.Accept()
+			accepted <- session
+		}()
+		session, err := dialer.Connect(acceptor.LocalAddr())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return session, <-accepted
+	}
+	//the acceptor holds a late race winner before the session its dialer keeps
+	dialer_late, acceptor_late := Dial()
+	dialer_kept, acceptor_kept := Dial()
+	ch_acceptor := make(chan AHMPReadRes, 64)
+	ch_dialer := make(chan AHMPReadRes, 64)
+	peer_dialer := NewPeer(acceptor_late, ch_acceptor)
+	if !peer_dialer.TryAddSession(acceptor_kept) {
+		t.Fatal("duplicate session not added")
+	}
+	peer_acceptor := NewPeer(dialer_kept, ch_dialer)
+
+	dialer_late.connection.CloseWithError(CloseSuperseded, "superseded")
+	for start := time.Now(); peer_dialer.session() != acceptor_kept; time.Sleep(time.Millisecond * 10) {
+		if time.Since(start) > time.Second*3 {
+			t.Fatal("superseded session not replaced")
+		}
+	}
+	peer_acceptor.SendJN("/a")
+	peer_dialer.SendJN("/b")
+	expectJN(t, ch_acceptor, "/a")
+	expectJN(t, ch_dialer, "/b")
+
+	peer_acceptor.Close()
+	peer_dialer.Close()
+}
+
+func TestPeerDuplicateSessionEndsBeforeAdoption(t *testing.T) {
+	for _, close_stream := range []bool{false, true} {
+		low_kept, high_kept, low_dropped, high_dropped, closeAll := dialDuplicateSessions(t)
+		ch_low := make(chan AHMPReadRes, 64)
+		ch_high := make(chan AHMPReadRes, 64)
+		peer_high := NewPeer(low_dropped, ch_low)
+		peer_low := NewPeer(high_dropped, ch_high)
+
+		//the acceptor of the kept session holds it without switching; the dialer loses it before adopting it
+		if !peer_low.TryAddSession(high_kept) {
+			t.Fatal("duplicate session not added")
+		}
+		if peer_low.session() != high_dropped {
+			t.Fatal("switched to a session the peer does not hold")
+		}
+		if close_stream {
+			low_kept.ahmp_stream.Close()
+		} else {
+			low_kept.connection.CloseWithError(0, "connection close")
+		}
+		select {
+		case <-high_kept.connection.Context().Done():
+		case <-time.After(time.Second * 3):
+			t.Fatal("ended duplicate not closed")
+		}
+
+		//the peer goes on over the session both hold
+		peer_low.SendJN("/a")
+		peer_high.SendJN("/b")
+		expectJN(t, ch_low, "/a")
+		expectJN(t, ch_high, "/b")
+		for start := time.Now(); peer_low.Stats().SecondaryInUse; time.Sleep(time.Millisecond * 10) {
+			if time.Since(start) > time.Second*3 {
+				t.Fatal("ended duplicate still held")
+			}
+		}
+
+		peer_low.Close()
+		peer_high.Close()
+		closeAll()
+	}
+}
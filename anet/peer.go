@@ -3,9 +3,16 @@ package anet
 import (
 	"abyss/and"
 	"abyss/atype"
+	"context"
+	"errors"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
+	"time"
+
+	"github.com/quic-go/quic-go"
 )
 
 type AHMPReadRes struct {
@@ -14,11 +21,25 @@ type AHMPReadRes struct {
 	err  error
 }
 
+// how long the end of a duplicate session that retired it last waits for the other end to close it.
+const duplicate_close_timeout = time.Second * 10
+
+// the last message on a duplicate session; see TryAddSession.
+var ahmp_dup_message = []byte("AHMP/1.0 DUP\n\n")
+
+// the same Peer is kept across a reconnect (see ReconnectPolicy); its sessions are replaced.
 type Peer struct {
+	send_mtx          sync.Mutex //held while sending, so no message goes to a session being retired
+	session_mtx       sync.Mutex
 	primary_session   *Transmission
-	secondary_session *Transmission
+	secondary_session *Transmission //a duplicate from a simultaneous connect: the one to switch to, or the one being drained
 	AhmpCh            chan AHMPReadRes
 	is_ok             atomic.Bool
+
+	//between our DUP and the peer's answer, when we retired the duplicate first (see TryAddSession).
+	//set and cleared with both mutexes held
+	handover chan struct{} //closed at the answer. what arrives on the kept session waits for it
+	queued   [][]byte      //messages we send meanwhile; they go on the kept session at the answer
 }
 
 // only this can be called externally for peer close. never call Close() directly.
@@ -34,14 +55,33 @@ func (p *Peer) ServeSessionLoop(session *Transmission) {
 		if err != nil {
 			_, ok := err.(*AHMPError)
 			if !ok {
-				p.Signal(err)
+				p.sessionFailed(session, err)
 				return //should be channel/connection closed (may need revision)
 			}
 		}
+		session.counters.ahmp_received.Add(1)
+		if _, ok := msg.(AHMPRaw_DUP); ok {
+			p.receiveDUP(session)
+			continue
+		}
+		if handover := p.handoverFor(session); handover != nil {
+			select {
+			case <-handover:
+			case <-session.connection.Context().Done():
+				p.sessionFailed(session, context.Cause(session.connection.Context()))
+				return
+			}
+		}
 		p.AhmpCh <- AHMPReadRes{p, msg, err}
 	}
 }
 
+func (p *Peer) session() *Transmission {
+	p.session_mtx.Lock()
+	defer p.session_mtx.Unlock()
+	return p.primary_session
+}
+
 func NewPeer(session *Transmission, ahmp_ch chan AHMPReadRes) *Peer {
 	result := new(Peer)
 	result.primary_session = session
@@ -53,68 +93,262 @@ func NewPeer(session *Transmission, ahmp_ch chan AHMPReadRes) *Peer {
 	return result
 }
 
+// a second session with the peer, from a simultaneous connect. both hosts keep the same one (see preferredOver)
+// and drain the other, so no AHMP message is lost, duplicated or reordered. false while a previous duplicate drains.
+//
+// a host switches only to a session the peer is known to hold. the dialer of the kept session switches at once
+// and ends the other with DUP; its acceptor keeps sending on the current one until that DUP arrives,
+// which may be before the kept session reaches it, then switches and answers with its own DUP.
+// until the answer, the host that went first queues what it sends and holds what arrives on the kept session,
+// as the peer may not have read the other one to its end yet.
+// the end that sent DUP first closes the connection on reading the answer, so both ends have read everything.
 func (p *Peer) TryAddSession(session *Transmission) bool {
-	if p.primary_session.address != session.address {
-		return false
-	}
+	p.send_mtx.Lock()
+	defer p.send_mtx.Unlock()
+	p.session_mtx.Lock()
 	if p.secondary_session != nil {
+		p.session_mtx.Unlock()
 		return false
 	}
 	p.secondary_session = session
-
 	go p.ServeSessionLoop(session)
-
+	dropped := p.settle()
+	p.session_mtx.Unlock()
+	p.retire(dropped)
 	return true
 }
+
+// switches to the kept session once allowed (see TryAddSession), and returns the one to send DUP on.
+// called with send_mtx and session_mtx held, while there is a secondary session.
+func (p *Peer) settle() *Transmission {
+	kept, dropped := p.primary_session, p.secondary_session
+	if dropped.preferredOver(kept) {
+		kept, dropped = dropped, kept
+	}
+	if dropped.dup_sent || !(kept.outbound || dropped.dup_received) {
+		return nil
+	}
+	p.primary_session, p.secondary_session = kept, dropped
+	dropped.dup_sent = true
+	if dropped.dup_received {
+		//the peer retired it first, and closes it on reading our DUP
+		p.secondary_session = nil
+		go func() {
+			select {
+			case <-dropped.connection.Context().Done():
+			case <-time.After(duplicate_close_timeout):
+				dropped.connection.CloseWithError(0, "duplicate session")
+			}
+		}()
+		return dropped
+	}
+	p.handover = make(chan struct{})
+	p.queued = [][]byte{}
+	return dropped
+}
+
+// sends DUP, with send_mtx held but not session_mtx, so a slow peer does not stall Stats.
+func (p *Peer) retire(dropped *Transmission) {
+	if dropped == nil {
+		return
+	}
+	if err := dropped.sendAHMP(ahmp_dup_message); err != nil {
+		//it ends in ServeSessionLoop, like any failed session
+		dropped.connection.CloseWithError(0, "duplicate session")
+	}
+}
+
+// ends the handover (see TryAddSession): the queued messages go on the kept session.
+// called with send_mtx held.
+func (p *Peer) endHandover() {
+	p.session_mtx.Lock()
+	handover, queued, kept := p.handover, p.queued, p.primary_session
+	p.handover, p.queued = nil, nil
+	p.session_mtx.Unlock()
+	if handover == nil {
+		return
+	}
+	for _, message := range queued {
+		if err := kept.sendAHMP(message); err != nil {
+			break
+		}
+	}
+	close(handover)
+}
+
+// what session's messages wait for, if anything.
+func (p *Peer) handoverFor(session *Transmission) chan struct{} {
+	p.session_mtx.Lock()
+	defer p.session_mtx.Unlock()
+	if session != p.primary_session {
+		return nil
+	}
+	return p.handover
+}
+
+// the peer sends nothing more on the session.
+func (p *Peer) receiveDUP(session *Transmission) {
+	p.send_mtx.Lock()
+	defer p.send_mtx.Unlock()
+	p.session_mtx.Lock()
+	session.dup_received = true
+	if session.dup_sent {
+		//our DUP went first; both ends have read everything
+		if session == p.secondary_session {
+			p.secondary_session = nil
+		}
+		p.session_mtx.Unlock()
+		p.endHandover()
+		session.connection.CloseWithError(0, "duplicate session")
+		return
+	}
+	//without a secondary, the session the peer keeps has not reached us yet; the peer reads this one until then
+	var dropped *Transmission
+	if p.secondary_session != nil && (session == p.primary_session || session == p.secondary_session) {
+		dropped = p.settle()
+	}
+	p.session_mtx.Unlock()
+	p.retire(dropped)
+}
+
+// the AHMP stream of a session ended, or its connection failed. a duplicate is dropped; the primary ends the peer.
+// a pending duplicate does not take over, since the peer may not hold it yet,
+// unless the primary was superseded: its dialer won with another dial and keeps that one.
+func (p *Peer) sessionFailed(session *Transmission, err error) {
+	p.send_mtx.Lock()
+	p.session_mtx.Lock()
+	exit, drop := false, false
+	var app_err *quic.ApplicationError
+	superseded := errors.As(err, &app_err) && app_err.Remote && app_err.ErrorCode == CloseSuperseded
+	switch session {
+	case p.secondary_session:
+		p.secondary_session = nil
+		drop = true
+	case p.primary_session:
+		if superseded && p.secondary_session != nil && !p.secondary_session.dup_sent {
+			p.primary_session, p.secondary_session = p.secondary_session, nil
+			break
+		}
+		exit = p.is_ok.CompareAndSwap(true, false)
+		p.queued = nil //the kept session is gone with the peer
+	}
+	p.session_mtx.Unlock()
+	if drop {
+		//the peer answers no DUP on it anymore
+		p.endHandover()
+	}
+	p.send_mtx.Unlock()
+	if drop {
+		session.connection.CloseWithError(0, "duplicate session")
+	}
+	if exit {
+		p.AhmpCh <- AHMPReadRes{p, AHMPExit{err}, nil}
+	}
+}
 func (p *Peer) Close() {
-	p.primary_session.connection.CloseWithError(0, "connection close")
+	p.closeWithError(0, "connection close")
+}
+func (p *Peer) closeWithError(code quic.ApplicationErrorCode, reason string) {
+	p.session_mtx.Lock()
+	defer p.session_mtx.Unlock()
+	p.primary_session.connection.CloseWithError(code, reason)
 	if p.secondary_session != nil {
-		p.secondary_session.connection.CloseWithError(0, "connection close")
+		p.secondary_session.connection.CloseWithError(code, reason)
 	}
 }
 
+// ends our side of the AHMP streams. the peer reads everything sent before, then hangs up.
+func (p *Peer) finish() {
+	p.send_mtx.Lock()
+	defer p.send_mtx.Unlock()
+	p.endHandover()
+	p.session_mtx.Lock()
+	defer p.session_mtx.Unlock()
+	p.primary_session.ahmp_stream.Close()
+	if p.secondary_session != nil {
+		p.secondary_session.ahmp_stream.Close()
+	}
+}
+
+// continues a closed peer over a new session.
+func (p *Peer) resume(session *Transmission) {
+	p.send_mtx.Lock()
+	p.session_mtx.Lock()
+	p.primary_session = session
+	p.secondary_session = nil
+	p.handover, p.queued = nil, nil
+	p.is_ok.Store(true)
+	p.session_mtx.Unlock()
+	p.send_mtx.Unlock()
+
+	go p.ServeSessionLoop(session)
+}
+
+// a failed send is not reported here: the session's read loop ends on the same failure, or we finished the stream.
+func (p *Peer) send(parts ...[]byte) {
+	p.send_mtx.Lock()
+	defer p.send_mtx.Unlock()
+	if p.queued != nil {
+		p.queued = append(p.queued, slices.Concat(parts...))
+		return
+	}
+	p.session().sendAHMP(parts...)
+}
+
 func (p *Peer) SendJN(path string) {
-	p.primary_session.ahmp_stream.Write([]byte("AHMP/1.0 JN " + path + "\n\n"))
+	p.send([]byte("AHMP/1.0 JN " + path + "\n\n"))
 }
 func (p *Peer) SendJOK(path string, world and.INeighborDiscoveryWorldBase) {
 	body := world.GetJsonBytes()
-	p.primary_session.ahmp_stream.Write([]byte("AHMP/1.0 JOK " + path + "\n"))
-	p.primary_session.ahmp_stream.Write([]byte("Content-Length: " + strconv.Itoa(len(body)) + "\n\n"))
-	p.primary_session.ahmp_stream.Write(body)
+	p.send(
+		[]byte("AHMP/1.0 JOK "+path+"\n"),
+		[]byte("Content-Length: "+strconv.Itoa(len(body))+"\n\n"),
+		body)
 }
 func (p *Peer) SendJDN(path string, status int, message string) {
-	p.primary_session.ahmp_stream.Write([]byte("AHMP/1.0 JDN " + path + " " + strconv.Itoa(status) + " " + message + "\n\n"))
+	p.send([]byte("AHMP/1.0 JDN " + path + " " + strconv.Itoa(status) + " " + message + "\n\n"))
 }
+
+// p dials the joiner on JNI. the joiner is told to punch toward p at the same time,
+// with the address we observe for p.
 func (p *Peer) SendJNI(world and.INeighborDiscoveryWorldBase, member and.INeighborDiscoveryPeerBase) {
 	address, _ := member.GetAddress().(atype.AbyssAddress)
-	p.primary_session.ahmp_stream.Write([]byte("AHMP/1.0 JNI "))
-	p.primary_session.ahmp_stream.Write(world.GetUUIDBytes())
-	p.primary_session.ahmp_stream.Write([]byte(" " + address.Text + "\n\n"))
+	p.send([]byte("AHMP/1.0 JNI "), world.GetUUIDBytes(), []byte(" "+address.Text+"\n\n"))
+
+	if joiner, ok := member.(*Peer); ok {
+		joiner.SendPCH(world, p.session().address)
+	}
+}
+func (p *Peer) SendPCH(world and.INeighborDiscoveryWorldBase, address atype.AbyssAddress) {
+	p.send([]byte("AHMP/1.0 PCH "), world.GetUUIDBytes(), []byte(" "+address.Text+"\n\n"))
 }
 func (p *Peer) SendMEM(world and.INeighborDiscoveryWorldBase) {
-	p.primary_session.ahmp_stream.Write([]byte("AHMP/1.0 MEM "))
-	p.primary_session.ahmp_stream.Write(world.GetUUIDBytes())
-	p.primary_session.ahmp_stream.Write([]byte("\n\n"))
+	p.send([]byte("AHMP/1.0 MEM "), world.GetUUIDBytes(), []byte("\n\n"))
 }
 func (p *Peer) SendSNB(world and.INeighborDiscoveryWorldBase, members_hash []string) {
 	body := strings.Join(members_hash, ",")
-	p.primary_session.ahmp_stream.Write([]byte("AHMP/1.0 SNB "))
-	p.primary_session.ahmp_stream.Write(world.GetUUIDBytes())
-	p.primary_session.ahmp_stream.Write([]byte("\nContent-Length: " + strconv.Itoa(len(body)) + "\n\n"))
-	p.primary_session.ahmp_stream.Write([]byte(body))
+	p.send(
+		[]byte("AHMP/1.0 SNB "),
+		world.GetUUIDBytes(),
+		[]byte("\nContent-Length: "+strconv.Itoa(len(body))+"\n\n"),
+		[]byte(body))
 }
 func (p *Peer) SendCRR(world and.INeighborDiscoveryWorldBase, members_hash string) {
-	p.primary_session.ahmp_stream.Write([]byte("AHMP/1.0 CRR "))
-	p.primary_session.ahmp_stream.Write(world.GetUUIDBytes())
-	p.primary_session.ahmp_stream.Write([]byte(" " + members_hash + "\n\n"))
+	p.send([]byte("AHMP/1.0 CRR "), world.GetUUIDBytes(), []byte(" "+members_hash+"\n\n"))
 }
 func (p *Peer) SendRST(world_uuid string) {
-	p.primary_session.ahmp_stream.Write([]byte("AHMP/1.0 RST " + world_uuid + "\n\n"))
+	p.send([]byte("AHMP/1.0 RST " + world_uuid + "\n\n"))
 }
 
 func (p *Peer) GetAddress() any {
-	return p.primary_session.address
+	return p.session().address
 }
 func (p *Peer) GetHash() string {
-	return p.primary_session.identity.Hash
+	return p.session().identity.Hash
+}
+
+// hash of the peer relaying our connection to p, if it is relayed.
+func (p *Peer) GetRelay() (string, bool) {
+	session := p.session()
+	return session.relay, session.relay != ""
 }
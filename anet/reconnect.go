@@ -0,0 +1,79 @@
+package anet
+
+import (
+	"abyss/atype"
+	"context"
+	"math/rand/v2"
+	"time"
+)
+
+// redialing peers we share worlds with after their connection drops.
+// while reconnecting the peer stays a member of its worlds without PeerLeave;
+// if it comes back within GraceWindow, by our dial or its own, the same *Peer continues without PeerJoin
+// and the world sessions resynchronize with SNB/CRR. otherwise it leaves as usual.
+// zero or negative values take the default.
+type ReconnectPolicy struct {
+	InitialBackoff time.Duration //default 500ms
+	MaxBackoff     time.Duration //default 10s
+	GraceWindow    time.Duration //default 30s
+}
+
+func (p ReconnectPolicy) withDefaults() ReconnectPolicy {
+	if p.InitialBackoff <= 0 {
+		p.InitialBackoff = time.Millisecond * 500
+	}
+	if p.MaxBackoff <= 0 {
+		p.MaxBackoff = time.Second * 10
+	}
+	if p.GraceWindow <= 0 {
+		p.GraceWindow = time.Second * 30
+	}
+	return p
+}
+
+type suspendedPeer struct {
+	peer   *Peer
+	cancel context.CancelFunc //stops redialing
+}
+
+// nil disables reconnection (default). applies to connections dropping from now on.
+func (n *Networker) SetReconnectPolicy(policy *ReconnectPolicy) {
+	if policy == nil {
+		n.reconnect_policy.Store(nil)
+		return
+	}
+	with_defaults := policy.withDefaults()
+	n.reconnect_policy.Store(&with_defaults)
+}
+
+// dials with exponential backoff and jitter until connected, canceled or the grace window ends.
+func (n *Networker) reconnect(ctx context.Context, address atype.AbyssAddress, policy ReconnectPolicy, new_session_ch chan<- *Transmission, expired_ch chan<- string) {
+	grace := time.NewTimer(policy.GraceWindow)
+	defer grace.Stop()
+	backoff := policy.InitialBackoff
+	for {
+		wait := backoff/2 + rand.N(backoff/2+1)
+		select {
+		case <-time.After(wait):
+		case <-grace.C:
+			select {
+			case expired_ch <- address.Pubkey_hash:
+			case <-ctx.Done():
+			}
+			return
+		case <-ctx.Done():
+			return
+		}
+
+		session, err := n.connect(address)
+		if err == nil {
+			select {
+			case new_session_ch <- session: //if the peer came back meanwhile, this is a duplicate
+			case <-n.closed:
+				session.connection.CloseWithError(0, "connection close")
+			}
+			return
+		}
+		backoff = min(backoff*2, policy.MaxBackoff)
+	}
+}
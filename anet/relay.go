@@ -0,0 +1,374 @@
+package anet
+
+import (
+	"abyss/atype"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// every stream opened after the AHMP stream starts with a header line: <protocol> [argument]
+const stream_header_max_len = 256
+const stream_header_timeout = time.Second * 3
+
+// relaying: the dialer opens "abyss-relay <target hash>" to the relay, which answers "ok" or
+// "refused <reason>", opens "abyss-relayed <dialer hash>" to the target and pipes the two streams.
+// the dialer and the target then run TLS and the AHMP ID exchange over the pipe, so the relay
+// sees only ciphertext and cannot impersonate either side.
+const relay_protocol = "abyss-relay"
+const relayed_protocol = "abyss-relayed"
+const relay_open_timeout = time.Second * 3
+
+// relayed sessions, and handshakes toward them, a single peer may carry to us at once.
+const relayed_max_per_carrier = 8
+
+// stream reset codes.
+const (
+	StreamErrorUnknownProtocol quic.StreamErrorCode = 0x01 //no handler for the stream header's protocol
+	StreamErrorRelayBroken     quic.StreamErrorCode = 0x02
+	StreamErrorTooManyRelayed  quic.StreamErrorCode = 0x03 //the carrying peer is at relayed_max_per_carrier
+)
+
+func writeStreamHeader(stream quic.Stream, protocol string, argument string) error {
+	line := protocol
+	if argument != "" {
+		line += " " + argument
+	}
+	if len(line) >= stream_header_max_len || strings.ContainsAny(line, "\r\n") {
+		return errors.New("invalid stream header")
+	}
+	_, err := stream.Write([]byte(line + "\n"))
+	return err
+}
+
+// reads byte by byte; whatever follows the header belongs to the protocol.
+func readStreamHeader(stream quic.Stream) (string, string, error) {
+	stream.SetReadDeadline(time.Now().Add(stream_header_timeout))
+	defer stream.SetReadDeadline(time.Time{})
+
+	line := make([]byte, 0, 80)
+	var b [1]byte
+	for {
+		if _, err := io.ReadFull(stream, b[:]); err != nil {
+			return "", "", err
+		}
+		if b[0] == '\n' {
+			break
+		}
+		if len(line) == stream_header_max_len {
+			return "", "", errors.New("stream header too long")
+		}
+		line = append(line, b[0])
+	}
+	protocol, argument, _ := strings.Cut(string(line), " ")
+	return protocol, argument, nil
+}
+
+func cancelStream(stream quic.Stream, code quic.StreamErrorCode) {
+	stream.CancelRead(code)
+	stream.CancelWrite(code)
+}
+
+// a stream used as a net.Conn, to run a handshake over it. addresses are those of the carrying connection.
+type streamConn struct {
+	quic.Stream
+	local  net.Addr
+	remote net.Addr
+}
+
+func newStreamConn(stream quic.Stream, carrier quic.Connection) *streamConn {
+	return &streamConn{stream, carrier.LocalAddr(), carrier.RemoteAddr()}
+}
+
+func (c *streamConn) LocalAddr() net.Addr  { return c.local }
+func (c *streamConn) RemoteAddr() net.Addr { return c.remote }
+func (c *streamConn) Close() error {
+	c.Stream.CancelRead(0)
+	return c.Stream.Close()
+}
+
+// copies both directions until both ends finish. an error on one side breaks both.
+func relayPipe(a quic.Stream, b quic.Stream) {
+	var wg sync.WaitGroup
+	pipe := func(dst quic.Stream, src quic.Stream) {
+		defer wg.Done()
+		if _, err := io.Copy(dst, src); err != nil {
+			src.CancelRead(StreamErrorRelayBroken)
+			dst.CancelWrite(StreamErrorRelayBroken)
+			return
+		}
+		dst.Close()
+	}
+	wg.Add(2)
+	go pipe(a, b)
+	go pipe(b, a)
+	wg.Wait()
+}
+
+// relay capacity. zero MaxCircuits: we do not relay for others.
+type RelayConfig struct {
+	MaxCircuits        int
+	MaxCircuitsPerPeer int //counted on both ends of a circuit. zero: no per-peer limit
+}
+
+type relayState struct {
+	mtx      sync.Mutex
+	config   RelayConfig
+	circuits int
+	per_peer map[string]int
+
+	chosen        map[string]string //peer hash > hash of the relay to reach it through
+	default_relay string
+
+	relayed map[string]int //carrying peer hash > relayed sessions it carries to us, including handshakes
+}
+
+func newRelayState() *relayState {
+	result := new(relayState)
+	result.per_peer = make(map[string]int)
+	result.chosen = make(map[string]string)
+	result.relayed = make(map[string]int)
+	return result
+}
+
+func (r *relayState) acquireRelayed(carrier_hash string) bool {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if r.relayed[carrier_hash] >= relayed_max_per_carrier {
+		return false
+	}
+	r.relayed[carrier_hash]++
+	return true
+}
+
+func (r *relayState) releaseRelayed(carrier_hash string) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if r.relayed[carrier_hash]--; r.relayed[carrier_hash] == 0 {
+		delete(r.relayed, carrier_hash)
+	}
+}
+
+func (r *relayState) acquire(source_hash string, target_hash string) bool {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if r.circuits >= r.config.MaxCircuits {
+		return false
+	}
+	if r.config.MaxCircuitsPerPeer > 0 &&
+		(r.per_peer[source_hash] >= r.config.MaxCircuitsPerPeer || r.per_peer[target_hash] >= r.config.MaxCircuitsPerPeer) {
+		return false
+	}
+	r.circuits++
+	r.per_peer[source_hash]++
+	r.per_peer[target_hash]++
+	return true
+}
+
+func (r *relayState) release(source_hash string, target_hash string) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.circuits--
+	for _, hash := range []string{source_hash, target_hash} {
+		if r.per_peer[hash]--; r.per_peer[hash] == 0 {
+			delete(r.per_peer, hash)
+		}
+	}
+}
+
+func (r *relayState) relayFor(peer_hash string) (string, bool) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	relay_hash, ok := r.chosen[peer_hash]
+	if !ok {
+		relay_hash = r.default_relay
+	}
+	return relay_hash, relay_hash != "" && relay_hash != peer_hash
+}
+
+// serve as a relay for connected peers. circuits already running are not cut when lowering the limits.
+func (n *Networker) EnableRelay(config RelayConfig) {
+	n.relay.mtx.Lock()
+	defer n.relay.mtx.Unlock()
+	n.relay.config = config
+}
+
+// reach the peer through the relay when dialing it directly fails. empty relay_hash removes the choice.
+func (n *Networker) SetRelay(peer_hash string, relay_hash string) {
+	n.relay.mtx.Lock()
+	defer n.relay.mtx.Unlock()
+	if relay_hash == "" {
+		delete(n.relay.chosen, peer_hash)
+		return
+	}
+	n.relay.chosen[peer_hash] = relay_hash
+}
+
+// relay for peers without a relay of their own (see SetRelay). empty relay_hash disables.
+func (n *Networker) SetDefaultRelay(relay_hash string) {
+	n.relay.mtx.Lock()
+	defer n.relay.mtx.Unlock()
+	n.relay.default_relay = relay_hash
+}
+
+// direct first, then through the relay chosen for the peer.
+func (n *Networker) connect(address atype.AbyssAddress) (*Transmission, error) {
+	transmission, err := n.netcore.Connect(address)
+	if err == nil {
+		return transmission, nil
+	}
+	relay_hash, ok := n.relay.relayFor(address.Pubkey_hash)
+	if !ok {
+		return nil, err
+	}
+	transmission, relay_err := n.connectRelayed(address, relay_hash)
+	if relay_err != nil {
+		return nil, errors.Join(err, relay_err)
+	}
+	return transmission, nil
+}
+
+func (n *Networker) connectRelayed(address atype.AbyssAddress, relay_hash string) (*Transmission, error) {
+	handshaker, ok := n.netcore.(IConnHandshaker)
+	if !ok {
+		return nil, errors.New("net core cannot relay")
+	}
+	relay, err := n.GetPeerByHash(relay_hash)
+	if err != nil {
+		return nil, errors.New("relay not connected")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), relay_open_timeout)
+	defer cancel()
+	relay_session := relay.session()
+	stream, err := relay_session.connection.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	relay_session.counters.streams_opened.Add(1)
+	if err := writeStreamHeader(stream, relay_protocol, address.Pubkey_hash); err != nil {
+		cancelStream(stream, StreamErrorRelayBroken)
+		return nil, err
+	}
+	response, reason, err := readStreamHeader(stream)
+	if err != nil {
+		cancelStream(stream, StreamErrorRelayBroken)
+		return nil, err
+	}
+	if response != "ok" {
+		cancelStream(stream, StreamErrorRelayBroken)
+		return nil, errors.New("relay refused: " + reason)
+	}
+
+	transmission, err := handshaker.ConnectConn(newStreamConn(stream, relay_session.connection), address)
+	if err != nil {
+		return nil, err
+	}
+	transmission.setRelayed(relay.GetHash())
+	return transmission, nil
+}
+
+// accepts the streams a peer opens on one of its sessions, until the session closes.
+func (n *Networker) serveStreams(session *Transmission, new_session_ch chan<- *Transmission) {
+	for {
+		stream, err := session.connection.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+		session.counters.streams_accepted.Add(1)
+		go n.serveStream(session, stream, new_session_ch)
+	}
+}
+
+func (n *Networker) serveStream(session *Transmission, stream quic.Stream, new_session_ch chan<- *Transmission) {
+	protocol, argument, err := readStreamHeader(stream)
+	if err != nil {
+		cancelStream(stream, StreamErrorUnknownProtocol)
+		return
+	}
+	switch protocol {
+	case relay_protocol:
+		n.serveRelay(session, stream, argument)
+	case relayed_protocol:
+		n.acceptRelayed(session, stream, argument, new_session_ch)
+	default:
+		n.serveAppStream(session, stream, protocol)
+	}
+}
+
+func (n *Networker) serveRelay(session *Transmission, stream quic.Stream, target_hash string) {
+	source_hash := session.GetHash()
+	refuse := func(reason string) {
+		writeStreamHeader(stream, "refused", reason)
+		stream.Close()
+		stream.CancelRead(0)
+	}
+	if !n.relay.acquire(source_hash, target_hash) {
+		refuse("over capacity")
+		return
+	}
+	defer n.relay.release(source_hash, target_hash)
+
+	target, err := n.GetPeerByHash(target_hash)
+	if err != nil {
+		refuse("not connected")
+		return
+	}
+	target_session := target.session()
+	ctx, cancel := context.WithTimeout(context.Background(), relay_open_timeout)
+	target_stream, err := target_session.connection.OpenStreamSync(ctx)
+	cancel()
+	if err != nil {
+		refuse("not connected")
+		return
+	}
+	target_session.counters.streams_opened.Add(1)
+	if err := writeStreamHeader(target_stream, relayed_protocol, source_hash); err != nil {
+		cancelStream(target_stream, StreamErrorRelayBroken)
+		refuse("not connected")
+		return
+	}
+	if err := writeStreamHeader(stream, "ok", ""); err != nil {
+		cancelStream(target_stream, StreamErrorRelayBroken)
+		cancelStream(stream, StreamErrorRelayBroken)
+		return
+	}
+	relayPipe(stream, target_stream)
+}
+
+func (n *Networker) acceptRelayed(session *Transmission, stream quic.Stream, source_hash string, new_session_ch chan<- *Transmission) {
+	handshaker, ok := n.netcore.(IConnHandshaker)
+	if !ok {
+		cancelStream(stream, StreamErrorUnknownProtocol)
+		return
+	}
+	carrier_hash := session.GetHash()
+	if !n.relay.acquireRelayed(carrier_hash) {
+		cancelStream(stream, StreamErrorTooManyRelayed)
+		return
+	}
+	transmission, err := handshaker.AcceptConn(newStreamConn(stream, session.connection))
+	if err != nil {
+		n.relay.releaseRelayed(carrier_hash)
+		n.ErrRaise(err)
+		return
+	}
+	context.AfterFunc(transmission.connection.Context(), func() { n.relay.releaseRelayed(carrier_hash) })
+	if !transmission.IsKnownAs(source_hash) {
+		transmission.connection.CloseWithError(0x42, "hash mismatch")
+		n.ErrRaise(errors.New("relayed connection hash mismatch"))
+		return
+	}
+	transmission.setRelayed(carrier_hash)
+	select {
+	case new_session_ch <- transmission:
+	case <-n.closed:
+		transmission.connection.CloseWithError(0, "connection close")
+	}
+}
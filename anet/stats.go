@@ -0,0 +1,163 @@
+package anet
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/logging"
+)
+
+// counters of one session. packets and RTT come from the QUIC connection tracer;
+// a muxConnection (memory, relayed) counts its bytes itself and has no packets of its own.
+type sessionCounters struct {
+	bytes_sent       atomic.Uint64
+	bytes_received   atomic.Uint64
+	packets_sent     atomic.Uint64
+	packets_received atomic.Uint64
+	packets_lost     atomic.Uint64
+	streams_opened   atomic.Uint64
+	streams_accepted atomic.Uint64
+	ahmp_sent        atomic.Uint64
+	ahmp_received    atomic.Uint64
+
+	rtt_mtx      sync.Mutex
+	smoothed_rtt time.Duration
+	min_rtt      time.Duration
+}
+
+// tracing id > counters, from the tracer's creation until the connection closes.
+// the tracer is created before the connection, so the session finds its counters here.
+var traced_counters sync.Map
+
+func newCountingTracer(ctx context.Context, _ logging.Perspective, _ quic.ConnectionID) *logging.ConnectionTracer {
+	id := ctx.Value(quic.ConnectionTracingKey)
+	counters := new(sessionCounters)
+	traced_counters.Store(id, counters)
+	sent := func(size logging.ByteCount) {
+		counters.packets_sent.Add(1)
+		counters.bytes_sent.Add(uint64(size))
+	}
+	received := func(size logging.ByteCount) {
+		counters.packets_received.Add(1)
+		counters.bytes_received.Add(uint64(size))
+	}
+	return &logging.ConnectionTracer{
+		SentLongHeaderPacket: func(_ *logging.ExtendedHeader, size logging.ByteCount, _ logging.ECN, _ *logging.AckFrame, _ []logging.Frame) {
+			sent(size)
+		},
+		SentShortHeaderPacket: func(_ *logging.ShortHeader, size logging.ByteCount, _ logging.ECN, _ *logging.AckFrame, _ []logging.Frame) {
+			sent(size)
+		},
+		ReceivedLongHeaderPacket: func(_ *logging.ExtendedHeader, size logging.ByteCount, _ logging.ECN, _ []logging.Frame) {
+			received(size)
+		},
+		ReceivedShortHeaderPacket: func(_ *logging.ShortHeader, size logging.ByteCount, _ logging.ECN, _ []logging.Frame) {
+			received(size)
+		},
+		LostPacket: func(logging.EncryptionLevel, logging.PacketNumber, logging.PacketLossReason) {
+			counters.packets_lost.Add(1)
+		},
+		UpdatedMetrics: func(rtt_stats *logging.RTTStats, _ logging.ByteCount, _ logging.ByteCount, _ int) {
+			counters.rtt_mtx.Lock()
+			counters.smoothed_rtt = rtt_stats.SmoothedRTT()
+			counters.min_rtt = rtt_stats.MinRTT()
+			counters.rtt_mtx.Unlock()
+		},
+		Close: func() {
+			traced_counters.Delete(id)
+		},
+	}
+}
+
+func countersOf(connection quic.Connection) *sessionCounters {
+	if mux, ok := connection.(*muxConnection); ok {
+		return mux.counters
+	}
+	if counters, ok := traced_counters.Load(connection.Context().Value(quic.ConnectionTracingKey)); ok {
+		return counters.(*sessionCounters)
+	}
+	return new(sessionCounters)
+}
+
+// snapshot of one session with a peer.
+type SessionStats struct {
+	RTT    time.Duration //smoothed. zero without QUIC metrics
+	MinRTT time.Duration
+
+	BytesSent       uint64 //including QUIC or mux framing and TLS
+	BytesReceived   uint64
+	PacketsSent     uint64 //zero over a muxConnection: memory, TCP and relayed sessions
+	PacketsReceived uint64
+	PacketsLost     uint64
+
+	StreamsOpened   uint64 //besides the AHMP stream
+	StreamsAccepted uint64
+	AHMPSent        uint64 //messages, after the ID exchange
+	AHMPReceived    uint64
+
+	Relay string //hash of the relaying peer; "" if direct
+}
+
+// lost packets per packet sent. zero before any packet.
+func (s SessionStats) LossRate() float64 {
+	if s.PacketsSent == 0 {
+		return 0
+	}
+	return float64(s.PacketsLost) / float64(s.PacketsSent)
+}
+
+type PeerStats struct {
+	Hash           string
+	Primary        SessionStats
+	Secondary      SessionStats //zero unless SecondaryInUse
+	SecondaryInUse bool         //a duplicate session, from a simultaneous connect, is being switched to or drained
+}
+
+func (s *Transmission) stats() SessionStats {
+	c := s.counters
+	c.rtt_mtx.Lock()
+	smoothed_rtt, min_rtt := c.smoothed_rtt, c.min_rtt
+	c.rtt_mtx.Unlock()
+	return SessionStats{
+		RTT:             smoothed_rtt,
+		MinRTT:          min_rtt,
+		BytesSent:       c.bytes_sent.Load(),
+		BytesReceived:   c.bytes_received.Load(),
+		PacketsSent:     c.packets_sent.Load(),
+		PacketsReceived: c.packets_received.Load(),
+		PacketsLost:     c.packets_lost.Load(),
+		StreamsOpened:   c.streams_opened.Load(),
+		StreamsAccepted: c.streams_accepted.Load(),
+		AHMPSent:        c.ahmp_sent.Load(),
+		AHMPReceived:    c.ahmp_received.Load(),
+		Relay:           s.relay,
+	}
+}
+
+func (p *Peer) Stats() PeerStats {
+	p.session_mtx.Lock()
+	defer p.session_mtx.Unlock()
+	result := PeerStats{Hash: p.primary_session.identity.Hash, Primary: p.primary_session.stats()}
+	if p.secondary_session != nil && p.secondary_session.connection.Context().Err() == nil {
+		result.Secondary = p.secondary_session.stats()
+		result.SecondaryInUse = true
+	}
+	return result
+}
+
+// snapshot of every connected peer, ordered by identity hash.
+func (n *Networker) PeerStats() []PeerStats {
+	result := make([]PeerStats, 0)
+	for _, peer := range n.connectedPeers() {
+		result = append(result, peer.Stats())
+	}
+	slices.SortFunc(result, func(a PeerStats, b PeerStats) int {
+		return strings.Compare(a.Hash, b.Hash)
+	})
+	return result
+}
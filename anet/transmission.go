@@ -2,28 +2,117 @@ package anet
 
 import (
 	"abyss/atype"
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
+	"io"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
 
 	"github.com/quic-go/quic-go"
 )
 
+const ahmp_id_nonce_size = 32
+
+var id_nonce_source io.Reader = rand.Reader //replaced in tests
+const ahmp_id_exporter_label = "EXPORTER-abyss-ahmp-id"
+
 type Transmission struct {
 	connection  quic.Connection
 	ahmp_stream quic.Stream //host control message protocol
 	ahmp_parser AHMPParser
 	identity    atype.AbyssIdentity
 	address     atype.AbyssAddress
+
+	previous_hashes []string       //identities the peer rotated away from, oldest first. proven by the certificate
+	reflexive       netip.AddrPort //our address as the peer sees it (IDO)
+	advertised      atype.AbyssAddress
+	relay           string //hash of the peer relaying the connection; "" if direct
+	over_tcp        bool
+	counters        *sessionCounters
+
+	local_hash string
+	outbound   bool   //we dialed it
+	binding    []byte //TLS exporter value of the ID proof, the same at both ends
+
+	dup_sent     bool //we retired it as a duplicate. guarded by the Peer's session_mtx, as is dup_received
+	dup_received bool //the peer retired it
+}
+
+// ID and IDA; sent first on every new connection. the IDC challenge follows per connection.
+func makeAHMPInitMessage(local_identity atype.AbyssIdentity, local_address atype.AbyssAddress) []byte {
+	var sb strings.Builder
+	sb.WriteString("AHMP/1.0 ID " + local_identity.Name + "\n")
+	sb.WriteString("Content-Length: " + strconv.Itoa(len(local_identity.Publickey)) + "\n")
+	sb.WriteString("\n")
+	sb.Write(local_identity.Publickey)
+	sb.WriteString("AHMP/1.0 IDA " + local_address.Text + "\n\n")
+	return []byte(sb.String())
 }
 
-func NewTransmission(connection quic.Connection, ahmp_stream quic.Stream, ahmp_init_msg []byte) (*Transmission, error) {
+// proof-of-possession payload. binding ties the proof to this connection,
+// so a signature cannot be replayed over another connection.
+// both nonces are signed, the verifier's challenge first, so the proof one end sends
+// cannot be echoed back as the other end's proof on the same connection.
+func makeIdentityProofPayload(binding []byte, challenge_nonce []byte, signer_nonce []byte, signer_hash string) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("abyss ahmp id proof\n")
+	buf.Write(binding)
+	buf.Write(challenge_nonce)
+	buf.Write(signer_nonce)
+	buf.WriteString(signer_hash)
+	return buf.Bytes()
+}
+
+// the observed endpoint is known to work, so it goes first.
+// advertised loopback endpoints are useless to anyone but a peer on the same host.
+func mergeAdvertisedAddress(observed atype.AbyssAddress, advertised atype.AbyssAddress) atype.AbyssAddress {
+	observed_ip, err := netip.ParseAddr(observed.Host)
+	observed_loopback := err == nil && observed_ip.IsLoopback()
+	endpoints := slices.Clone(observed.Endpoints)
+	for _, endpoint := range advertised.Endpoints {
+		ip, err := netip.ParseAddr(endpoint.Host)
+		if err == nil && (ip.IsUnspecified() || (ip.IsLoopback() && !observed_loopback)) {
+			continue
+		}
+		endpoints = append(endpoints, endpoint)
+	}
+	result, ok := atype.MakeAbyssAddressMulti(observed.Pubkey_hash, endpoints, "")
+	if !ok {
+		return observed
+	}
+	return result
+}
+
+func NewTransmission(connection quic.Connection, ahmp_stream quic.Stream, ahmp_init_msg []byte, local_hash string, local_signer crypto.Signer) (*Transmission, error) {
 	result := new(Transmission)
 
 	result.connection = connection
 	result.ahmp_stream = ahmp_stream
+	result.counters = countersOf(connection)
+	result.local_hash = local_hash
 
-	ahmp_stream.Write(ahmp_init_msg)
+	//ID exchange, with challenge nonce
+	local_nonce := make([]byte, ahmp_id_nonce_size)
+	if _, err := io.ReadFull(id_nonce_source, local_nonce); err != nil {
+		return nil, err
+	}
+	if err := writeAHMP(ahmp_stream, ahmp_init_msg); err != nil {
+		return nil, err
+	}
+	if err := writeAHMP(ahmp_stream, []byte("AHMP/1.0 IDC "+hex.EncodeToString(local_nonce)+"\n\n")); err != nil {
+		return nil, err
+	}
+	//echo the observed address, so the peer learns its public mapping
+	if err := writeAHMP(ahmp_stream, []byte("AHMP/1.0 IDO "+connection.RemoteAddr().String()+"\n\n")); err != nil {
+		return nil, err
+	}
 
-	//TODO : ahmp parser
 	init_message, err := result.ahmp_parser.Read(ahmp_stream)
 	if err != nil {
 		return nil, err
@@ -38,14 +127,187 @@ func NewTransmission(connection quic.Connection, ahmp_stream quic.Stream, ahmp_i
 		return nil, err
 	}
 
-	result.address, ok = atype.MakeAbyssAddress2(result.identity.Hash, connection.RemoteAddr().String(), "")
+	//the advertised identity must be the one the TLS certificate was verified for
+	if err := waitHandshake(connection); err != nil {
+		return nil, err
+	}
+	tls_state := connection.ConnectionState().TLS
+	if len(tls_state.PeerCertificates) == 0 {
+		return nil, errors.New("no peer certificate")
+	}
+	certificate_identity, previous_hashes, err := identityFromCertificate(tls_state.PeerCertificates[0])
+	if err != nil {
+		return nil, err
+	}
+	if certificate_identity.Hash != result.identity.Hash {
+		return nil, errors.New("certificate identity mismatch")
+	}
+	result.previous_hashes = previous_hashes
+
+	address_message, err := result.ahmp_parser.Read(ahmp_stream)
+	if err != nil {
+		return nil, err
+	}
+	apd_ida, ok := address_message.(AHMPRaw_IDA)
+	if !ok {
+		return nil, errors.New("id address exchange failed")
+	}
+	advertised_address, ok := atype.ParseAbyssAddress(string(apd_ida.address))
+	if !ok || advertised_address.Pubkey_hash != result.identity.Hash {
+		return nil, errors.New("invalid advertised address")
+	}
+
+	challenge_message, err := result.ahmp_parser.Read(ahmp_stream)
+	if err != nil {
+		return nil, err
+	}
+	apd_idc, ok := challenge_message.(AHMPRaw_IDC)
+	if !ok {
+		return nil, errors.New("id challenge failed")
+	}
+	remote_nonce, err := hex.DecodeString(string(apd_idc.nonce))
+	//an echoed challenge would leave the two proofs differing only in the signer hash
+	if err != nil || len(remote_nonce) != ahmp_id_nonce_size || bytes.Equal(remote_nonce, local_nonce) {
+		return nil, errors.New("invalid id challenge")
+	}
+
+	observation_message, err := result.ahmp_parser.Read(ahmp_stream)
+	if err != nil {
+		return nil, err
+	}
+	apd_ido, ok := observation_message.(AHMPRaw_IDO)
+	if !ok {
+		return nil, errors.New("id observation failed")
+	}
+	result.reflexive, err = netip.ParseAddrPort(string(apd_ido.address))
+	if err != nil {
+		return nil, errors.New("invalid observed address")
+	}
+	result.reflexive = netip.AddrPortFrom(result.reflexive.Addr().Unmap(), result.reflexive.Port())
+
+	//proof of possession
+	binding, err := tls_state.ExportKeyingMaterial(ahmp_id_exporter_label, nil, 32)
+	if err != nil {
+		return nil, err
+	}
+	result.binding = binding
+	signature, err := atype.SignAbyssMessage(local_signer, makeIdentityProofPayload(binding, remote_nonce, local_nonce, local_hash))
+	if err != nil {
+		return nil, err
+	}
+	if err := writeAHMP(ahmp_stream, []byte("AHMP/1.0 IDS "+local_hash+"\nContent-Length: "+strconv.Itoa(len(signature))+"\n\n"), signature); err != nil {
+		return nil, err
+	}
+
+	proof_message, err := result.ahmp_parser.Read(ahmp_stream)
+	if err != nil {
+		return nil, err
+	}
+	apd_ids, ok := proof_message.(AHMPRaw_IDS)
+	if !ok {
+		return nil, errors.New("id proof failed")
+	}
+	if string(apd_ids.hash) != result.identity.Hash {
+		return nil, errors.New("id proof hash mismatch")
+	}
+	err = atype.VerifyAbyssSignature(result.identity, makeIdentityProofPayload(binding, local_nonce, remote_nonce, result.identity.Hash), apd_ids.signature)
+	if err != nil {
+		return nil, errors.New("id proof verification failed: " + err.Error())
+	}
+
+	observed_address, ok := atype.MakeAbyssAddress2(result.identity.Hash, connection.RemoteAddr().String(), "")
 	if !ok {
 		return nil, errors.New("failed to parse remote address")
 	}
+	result.advertised = advertised_address
+	result.address = mergeAdvertisedAddress(observed_address, advertised_address)
 
 	return result, nil
 }
 
+// on an early connection ID, IDA, IDC and IDO travel in 0-RTT, before the handshake authenticates the peer.
+// nothing past them is sent or trusted until it completes: the IDS proof is bound to the handshake,
+// so a replayed 0-RTT flight never gets a session, and no other AHMP message (JN and up) is ever sent early.
+func waitHandshake(connection quic.Connection) error {
+	early, ok := connection.(quic.EarlyConnection)
+	if !ok {
+		return nil
+	}
+	select {
+	case <-early.HandshakeComplete():
+		return nil
+	case <-connection.Context().Done():
+		return context.Cause(connection.Context())
+	}
+}
+
 func (s *Transmission) GetHash() string {
 	return s.identity.Hash
 }
+
+// previous identity hashes of the peer, oldest first.
+func (s *Transmission) GetPreviousHashes() []string {
+	return s.previous_hashes
+}
+
+// a relayed connection observes the relay, not the peer; only the advertised address is meaningful.
+func (s *Transmission) setRelayed(relay_hash string) {
+	s.relay = relay_hash
+	s.address = s.advertised
+}
+
+// the observed address of a TCP connection is a dialing port, or reads as a QUIC endpoint; only the advertised address is meaningful.
+func (s *Transmission) setOverTCP() {
+	s.over_tcp = true
+	s.address = s.advertised
+}
+
+// direct QUIC, direct TCP, relayed; in order of preference. both ends of a session rank it alike.
+func (s *Transmission) pathRank() int {
+	switch {
+	case s.relay != "":
+		return 2
+	case s.over_tcp:
+		return 1
+	default:
+		return 0
+	}
+}
+
+func (s *Transmission) dialerHash() string {
+	if s.outbound {
+		return s.local_hash
+	}
+	return s.identity.Hash
+}
+
+// of two sessions with the same peer, the one both hosts keep: the better path (see pathRank),
+// then the one dialed by the lower identity hash. sessions dialed by the same host are ordered by their binding.
+func (s *Transmission) preferredOver(other *Transmission) bool {
+	if s.pathRank() != other.pathRank() {
+		return s.pathRank() < other.pathRank()
+	}
+	if s.dialerHash() != other.dialerHash() {
+		return s.dialerHash() < other.dialerHash()
+	}
+	return bytes.Compare(s.binding, other.binding) < 0
+}
+
+// true if hash is the current or a previous identity hash of the peer.
+func (s *Transmission) IsKnownAs(hash string) bool {
+	return s.identity.Hash == hash || slices.Contains(s.previous_hashes, hash)
+}
+
+// one AHMP message, written at once so concurrent senders do not interleave.
+func writeAHMP(ahmp_stream quic.Stream, parts ...[]byte) error {
+	_, err := ahmp_stream.Write(slices.Concat(parts...))
+	return err
+}
+
+func (s *Transmission) sendAHMP(parts ...[]byte) error {
+	if err := writeAHMP(s.ahmp_stream, parts...); err != nil {
+		return err
+	}
+	s.counters.ahmp_sent.Add(1)
+	return nil
+}
@@ -1,65 +1,264 @@
 package atype
 
 import (
-	"bytes"
+	"net/netip"
+	"net/url"
+	"path"
+	"slices"
 	"strconv"
 	"strings"
+	"unicode/utf8"
 )
 
+// how an endpoint is dialed. QUIC endpoints are UDP; TCP endpoints carry TLS over TCP, for networks that block UDP.
+type AbyssTransport uint8
+
+const (
+	TransportQUIC AbyssTransport = iota
+	TransportTCP
+)
+
+type AbyssEndpoint struct {
+	Host      string //IPv4 dotted, IPv6 without brackets, or a DNS hostname resolved at dial time
+	Port      uint16
+	Transport AbyssTransport //zero: QUIC
+}
+
 type AbyssAddress struct {
 	Pubkey_hash string
-	IP          string
-	Port        uint16
-	Path        string //always start with '/' or empty
+	Host        string          //same as Endpoints[0]
+	Port        uint16          //same as Endpoints[0]
+	Endpoints   []AbyssEndpoint //candidate endpoints in priority order, never empty
+	Path        string          //decoded. always start with '/' or empty
+	Query       url.Values      //decoded. nil if there is no query
+	Fragment    string          //decoded
 
-	Text string
+	Text string //normalized, percent-encoded form
 }
 
-func IsValidIpv4Address(ip string) bool {
-	return true //TODO
+// IPv4 or IPv6 literal. zoned IPv6 addresses are not allowed.
+func IsValidIpAddress(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	return err == nil && addr.Zone() == ""
 }
 
-// TODO: ipv6 support
-func MakeAbyssAddress(pubkey_hash string, ip string, port uint16, path string) (AbyssAddress, bool) {
-	var address AbyssAddress
+// RFC 1123 hostname. a dotted-numeric name is never a hostname; it must be a valid IPv4 literal.
+func IsValidHostname(host string) bool {
+	host = strings.TrimSuffix(host, ".")
+	if len(host) == 0 || len(host) > 253 {
+		return false
+	}
+	all_numeric := true
+	for _, label := range strings.Split(host, ".") {
+		if len(label) == 0 || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			switch {
+			case c >= '0' && c <= '9':
+			case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c == '-':
+				all_numeric = false
+			default:
+				return false
+			}
+		}
+	}
+	return !all_numeric
+}
+
+func IsValidHost(host string) bool {
+	return IsValidIpAddress(host) || IsValidHostname(host)
+}
+
+// IPv4-mapped IPv6 addresses are reduced to IPv4 and hostnames are lowercased,
+// so the same host always has the same text.
+func normalizeHost(host string) string {
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return strings.ToLower(strings.TrimSuffix(host, "."))
+	}
+	return addr.Unmap().String()
+}
+
+// IPv6 addresses are bracketed in the text form: abyss:<hash>:[::1]:1605/path
+// TCP endpoints are prefixed: abyss:<hash>:tcp:203.0.113.5:443
+func writeHostPort(sb *strings.Builder, host string, port uint16, transport AbyssTransport) {
+	if transport == TransportTCP {
+		sb.WriteString("tcp:")
+	}
+	if strings.Contains(host, ":") {
+		sb.WriteString("[")
+		sb.WriteString(host)
+		sb.WriteString("]")
+	} else {
+		sb.WriteString(host)
+	}
+	sb.WriteString(":")
+	sb.WriteString(strconv.Itoa(int(port)))
+}
+
+// abyss:<hash>:<endpoint>[,<endpoint>...][<path>][?<query>][#<fragment>]
+//
+// multiple endpoints are comma separated: abyss:<hash>:192.168.0.2:1605,203.0.113.5:1605/path
+// path segments and the fragment are percent-encoded, the query is form-encoded with sorted keys.
+func writeAbyssAddressText(pubkey_hash string, endpoints []AbyssEndpoint, path string, query url.Values, fragment string) string {
+	var sb strings.Builder
+	sb.WriteString("abyss:")
+	sb.WriteString(pubkey_hash)
+	sb.WriteString(":")
+	for i, endpoint := range endpoints {
+		if i != 0 {
+			sb.WriteString(",")
+		}
+		writeHostPort(&sb, endpoint.Host, endpoint.Port, endpoint.Transport)
+	}
+	for i, segment := range strings.Split(path, "/") {
+		if i != 0 {
+			sb.WriteString("/")
+		}
+		sb.WriteString(url.PathEscape(segment))
+	}
+	if len(query) != 0 {
+		sb.WriteString("?")
+		sb.WriteString(query.Encode())
+	}
+	if fragment != "" {
+		sb.WriteString("#")
+		sb.WriteString((&url.URL{Fragment: fragment}).EscapedFragment())
+	}
+	return sb.String()
+}
+
+// removes dot segments and duplicate slashes, keeping a trailing slash.
+func normalizeAbyssPath(path_str string) string {
+	if path_str == "" {
+		return ""
+	}
+	cleaned := path.Clean(path_str)
+	if strings.HasSuffix(path_str, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned
+}
+
+func isValidPubkeyHash(pubkey_hash string) bool {
 	if len(pubkey_hash) < 32 {
-		return address, false
+		return false
 	}
-	if !IsValidIpv4Address(ip) {
+	for _, c := range pubkey_hash {
+		if !(c >= '0' && c <= '9') && !(c >= 'a' && c <= 'z') && !(c >= 'A' && c <= 'Z') {
+			return false
+		}
+	}
+	return true
+}
+
+func MakeAbyssAddress(pubkey_hash string, host string, port uint16, path string) (AbyssAddress, bool) {
+	return MakeAbyssAddressMulti(pubkey_hash, []AbyssEndpoint{{Host: host, Port: port}}, path)
+}
+
+func MakeAbyssAddressMulti(pubkey_hash string, endpoints []AbyssEndpoint, path string) (AbyssAddress, bool) {
+	return MakeAbyssAddressURL(pubkey_hash, endpoints, path, nil, "")
+}
+
+// path, query and fragment are decoded values. duplicate endpoints are removed, keeping the first.
+func MakeAbyssAddressURL(pubkey_hash string, endpoints []AbyssEndpoint, path string, query url.Values, fragment string) (AbyssAddress, bool) {
+	var address AbyssAddress
+	if !isValidPubkeyHash(pubkey_hash) {
 		return address, false
 	}
-	if port == 0 {
+	if len(endpoints) == 0 {
 		return address, false
 	}
+	address.Endpoints = make([]AbyssEndpoint, 0, len(endpoints))
+	for _, endpoint := range endpoints {
+		if !IsValidHost(endpoint.Host) {
+			return address, false
+		}
+		if endpoint.Port == 0 || endpoint.Transport > TransportTCP {
+			return address, false
+		}
+		endpoint.Host = normalizeHost(endpoint.Host)
+		if !slices.Contains(address.Endpoints, endpoint) {
+			address.Endpoints = append(address.Endpoints, endpoint)
+		}
+	}
 	if path != "" && path[0] != '/' { //path can be empty
 		return address, false
 	}
+	if !utf8.ValidString(path) || !utf8.ValidString(fragment) {
+		return address, false
+	}
 
 	address.Pubkey_hash = pubkey_hash
-	address.IP = ip
-	address.Port = port
-	address.Path = path
-
-	var sb strings.Builder
-	sb.WriteString("abyss:")
-	sb.WriteString(pubkey_hash)
-	sb.WriteString(":")
-	sb.WriteString(ip)
-	sb.WriteString(":")
-	sb.WriteString(strconv.Itoa(int(port)))
-	sb.WriteString(path)
-
-	address.Text = sb.String()
+	address.Host = address.Endpoints[0].Host
+	address.Port = address.Endpoints[0].Port
+	address.Path = normalizeAbyssPath(path)
+	if len(query) != 0 {
+		address.Query = make(url.Values, len(query))
+		for key, values := range query {
+			address.Query[key] = slices.Clone(values)
+		}
+	}
+	address.Fragment = fragment
+	address.Text = writeAbyssAddressText(pubkey_hash, address.Endpoints, address.Path, address.Query, fragment)
 	return address, true
 }
 
+// ip_port as in net.Addr.String(): "1.2.3.4:1605" or "[::1]:1605"
 func MakeAbyssAddress2(pubkey_hash string, ip_port string, path string) (AbyssAddress, bool) {
-	split := bytes.LastIndexByte([]byte(ip_port), ':')
-	port, err := strconv.Atoi(ip_port[split+1:])
-	if err != nil || int(uint16(port)) != port {
+	addr_port, err := netip.ParseAddrPort(ip_port)
+	if err != nil {
 		return AbyssAddress{}, false
 	}
-	return MakeAbyssAddress(pubkey_hash, ip_port[:split], uint16(port), path)
+	return MakeAbyssAddress(pubkey_hash, addr_port.Addr().String(), addr_port.Port(), path)
+}
+
+// "tcp:<host>:<port>" can not be a QUIC endpoint, since "<host>:<port>" is not a port.
+func parseAbyssEndpoint(ep_str string) (AbyssEndpoint, bool) {
+	if tcp_str, ok := strings.CutPrefix(ep_str, "tcp:"); ok {
+		if endpoint, ok := parseAbyssHostPort(tcp_str); ok {
+			endpoint.Transport = TransportTCP
+			return endpoint, true
+		}
+	}
+	return parseAbyssHostPort(ep_str)
+}
+
+func parseAbyssHostPort(ep_str string) (AbyssEndpoint, bool) {
+	var endpoint AbyssEndpoint
+	var port_str string
+
+	//host
+	if strings.HasPrefix(ep_str, "[") {
+		next_pos := strings.Index(ep_str, "]:")
+		if next_pos == -1 {
+			return endpoint, false
+		}
+		endpoint.Host = ep_str[1:next_pos]
+		if !strings.Contains(endpoint.Host, ":") { //brackets are for IPv6 only
+			return endpoint, false
+		}
+		port_str = ep_str[next_pos+2:]
+	} else {
+		next_pos := strings.Index(ep_str, ":")
+		if next_pos == -1 {
+			return endpoint, false
+		}
+		endpoint.Host = ep_str[:next_pos]
+		port_str = ep_str[next_pos+1:]
+	}
+	if !IsValidHost(endpoint.Host) {
+		return endpoint, false
+	}
+
+	//port
+	port_num, err := strconv.ParseInt(port_str, 10, 32)
+	if err != nil || port_num <= 0 || port_num > 65535 {
+		return endpoint, false
+	}
+	endpoint.Port = uint16(port_num)
+	return endpoint, true
 }
 
 func ParseAbyssAddress(addr_str string) (AbyssAddress, bool) {
@@ -74,54 +273,58 @@ func ParseAbyssAddress(addr_str string) (AbyssAddress, bool) {
 	if next_pos == -1 {
 		return address, false
 	}
-	address.Pubkey_hash = remainder[:next_pos]
-	if len(address.Pubkey_hash) < 32 {
-		return address, false
-	}
+	pubkey_hash := remainder[:next_pos]
 	remainder = remainder[next_pos+1:]
 
-	//ip
-	next_pos = strings.Index(remainder, ":")
-	if next_pos == -1 {
-		return address, false
+	//fragment
+	var fragment string
+	if next_pos = strings.Index(remainder, "#"); next_pos != -1 {
+		decoded, err := url.PathUnescape(remainder[next_pos+1:])
+		if err != nil {
+			return address, false
+		}
+		fragment = decoded
+		remainder = remainder[:next_pos]
 	}
-	address.IP = remainder[:next_pos]
-	if !IsValidIpv4Address(address.IP) {
-		return address, false
+
+	//query
+	var query url.Values
+	if next_pos = strings.Index(remainder, "?"); next_pos != -1 {
+		parsed, err := url.ParseQuery(remainder[next_pos+1:])
+		if err != nil {
+			return address, false
+		}
+		query = parsed
+		remainder = remainder[:next_pos]
 	}
-	remainder = remainder[next_pos+1:]
 
-	//port
+	//endpoints
 	next_pos = strings.Index(remainder, "/")
 	if next_pos == -1 {
 		next_pos = len(remainder)
 	}
-	port_num, err := strconv.ParseInt(remainder[:next_pos], 10, 32)
-	if err != nil || port_num <= 0 || port_num > 65535 {
-		return address, false
+	var endpoints []AbyssEndpoint
+	for _, ep_str := range strings.Split(remainder[:next_pos], ",") {
+		endpoint, ok := parseAbyssEndpoint(ep_str)
+		if !ok {
+			return address, false
+		}
+		endpoints = append(endpoints, endpoint)
 	}
-	address.Port = uint16(port_num)
-	remainder = remainder[next_pos:]
-
-	//path
-	address.Path = remainder //can be empty
-
-	address.Text = addr_str
 
-	return address, true
+	//path, unescaped per segment. an encoded '/' or dot segment would not format back to the same text
+	segments := strings.Split(remainder[next_pos:], "/")
+	for i, raw_segment := range segments {
+		segment, err := url.PathUnescape(raw_segment)
+		if err != nil || strings.Contains(segment, "/") || ((segment == "." || segment == "..") && segment != raw_segment) {
+			return address, false
+		}
+		segments[i] = segment
+	}
+	return MakeAbyssAddressURL(pubkey_hash, endpoints, strings.Join(segments, "/"), query, fragment) //path can be empty
 }
 
+// same host, another path. query and fragment are not carried over.
 func (a *AbyssAddress) MakeOtherPath(new_path string) (AbyssAddress, bool) {
-	if new_path != "" && new_path[0] != '/' {
-		return AbyssAddress{}, false
-	}
-	var sb strings.Builder
-	sb.WriteString("abyss:")
-	sb.WriteString(a.Pubkey_hash)
-	sb.WriteString(":")
-	sb.WriteString(a.IP)
-	sb.WriteString(":")
-	sb.WriteString(strconv.Itoa(int(a.Port)))
-	sb.WriteString(new_path)
-	return AbyssAddress{a.Pubkey_hash, a.IP, a.Port, a.Path, sb.String()}, true
+	return MakeAbyssAddressMulti(a.Pubkey_hash, a.Endpoints, new_path)
 }
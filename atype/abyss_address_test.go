@@ -1,7 +1,13 @@
 package atype
 
 import (
+	"math/rand"
+	"net/netip"
+	"net/url"
+	"reflect"
+	"strings"
 	"testing"
+	"testing/quick"
 )
 
 func TestAbyssAddress(t *testing.T) {
@@ -17,10 +23,294 @@ func TestAbyssAddress(t *testing.T) {
 	if !ok {
 		t.Fatal("failed to parse address")
 	}
-	if address != addr2 {
+	if !reflect.DeepEqual(address, addr2) {
 		t.Fatal("address not match")
 	}
 }
+func TestAbyssAddressIpv6(t *testing.T) {
+	address, ok := MakeAbyssAddress("fJa6v71dbjNvQfoBNMdLqtflUIZNLvd4Q3XUl67Ypi0i", "2001:db8::1", 1605, "/home")
+	if !ok {
+		t.Fatal("failed to make address")
+	}
+	if address.Text != "abyss:fJa6v71dbjNvQfoBNMdLqtflUIZNLvd4Q3XUl67Ypi0i:[2001:db8::1]:1605/home" {
+		t.Fatal("text result not match: " + address.Text)
+	}
+
+	addr2, ok := ParseAbyssAddress(address.Text)
+	if !ok {
+		t.Fatal("failed to parse address")
+	}
+	if !reflect.DeepEqual(address, addr2) {
+		t.Fatal("address not match")
+	}
+
+	addr3, ok := MakeAbyssAddress2("fJa6v71dbjNvQfoBNMdLqtflUIZNLvd4Q3XUl67Ypi0i", "[2001:db8::1]:1605", "/home")
+	if !ok {
+		t.Fatal("failed to make address from ip:port")
+	}
+	if !reflect.DeepEqual(address, addr3) {
+		t.Fatal("address not match")
+	}
+
+	//IPv4-mapped addresses from dual-stack sockets
+	addr4, ok := MakeAbyssAddress2("fJa6v71dbjNvQfoBNMdLqtflUIZNLvd4Q3XUl67Ypi0i", "[::ffff:192.168.0.1]:1605", "")
+	if !ok {
+		t.Fatal("failed to make address from ip:port")
+	}
+	if addr4.Text != "abyss:fJa6v71dbjNvQfoBNMdLqtflUIZNLvd4Q3XUl67Ypi0i:192.168.0.1:1605" {
+		t.Fatal("text result not match: " + addr4.Text)
+	}
+}
+
+func TestAbyssAddressMultiEndpoint(t *testing.T) {
+	address, ok := MakeAbyssAddressMulti("fJa6v71dbjNvQfoBNMdLqtflUIZNLvd4Q3XUl67Ypi0i", []AbyssEndpoint{
+		{Host: "192.168.0.2", Port: 1605},
+		{Host: "203.0.113.5", Port: 21605},
+		{Host: "2001:db8::1", Port: 1605},
+		{Host: "192.168.0.2", Port: 1605},
+	}, "/home")
+	if !ok {
+		t.Fatal("failed to make address")
+	}
+	if address.Text != "abyss:fJa6v71dbjNvQfoBNMdLqtflUIZNLvd4Q3XUl67Ypi0i:192.168.0.2:1605,203.0.113.5:21605,[2001:db8::1]:1605/home" {
+		t.Fatal("text result not match: " + address.Text)
+	}
+	if address.Host != "192.168.0.2" || address.Port != 1605 || len(address.Endpoints) != 3 {
+		t.Fatal("endpoints not match")
+	}
+
+	addr2, ok := ParseAbyssAddress(address.Text)
+	if !ok {
+		t.Fatal("failed to parse address")
+	}
+	if !reflect.DeepEqual(address, addr2) {
+		t.Fatal("address not match")
+	}
+
+	other, ok := address.MakeOtherPath("/lobby")
+	if !ok || !reflect.DeepEqual(other.Endpoints, address.Endpoints) {
+		t.Fatal("endpoints lost in MakeOtherPath")
+	}
+
+	for _, faulty := range []string{
+		"abyss:fJa6v71dbjNvQfoBNMdLqtflUIZNLvd4Q3XUl67Ypi0i:192.168.0.2:1605,/home",
+		"abyss:fJa6v71dbjNvQfoBNMdLqtflUIZNLvd4Q3XUl67Ypi0i:,192.168.0.2:1605/home",
+		"abyss:fJa6v71dbjNvQfoBNMdLqtflUIZNLvd4Q3XUl67Ypi0i:192.168.0.2:1605,203.0.113.5/home",
+	} {
+		if _, ok := ParseAbyssAddress(faulty); ok {
+			t.Fatal("failed to detect faulty address: " + faulty)
+		}
+	}
+}
+
+func TestAbyssAddressTransport(t *testing.T) {
+	address, ok := ParseAbyssAddress("abyss:fJa6v71dbjNvQfoBNMdLqtflUIZNLvd4Q3XUl67Ypi0i:192.168.0.2:1605,tcp:192.168.0.2:1605,tcp:[2001:db8::1]:443,tcp:80/home")
+	if !ok {
+		t.Fatal("failed to parse address")
+	}
+	expected := []AbyssEndpoint{
+		{Host: "192.168.0.2", Port: 1605},
+		{Host: "192.168.0.2", Port: 1605, Transport: TransportTCP},
+		{Host: "2001:db8::1", Port: 443, Transport: TransportTCP},
+		{Host: "tcp", Port: 80}, //a host named tcp
+	}
+	if !reflect.DeepEqual(address.Endpoints, expected) {
+		t.Fatal("endpoints not match")
+	}
+	if address.Text != "abyss:fJa6v71dbjNvQfoBNMdLqtflUIZNLvd4Q3XUl67Ypi0i:192.168.0.2:1605,tcp:192.168.0.2:1605,tcp:[2001:db8::1]:443,tcp:80/home" {
+		t.Fatal("text result not match: " + address.Text)
+	}
+	if _, ok := ParseAbyssAddress("abyss:fJa6v71dbjNvQfoBNMdLqtflUIZNLvd4Q3XUl67Ypi0i:tcp:192.168.0.2/home"); ok {
+		t.Fatal("failed to detect tcp endpoint without port")
+	}
+}
+
+func TestAbyssAddressHostname(t *testing.T) {
+	address, ok := ParseAbyssAddress("abyss:fJa6v71dbjNvQfoBNMdLqtflUIZNLvd4Q3XUl67Ypi0i:World.Example.org:1605,192.168.0.2:1605/lobby")
+	if !ok {
+		t.Fatal("failed to parse address")
+	}
+	if address.Host != "world.example.org" || address.Port != 1605 || address.Path != "/lobby" {
+		t.Fatal("address not match")
+	}
+	if address.Text != "abyss:fJa6v71dbjNvQfoBNMdLqtflUIZNLvd4Q3XUl67Ypi0i:world.example.org:1605,192.168.0.2:1605/lobby" {
+		t.Fatal("text result not match: " + address.Text)
+	}
+
+	for _, faulty := range []string{"-world.example.org", "world..example.org", "world_example.org", "192.168.0", ""} {
+		if _, ok := MakeAbyssAddress("fJa6v71dbjNvQfoBNMdLqtflUIZNLvd4Q3XUl67Ypi0i", faulty, 1605, "/lobby"); ok {
+			t.Fatal("failed to detect faulty host: " + faulty)
+		}
+	}
+}
+
+func TestAbyssAddressURL(t *testing.T) {
+	address, ok := ParseAbyssAddress("abyss:fJa6v71dbjNvQfoBNMdLqtflUIZNLvd4Q3XUl67Ypi0i:192.168.0.1:1605/worlds/./my%20world/../lobby?spawn=north+gate&invite=a%26b#seat%203")
+	if !ok {
+		t.Fatal("failed to parse address")
+	}
+	if address.Path != "/worlds/lobby" {
+		t.Fatal("path not match: " + address.Path)
+	}
+	if address.Query.Get("spawn") != "north gate" || address.Query.Get("invite") != "a&b" {
+		t.Fatal("query not match")
+	}
+	if address.Fragment != "seat 3" {
+		t.Fatal("fragment not match: " + address.Fragment)
+	}
+	if address.Text != "abyss:fJa6v71dbjNvQfoBNMdLqtflUIZNLvd4Q3XUl67Ypi0i:192.168.0.1:1605/worlds/lobby?invite=a%26b&spawn=north+gate#seat%203" {
+		t.Fatal("text result not match: " + address.Text)
+	}
+
+	other, ok := address.MakeOtherPath("/my room")
+	if !ok {
+		t.Fatal("failed to make other path")
+	}
+	if other.Path != "/my room" || other.Query != nil || other.Fragment != "" {
+		t.Fatal("other path not match")
+	}
+	if other.Text != "abyss:fJa6v71dbjNvQfoBNMdLqtflUIZNLvd4Q3XUl67Ypi0i:192.168.0.1:1605/my%20room" {
+		t.Fatal("text result not match: " + other.Text)
+	}
+}
+
+type randomAbyssAddressInput struct {
+	Hash      string
+	Endpoints []AbyssEndpoint
+	Path      string
+	Query     url.Values
+	Fragment  string
+}
+
+func randomString(r *rand.Rand, alphabet []rune, max_len int) string {
+	n := r.Intn(max_len + 1)
+	result := make([]rune, n)
+	for i := range result {
+		result[i] = alphabet[r.Intn(len(alphabet))]
+	}
+	return string(result)
+}
+
+func (randomAbyssAddressInput) Generate(r *rand.Rand, size int) reflect.Value {
+	alnum := []rune("0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
+	tricky := []rune("abcXYZ019 -._~!$&'()*+,;=:@/?#[]%\"<>^`{|}\u00e9\u4e16\U0001F600\t")
+
+	var input randomAbyssAddressInput
+	for hash_len := 32 + r.Intn(16); len(input.Hash) < hash_len; {
+		input.Hash += string(alnum[r.Intn(len(alnum))])
+	}
+
+	for i := 0; i < 1+r.Intn(4); i++ {
+		var endpoint AbyssEndpoint
+		switch r.Intn(3) {
+		case 0:
+			endpoint.Host = netip.AddrFrom4([4]byte{byte(r.Intn(256)), byte(r.Intn(256)), byte(r.Intn(256)), byte(r.Intn(256))}).String()
+		case 1:
+			var ip [16]byte
+			r.Read(ip[:])
+			endpoint.Host = netip.AddrFrom16(ip).Unmap().String()
+		case 2:
+			endpoint.Host = "h" + randomString(r, []rune("abcdefghijklmnopqrstuvwxyz0123456789"), 10) + ".example.org"
+		}
+		endpoint.Port = uint16(1 + r.Intn(65535))
+		endpoint.Transport = AbyssTransport(r.Intn(2))
+		input.Endpoints = append(input.Endpoints, endpoint)
+	}
+
+	if r.Intn(4) != 0 {
+		input.Path = "/" + randomString(r, tricky, size)
+	}
+	if r.Intn(2) == 0 {
+		input.Query = make(url.Values)
+		for i := 0; i < 1+r.Intn(3); i++ {
+			key := randomString(r, tricky, 8)
+			for j := 0; j < 1+r.Intn(2); j++ {
+				input.Query.Add(key, randomString(r, tricky, 8))
+			}
+		}
+	}
+	input.Fragment = randomString(r, tricky, 8)
+	return reflect.ValueOf(input)
+}
+
+// formatting then parsing gives back the same address, and the text form is a fixed point.
+func TestAbyssAddressRoundTripProperty(t *testing.T) {
+	property := func(input randomAbyssAddressInput) bool {
+		address, ok := MakeAbyssAddressURL(input.Hash, input.Endpoints, input.Path, input.Query, input.Fragment)
+		if !ok {
+			t.Log("failed to make address")
+			return false
+		}
+		parsed, ok := ParseAbyssAddress(address.Text)
+		if !ok {
+			t.Log("failed to parse " + address.Text)
+			return false
+		}
+		if !reflect.DeepEqual(address, parsed) {
+			t.Log("round trip mismatch: " + address.Text + " / " + parsed.Text)
+			return false
+		}
+		reparsed, ok := ParseAbyssAddress(parsed.Text)
+		return ok && reparsed.Text == address.Text
+	}
+	if err := quick.Check(property, &quick.Config{MaxCount: 2000}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// address text with edits a peer might send: encoded slashes and dots, dot segments, empty segments.
+type randomAbyssAddressText string
+
+func (randomAbyssAddressText) Generate(r *rand.Rand, size int) reflect.Value {
+	input := randomAbyssAddressInput{}.Generate(r, size).Interface().(randomAbyssAddressInput)
+	address, _ := MakeAbyssAddressURL(input.Hash, input.Endpoints, input.Path, input.Query, input.Fragment)
+	text := address.Text
+	path_start := strings.Index(text[6+len(input.Hash)+1:], "/")
+	if path_start == -1 {
+		return reflect.ValueOf(randomAbyssAddressText(text))
+	}
+	path_start += 6 + len(input.Hash) + 1
+	edits := []string{"/", "%2F", "%2f", ".", "%2E", "%2e", "/./", "/../", "/%2E%2E/", "/.%2E/", "//", "%25", "%252F"}
+	for i := 0; i < 1+r.Intn(3); i++ {
+		pos := path_start + 1 + r.Intn(len(text)-path_start)
+		if end := strings.IndexAny(text[path_start:], "?#"); end != -1 && pos > path_start+end {
+			pos = path_start + end
+		}
+		text = text[:pos] + edits[r.Intn(len(edits))] + text[pos:]
+	}
+	return reflect.ValueOf(randomAbyssAddressText(text))
+}
+
+// whatever text parses, its formatted text parses back to the same address.
+func TestAbyssAddressParseRoundTripProperty(t *testing.T) {
+	property := func(text randomAbyssAddressText) bool {
+		parsed, ok := ParseAbyssAddress(string(text))
+		if !ok {
+			return true
+		}
+		reparsed, ok := ParseAbyssAddress(parsed.Text)
+		if !ok || !reflect.DeepEqual(parsed, reparsed) {
+			t.Log("round trip mismatch: " + string(text) + " / " + parsed.Text + " / " + reparsed.Text)
+			return false
+		}
+		return true
+	}
+	if err := quick.Check(property, &quick.Config{MaxCount: 2000}); err != nil {
+		t.Fatal(err)
+	}
+
+	//encoded separators are not path structure
+	for _, text := range []string{
+		"abyss:fJa6v71dbjNvQfoBNMdLqtflUIZNLvd4Q3XUl67Ypi0i:192.168.0.1:1605/a%2Fb",
+		"abyss:fJa6v71dbjNvQfoBNMdLqtflUIZNLvd4Q3XUl67Ypi0i:192.168.0.1:1605/a/%2E%2E/b",
+		"abyss:fJa6v71dbjNvQfoBNMdLqtflUIZNLvd4Q3XUl67Ypi0i:192.168.0.1:1605/a/%2e",
+	} {
+		if _, ok := ParseAbyssAddress(text); ok {
+			t.Fatal("encoded separator accepted: " + text)
+		}
+	}
+}
+
 func TestAbyssAddress_err1(t *testing.T) { //too short public key hash (less than 32 bytes)
 	_, ok := MakeAbyssAddress("1234567890123456789012345678901", "192.168.0.1", 1605, "/home")
 	if ok {
@@ -33,16 +323,28 @@ func TestAbyssAddress_err1(t *testing.T) { //too short public key hash (less tha
 	}
 }
 
-// func TestAbyssAddress_err2(t *testing.T) { //invalid ipv4 address
-// 	_, ok := MakeAbyssAddress("fJa6v71dbjNvQfoBNMdLqtflUIZNLvd4Q3XUl67Ypi0i", "192.168", 1605, "/home")
-// 	if ok {
-// 		t.Fatal("failed to detect faulty address")
-// 	}
-// 	_, ok = ParseAbyssAddress("abyss:fJa6v71dbjNvQfoBNMdLqtflUIZNLvd4Q3XUl67Ypi0i:192.168:1605/home")
-// 	if ok {
-// 		t.Fatal("failed to detect faulty address")
-// 	}
-// }
+func TestAbyssAddress_err2(t *testing.T) { //invalid ip address
+	_, ok := MakeAbyssAddress("fJa6v71dbjNvQfoBNMdLqtflUIZNLvd4Q3XUl67Ypi0i", "192.168", 1605, "/home")
+	if ok {
+		t.Fatal("failed to detect faulty address")
+	}
+	_, ok = ParseAbyssAddress("abyss:fJa6v71dbjNvQfoBNMdLqtflUIZNLvd4Q3XUl67Ypi0i:192.168:1605/home")
+	if ok {
+		t.Fatal("failed to detect faulty address")
+	}
+	_, ok = ParseAbyssAddress("abyss:fJa6v71dbjNvQfoBNMdLqtflUIZNLvd4Q3XUl67Ypi0i:[192.168.0.1]:1605/home")
+	if ok {
+		t.Fatal("failed to detect faulty address")
+	}
+	_, ok = ParseAbyssAddress("abyss:fJa6v71dbjNvQfoBNMdLqtflUIZNLvd4Q3XUl67Ypi0i:[::1:1605/home")
+	if ok {
+		t.Fatal("failed to detect faulty address")
+	}
+	_, ok = MakeAbyssAddress("fJa6v71dbjNvQfoBNMdLqtflUIZNLvd4Q3XUl67Ypi0i", "fe80::1%eth0", 1605, "/home")
+	if ok {
+		t.Fatal("failed to detect faulty address")
+	}
+}
 
 func TestAbyssAddress_err3(t *testing.T) { //invalid port number
 	_, ok := MakeAbyssAddress("fJa6v71dbjNvQfoBNMdLqtflUIZNLvd4Q3XUl67Ypi0i", "192.168.0.1", 0, "/home")
@@ -80,8 +382,23 @@ func TestAbyssAddress_err4(t *testing.T) { //invalid path
 	if ok {
 		t.Fatal("failed to detect faulty address")
 	}
-	_, ok = ParseAbyssAddress("abyss:fJa6v71dbjNvQfoBNMdLqtflUIZNLvd4Q3XUl67Ypi0i:192.168.0.1:1605")
+	_, ok = ParseAbyssAddress("abyss:fJa6v71dbjNvQfoBNMdLqtflUIZNLvd4Q3XUl67Ypi0i:192.168.0.1:1605/home%zz")
 	if ok {
 		t.Fatal("failed to detect faulty address")
 	}
+	_, ok = ParseAbyssAddress("abyss:fJa6v71dbjNvQfoBNMdLqtflUIZNLvd4Q3XUl67Ypi0i:192.168.0.1:1605/home?a=1;b=2")
+	if ok {
+		t.Fatal("failed to detect faulty address")
+	}
+}
+
+// an address without a path is valid: it is the form LocalAddr() produces and IDA carries.
+func TestAbyssAddressEmptyPath(t *testing.T) {
+	address, ok := ParseAbyssAddress("abyss:fJa6v71dbjNvQfoBNMdLqtflUIZNLvd4Q3XUl67Ypi0i:192.168.0.1:1605")
+	if !ok {
+		t.Fatal("failed to parse address without path")
+	}
+	if address.Path != "" || address.Text != "abyss:fJa6v71dbjNvQfoBNMdLqtflUIZNLvd4Q3XUl67Ypi0i:192.168.0.1:1605" {
+		t.Fatal("address without path not kept as is: " + address.Text)
+	}
 }
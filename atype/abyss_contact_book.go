@@ -0,0 +1,223 @@
+package atype
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+)
+
+type AbyssTrustLevel int
+
+const (
+	TrustUnknown AbyssTrustLevel = iota
+	TrustBlocked AbyssTrustLevel = iota
+	TrustKnown   AbyssTrustLevel = iota
+	TrustFull    AbyssTrustLevel = iota
+)
+
+// what we know about an identity. Petname is our own name for it; the name the peer claims is never stored here.
+type AbyssContact struct {
+	Hash     string
+	Petname  string
+	Address  AbyssAddress //last known address. Address.Text == "" if unknown
+	Notes    string
+	Trust    AbyssTrustLevel
+	Previous []string //identity hashes the contact rotated away from, oldest first
+}
+
+type abyssContactJson struct {
+	Hash     string
+	Petname  string
+	Address  string `json:",omitempty"`
+	Notes    string `json:",omitempty"`
+	Trust    AbyssTrustLevel
+	Previous []string `json:",omitempty"`
+}
+
+// local address book. safe for concurrent use.
+type AbyssContactBook struct {
+	mtx      sync.Mutex
+	contacts map[string]AbyssContact //identity hash > contact
+}
+
+func NewAbyssContactBook() *AbyssContactBook {
+	result := new(AbyssContactBook)
+	result.contacts = make(map[string]AbyssContact)
+	return result
+}
+
+// adds or replaces the contact. petnames are unique within the book.
+func (b *AbyssContactBook) Set(contact AbyssContact) error {
+	if !isValidPubkeyHash(contact.Hash) {
+		return errors.New("invalid identity hash")
+	}
+	if strings.ContainsAny(contact.Petname, "\r\n") {
+		return errors.New("petname contains line break")
+	}
+	if contact.Address.Text != "" && contact.Address.Pubkey_hash != contact.Hash {
+		return errors.New("address of another identity")
+	}
+
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	if contact.Petname != "" {
+		for hash, other := range b.contacts {
+			if hash != contact.Hash && other.Petname == contact.Petname {
+				return errors.New("petname already in use: " + contact.Petname)
+			}
+		}
+	}
+	b.contacts[contact.Hash] = contact
+	return nil
+}
+
+func (b *AbyssContactBook) Get(hash string) (AbyssContact, bool) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	result, ok := b.contacts[hash]
+	return result, ok
+}
+
+func (b *AbyssContactBook) GetByPetname(petname string) (AbyssContact, bool) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	for _, contact := range b.contacts {
+		if contact.Petname == petname {
+			return contact, true
+		}
+	}
+	return AbyssContact{}, false
+}
+
+func (b *AbyssContactBook) Remove(hash string) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	delete(b.contacts, hash)
+}
+
+// all contacts, ordered by petname then hash.
+func (b *AbyssContactBook) List() []AbyssContact {
+	b.mtx.Lock()
+	result := make([]AbyssContact, 0, len(b.contacts))
+	for _, contact := range b.contacts {
+		result = append(result, contact)
+	}
+	b.mtx.Unlock()
+
+	slices.SortFunc(result, func(a AbyssContact, b AbyssContact) int {
+		if c := strings.Compare(a.Petname, b.Petname); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Hash, b.Hash)
+	})
+	return result
+}
+
+// records the last known address, only for existing contacts.
+func (b *AbyssContactBook) UpdateAddress(address AbyssAddress) bool {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	contact, ok := b.contacts[address.Pubkey_hash]
+	if !ok {
+		return false
+	}
+	contact.Address = address
+	b.contacts[address.Pubkey_hash] = contact
+	return true
+}
+
+// moves the contact of old_hash to new_hash, after a verified rotation (see VerifyAbyssRotationChain).
+// the last known endpoints are kept.
+func (b *AbyssContactBook) Rotate(old_hash string, new_hash string) bool {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	contact, ok := b.contacts[old_hash]
+	if !ok {
+		return false
+	}
+	if _, ok := b.contacts[new_hash]; ok {
+		return false //already known under the new hash; keep that one.
+	}
+	delete(b.contacts, old_hash)
+	contact.Hash = new_hash
+	if contact.Address.Text != "" {
+		contact.Address, _ = MakeAbyssAddressURL(new_hash, contact.Address.Endpoints, contact.Address.Path, contact.Address.Query, contact.Address.Fragment)
+	}
+	contact.Previous = append(slices.Clone(contact.Previous), old_hash)
+	b.contacts[new_hash] = contact
+	return true
+}
+
+// our petname for the hash if we have one, otherwise the name the peer claims.
+func (b *AbyssContactBook) DisplayName(hash string, claimed_name string) string {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	contact, ok := b.contacts[hash]
+	if ok && contact.Petname != "" {
+		return contact.Petname
+	}
+	return claimed_name
+}
+
+func (b *AbyssContactBook) Save(path string) error {
+	contacts := b.List()
+	parsed := make([]abyssContactJson, len(contacts))
+	for i, contact := range contacts {
+		parsed[i] = abyssContactJson{
+			Hash:     contact.Hash,
+			Petname:  contact.Petname,
+			Address:  contact.Address.Text,
+			Notes:    contact.Notes,
+			Trust:    contact.Trust,
+			Previous: contact.Previous,
+		}
+	}
+	data, err := json.MarshalIndent(parsed, "", "\t")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0600)
+}
+
+// replaces the book contents with the file. a missing file is an empty book.
+func (b *AbyssContactBook) Load(path string) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		data = []byte("[]")
+	} else if err != nil {
+		return err
+	}
+	var parsed []abyssContactJson
+	if err := json.Unmarshal(data, &parsed); err != nil {
+		return err
+	}
+
+	loaded := NewAbyssContactBook()
+	for _, entry := range parsed {
+		contact := AbyssContact{
+			Hash:     entry.Hash,
+			Petname:  entry.Petname,
+			Notes:    entry.Notes,
+			Trust:    entry.Trust,
+			Previous: entry.Previous,
+		}
+		if entry.Address != "" {
+			address, ok := ParseAbyssAddress(entry.Address)
+			if !ok {
+				return errors.New("invalid contact address: " + entry.Address)
+			}
+			contact.Address = address
+		}
+		if err := loaded.Set(contact); err != nil {
+			return err
+		}
+	}
+
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.contacts = loaded.contacts
+	return nil
+}
@@ -0,0 +1,83 @@
+package atype
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestAbyssContactBook(t *testing.T) {
+	id1, err := GenerateAbyssPrivateIdentity("claimed1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	id2, err := GenerateAbyssPrivateIdentity("claimed2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address1, ok := MakeAbyssAddress(id1.Identity.Hash, "127.0.0.1", 1605, "/home")
+	if !ok {
+		t.Fatal("failed to make address")
+	}
+
+	book := NewAbyssContactBook()
+	if err := book.Set(AbyssContact{Hash: id1.Identity.Hash, Petname: "alice", Trust: TrustFull}); err != nil {
+		t.Fatal(err)
+	}
+	if err := book.Set(AbyssContact{Hash: id2.Identity.Hash, Petname: "alice"}); err == nil {
+		t.Fatal("duplicate petname accepted")
+	}
+	if err := book.Set(AbyssContact{Hash: id2.Identity.Hash, Petname: "bob", Address: address1}); err == nil {
+		t.Fatal("address of another identity accepted")
+	}
+	if err := book.Set(AbyssContact{Hash: id2.Identity.Hash, Petname: "bob", Notes: "met at\tworkshop"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if book.DisplayName(id1.Identity.Hash, "claimed1") != "alice" {
+		t.Fatal("petname not preferred")
+	}
+	if book.DisplayName("unknown", "claimed3") != "claimed3" {
+		t.Fatal("claimed name not used for unknown hash")
+	}
+	if !book.UpdateAddress(address1) {
+		t.Fatal("address not updated")
+	}
+	if contact, ok := book.GetByPetname("bob"); !ok || contact.Hash != id2.Identity.Hash {
+		t.Fatal("petname lookup failed")
+	}
+
+	//persistence
+	path := filepath.Join(t.TempDir(), "contacts.json")
+	if err := book.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	loaded := NewAbyssContactBook()
+	if err := loaded.Load(path); err != nil {
+		t.Fatal(err)
+	}
+	contacts := loaded.List()
+	if len(contacts) != 2 || contacts[0].Petname != "alice" || contacts[1].Petname != "bob" {
+		t.Fatal("contacts not loaded in order")
+	}
+	if contacts[0].Address.Text != address1.Text || contacts[0].Trust != TrustFull || contacts[1].Notes != "met at\tworkshop" {
+		t.Fatal("contact fields lost")
+	}
+	if err := NewAbyssContactBook().Load(filepath.Join(t.TempDir(), "missing.json")); err != nil {
+		t.Fatal("missing file is not an empty book")
+	}
+
+	//rotation keeps the petname and endpoints
+	if !loaded.Rotate(id1.Identity.Hash, "rotated"+id2.Identity.Hash) {
+		t.Fatal("rotation not applied")
+	}
+	rotated, ok := loaded.GetByPetname("alice")
+	if !ok || rotated.Hash != "rotated"+id2.Identity.Hash || rotated.Previous[0] != id1.Identity.Hash {
+		t.Fatal("rotated contact mismatch")
+	}
+	if rotated.Address.Pubkey_hash != rotated.Hash || rotated.Address.Endpoints[0] != address1.Endpoints[0] {
+		t.Fatal("rotated address mismatch")
+	}
+	if _, ok := loaded.Get(id1.Identity.Hash); ok {
+		t.Fatal("old hash still present")
+	}
+}
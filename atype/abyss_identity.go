@@ -1,55 +1,149 @@
 package atype
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/x509"
 	"encoding/pem"
 	"errors"
 
 	"github.com/btcsuite/btcutil/base58"
 	"golang.org/x/crypto/sha3"
+	"golang.org/x/crypto/ssh"
 )
 
 // utf-8
+//
+// Hash is the same for every accepted encoding of a key, with one exception:
+// an RSA key in a legacy "OPENSSH PUBLIC KEY" block keeps the hash of the block's raw PKIX DER,
+// so identities created before other formats were accepted keep their hash.
+// the same RSA key in any other format hashes its PKCS#1 DER and gets a different Hash.
 type AbyssIdentity struct {
-	Publickey []byte //pem file content
+	Publickey []byte //pem file content, or an OpenSSH authorized_keys line
 	Name      string
 
 	Parsed_publickey any
 	Hash             string //never directly write this
 }
 
+// accepted public key formats:
+//
+//	"RSA PUBLIC KEY" PEM (PKCS#1)
+//	"PUBLIC KEY" PEM (PKIX) - ed25519, ECDSA P-256, RSA
+//	"OPENSSH PUBLIC KEY" PEM holding PKIX DER (legacy)
+//	OpenSSH authorized_keys line - ssh-ed25519, ecdsa-sha2-nistp256, ssh-rsa
+//
+// the hash does not depend on the format (see abyssHashInput), except for RSA keys in the legacy block; see AbyssIdentity.
 func MakeAbyssIdentity(publickey []byte, name string) (AbyssIdentity, error) {
 	var identity AbyssIdentity
 	identity.Publickey = publickey
 	identity.Name = name
 
+	parsed_publickey, err := parseAbyssPublicKey(publickey)
+	if err != nil {
+		return identity, err
+	}
+	hash_input, err := abyssHashInput(parsed_publickey)
+	if err != nil {
+		return identity, err
+	}
+	if block_p, _ := pem.Decode(publickey); block_p != nil && block_p.Type == "OPENSSH PUBLIC KEY" {
+		hash_input = block_p.Bytes
+	}
+	identity.Parsed_publickey = parsed_publickey
+
+	hashfunc := sha3.New256()
+	hashfunc.Write(hash_input)
+	hashfunc.Write([]byte(name))
+	hash := hashfunc.Sum(nil)
+
+	identity.Hash = base58.Encode(hash)
+	return identity, nil
+}
+
+func parseAbyssPublicKey(publickey []byte) (any, error) {
 	block_p, _ := pem.Decode(publickey)
 	if block_p == nil {
-		return identity, errors.New("invalid public key")
+		ssh_publickey, _, _, _, err := ssh.ParseAuthorizedKey(publickey)
+		if err != nil {
+			return nil, errors.New("invalid public key")
+		}
+		crypto_publickey, ok := ssh_publickey.(ssh.CryptoPublicKey)
+		if !ok {
+			return nil, errors.New("unsupported public key")
+		}
+		return crypto_publickey.CryptoPublicKey(), nil
 	}
 
 	switch block_p.Type {
 	case "RSA PUBLIC KEY":
-		parsed_publickey, err := x509.ParsePKCS1PublicKey(block_p.Bytes)
-		if err != nil {
-			return identity, err
-		}
-		identity.Parsed_publickey = parsed_publickey
-	case "OPENSSH PUBLIC KEY":
-		parsed_publickey, err := x509.ParsePKIXPublicKey(block_p.Bytes)
-		if err != nil {
-			return identity, err
+		return x509.ParsePKCS1PublicKey(block_p.Bytes)
+	case "PUBLIC KEY", "OPENSSH PUBLIC KEY":
+		return x509.ParsePKIXPublicKey(block_p.Bytes)
+	default:
+		return nil, errors.New("unsupported public key")
+	}
+}
+
+// the stable hash input of a public key, regardless of the encoding it arrived in.
+//
+//	RSA: PKCS#1 DER
+//	ed25519, ECDSA P-256: PKIX DER
+func abyssHashInput(publickey any) ([]byte, error) {
+	switch key := publickey.(type) {
+	case *rsa.PublicKey:
+		return x509.MarshalPKCS1PublicKey(key), nil
+	case ed25519.PublicKey:
+		return x509.MarshalPKIXPublicKey(key)
+	case *ecdsa.PublicKey:
+		if key.Curve != elliptic.P256() {
+			return nil, errors.New("unsupported ecdsa curve")
 		}
-		identity.Parsed_publickey = parsed_publickey
+		return x509.MarshalPKIXPublicKey(key)
 	default:
-		return identity, errors.New("unsupported public key")
+		return nil, errors.New("unsupported public key")
 	}
+}
 
-	hashfunc := sha3.New256()
-	hashfunc.Write(block_p.Bytes)
-	hashfunc.Write([]byte(name))
-	hash := hashfunc.Sum(nil)
+// signs message with the private key matching an AbyssIdentity.
+// rsa keys use PSS over SHA-256, ecdsa keys sign the SHA-256 digest (ASN.1), ed25519 keys sign the message directly.
+func SignAbyssMessage(private_key crypto.Signer, message []byte) ([]byte, error) {
+	switch private_key.Public().(type) {
+	case *rsa.PublicKey:
+		digest := sha256.Sum256(message)
+		return private_key.Sign(rand.Reader, digest[:], &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA256})
+	case *ecdsa.PublicKey:
+		digest := sha256.Sum256(message)
+		return private_key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	case ed25519.PublicKey:
+		return private_key.Sign(rand.Reader, message, crypto.Hash(0))
+	default:
+		return nil, errors.New("unsupported private key")
+	}
+}
 
-	identity.Hash = base58.Encode(hash)
-	return identity, nil
+func VerifyAbyssSignature(identity AbyssIdentity, message []byte, signature []byte) error {
+	switch publickey := identity.Parsed_publickey.(type) {
+	case *rsa.PublicKey:
+		digest := sha256.Sum256(message)
+		return rsa.VerifyPSS(publickey, crypto.SHA256, digest[:], signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+	case *ecdsa.PublicKey:
+		digest := sha256.Sum256(message)
+		if !ecdsa.VerifyASN1(publickey, digest[:], signature) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	case ed25519.PublicKey:
+		if !ed25519.Verify(publickey, message, signature) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	default:
+		return errors.New("unsupported public key")
+	}
 }
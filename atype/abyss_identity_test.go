@@ -1,6 +1,10 @@
 package atype
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
@@ -9,6 +13,7 @@ import (
 
 	"github.com/btcsuite/btcutil/base58"
 	"golang.org/x/crypto/sha3"
+	"golang.org/x/crypto/ssh"
 )
 
 func TestAbyssIdentity(t *testing.T) {
@@ -32,3 +37,130 @@ func TestAbyssIdentity(t *testing.T) {
 		t.Fatal("hash value mismatch")
 	}
 }
+
+func TestAbyssSignature(t *testing.T) {
+	rsa_key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal("failed to generate rsa key pair")
+	}
+	rsa_pem := pem.EncodeToMemory(&pem.Block{Type: "RSA PUBLIC KEY", Bytes: x509.MarshalPKCS1PublicKey(&rsa_key.PublicKey)})
+
+	ed_pub, ed_key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal("failed to generate ed25519 key pair")
+	}
+	ed_pkix, err := x509.MarshalPKIXPublicKey(ed_pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ed_pem := pem.EncodeToMemory(&pem.Block{Type: "OPENSSH PUBLIC KEY", Bytes: ed_pkix})
+
+	ec_key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal("failed to generate ecdsa key pair")
+	}
+	ec_pkix, err := x509.MarshalPKIXPublicKey(&ec_key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ec_pem := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: ec_pkix})
+
+	for _, c := range []struct {
+		pemfile []byte
+		signer  crypto.Signer
+	}{{rsa_pem, rsa_key}, {ed_pem, ed_key}, {ec_pem, ec_key}} {
+		identity, err := MakeAbyssIdentity(c.pemfile, "mallang")
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature, err := SignAbyssMessage(c.signer, []byte("message"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := VerifyAbyssSignature(identity, []byte("message"), signature); err != nil {
+			t.Fatal("valid signature rejected: " + err.Error())
+		}
+		if err := VerifyAbyssSignature(identity, []byte("massage"), signature); err == nil {
+			t.Fatal("invalid signature accepted")
+		}
+	}
+}
+
+func TestAbyssIdentityFormats(t *testing.T) {
+	ed_pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal("failed to generate ed25519 key pair")
+	}
+	rsa_key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal("failed to generate rsa key pair")
+	}
+	ec_key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal("failed to generate ecdsa key pair")
+	}
+
+	for _, publickey := range []crypto.PublicKey{ed_pub, &rsa_key.PublicKey, &ec_key.PublicKey} {
+		pkix, err := x509.MarshalPKIXPublicKey(publickey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ssh_publickey, err := ssh.NewPublicKey(publickey)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		formats := [][]byte{
+			pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pkix}),
+			ssh.MarshalAuthorizedKey(ssh_publickey),
+		}
+		if rsa_publickey, ok := publickey.(*rsa.PublicKey); ok {
+			formats = append(formats, pem.EncodeToMemory(&pem.Block{Type: "RSA PUBLIC KEY", Bytes: x509.MarshalPKCS1PublicKey(rsa_publickey)}))
+		}
+
+		var hash string
+		for i, format := range formats {
+			identity, err := MakeAbyssIdentity(format, "mallang")
+			if err != nil {
+				t.Fatal("failed to parse format " + string(format) + ": " + err.Error())
+			}
+			if i == 0 {
+				hash = identity.Hash
+			} else if identity.Hash != hash {
+				t.Fatal("hash differs between formats: " + string(format))
+			}
+		}
+
+		//the legacy block keeps the hash of its raw bytes
+		legacy, err := MakeAbyssIdentity(pem.EncodeToMemory(&pem.Block{Type: "OPENSSH PUBLIC KEY", Bytes: pkix}), "mallang")
+		if err != nil {
+			t.Fatal(err)
+		}
+		hashfunc := sha3.New256()
+		hashfunc.Write(pkix)
+		hashfunc.Write([]byte("mallang"))
+		if legacy.Hash != base58.Encode(hashfunc.Sum(nil)) {
+			t.Fatal("legacy hash changed")
+		}
+		if _, ok := publickey.(*rsa.PublicKey); ok {
+			//the documented exception: PKIX DER is not the PKCS#1 DER the other formats hash
+			if legacy.Hash == hash {
+				t.Fatal("legacy RSA hash unexpectedly matches the format-independent hash")
+			}
+		} else if legacy.Hash != hash {
+			t.Fatal("legacy hash differs for a non-RSA key")
+		}
+	}
+
+	p384_key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal("failed to generate ecdsa key pair")
+	}
+	pkix, err := x509.MarshalPKIXPublicKey(&p384_key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := MakeAbyssIdentity(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pkix}), "mallang"); err == nil {
+		t.Fatal("accepted unsupported curve")
+	}
+}
@@ -0,0 +1,246 @@
+package atype
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// scrypt parameters for newly encrypted key files. loaded files carry their own.
+const (
+	keystore_scrypt_n = 1 << 15
+	keystore_scrypt_r = 8
+	keystore_scrypt_p = 1
+)
+
+// upper bounds on the scrypt parameters of a loaded file, which would otherwise choose our memory and CPU use.
+const (
+	keystore_scrypt_max_n = 1 << 20
+	keystore_scrypt_max_r = 16
+	keystore_scrypt_max_p = 4
+
+	keystore_scrypt_max_memory = 256 << 20 //scrypt needs 128*N*r bytes
+)
+
+type AbyssPrivateIdentity struct {
+	Privatekey crypto.Signer
+	Name       string
+
+	Identity  AbyssIdentity   //public half, derived from Privatekey and Name. never directly write this
+	Rotations []AbyssRotation //previous identities of the same owner, oldest first. see RotateAbyssPrivateIdentity
+}
+
+func MakeAbyssPrivateIdentity(privatekey crypto.Signer, name string) (AbyssPrivateIdentity, error) {
+	var identity AbyssPrivateIdentity
+	identity.Privatekey = privatekey
+	identity.Name = name
+
+	pkix, err := x509.MarshalPKIXPublicKey(privatekey.Public())
+	if err != nil {
+		return identity, err
+	}
+	pemfile := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pkix})
+
+	identity.Identity, err = MakeAbyssIdentity(pemfile, name)
+	return identity, err
+}
+
+// new ed25519 identity
+func GenerateAbyssPrivateIdentity(name string) (AbyssPrivateIdentity, error) {
+	_, privatekey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return AbyssPrivateIdentity{}, err
+	}
+	return MakeAbyssPrivateIdentity(privatekey, name)
+}
+
+func keystoreKey(passphrase []byte, salt []byte, n int, r int, p int) (cipher.AEAD, error) {
+	key, err := scrypt.Key(passphrase, salt, n, r, p, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// PKCS#8 PEM. with a non-empty passphrase, the key is sealed with AES-256-GCM under a scrypt-derived key.
+// the name is stored in the Abyss-Name header (and authenticated, when encrypted).
+func EncodeAbyssPrivateIdentity(identity AbyssPrivateIdentity, passphrase []byte) ([]byte, error) {
+	if strings.ContainsAny(identity.Name, "\r\n") {
+		return nil, errors.New("name contains line break")
+	}
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(identity.Privatekey)
+	if err != nil {
+		return nil, err
+	}
+
+	//rotation history follows the key, in plain (it is public)
+	var rotation_blocks []byte
+	for _, rotation := range identity.Rotations {
+		rotation_json, err := EncodeAbyssRotation(rotation)
+		if err != nil {
+			return nil, err
+		}
+		rotation_blocks = append(rotation_blocks, pem.EncodeToMemory(&pem.Block{Type: "ABYSS IDENTITY ROTATION", Bytes: rotation_json})...)
+	}
+
+	if len(passphrase) == 0 {
+		return append(pem.EncodeToMemory(&pem.Block{
+			Type:    "PRIVATE KEY",
+			Headers: map[string]string{"Abyss-Name": identity.Name},
+			Bytes:   pkcs8,
+		}), rotation_blocks...), nil
+	}
+
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, err := keystoreKey(passphrase, salt, keystore_scrypt_n, keystore_scrypt_r, keystore_scrypt_p)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return append(pem.EncodeToMemory(&pem.Block{
+		Type: "ABYSS ENCRYPTED PRIVATE KEY",
+		Headers: map[string]string{
+			"Abyss-Name": identity.Name,
+			"KDF":        "scrypt",
+			"KDF-Params": strconv.Itoa(keystore_scrypt_n) + "," + strconv.Itoa(keystore_scrypt_r) + "," + strconv.Itoa(keystore_scrypt_p),
+			"Salt":       hex.EncodeToString(salt),
+			"Cipher":     "AES-256-GCM",
+			"Nonce":      hex.EncodeToString(nonce),
+		},
+		Bytes: aead.Seal(nil, nonce, pkcs8, []byte(identity.Name)),
+	}), rotation_blocks...), nil
+}
+
+func DecodeAbyssPrivateIdentity(pemfile []byte, passphrase []byte) (AbyssPrivateIdentity, error) {
+	block_p, rest := pem.Decode(pemfile)
+	if block_p == nil {
+		return AbyssPrivateIdentity{}, errors.New("invalid private key")
+	}
+	name, ok := block_p.Headers["Abyss-Name"]
+	if !ok {
+		return AbyssPrivateIdentity{}, errors.New("missing identity name")
+	}
+
+	var pkcs8 []byte
+	switch block_p.Type {
+	case "PRIVATE KEY":
+		pkcs8 = block_p.Bytes
+	case "ABYSS ENCRYPTED PRIVATE KEY":
+		if len(passphrase) == 0 {
+			return AbyssPrivateIdentity{}, errors.New("passphrase required")
+		}
+		if block_p.Headers["KDF"] != "scrypt" || block_p.Headers["Cipher"] != "AES-256-GCM" {
+			return AbyssPrivateIdentity{}, errors.New("unsupported key encryption")
+		}
+		params := strings.Split(block_p.Headers["KDF-Params"], ",")
+		if len(params) != 3 {
+			return AbyssPrivateIdentity{}, errors.New("invalid KDF parameters")
+		}
+		var kdf_params [3]int
+		for i, param := range params {
+			v, err := strconv.Atoi(param)
+			if err != nil {
+				return AbyssPrivateIdentity{}, errors.New("invalid KDF parameters")
+			}
+			kdf_params[i] = v
+		}
+		n, r, p := kdf_params[0], kdf_params[1], kdf_params[2]
+		if n <= 1 || n&(n-1) != 0 || r < 1 || p < 1 {
+			return AbyssPrivateIdentity{}, errors.New("invalid KDF parameters")
+		}
+		if n > keystore_scrypt_max_n || r > keystore_scrypt_max_r || p > keystore_scrypt_max_p || 128*n*r > keystore_scrypt_max_memory {
+			return AbyssPrivateIdentity{}, errors.New("KDF parameters too large")
+		}
+		salt, err := hex.DecodeString(block_p.Headers["Salt"])
+		if err != nil {
+			return AbyssPrivateIdentity{}, errors.New("invalid salt")
+		}
+		nonce, err := hex.DecodeString(block_p.Headers["Nonce"])
+		if err != nil {
+			return AbyssPrivateIdentity{}, errors.New("invalid nonce")
+		}
+		aead, err := keystoreKey(passphrase, salt, n, r, p)
+		if err != nil {
+			return AbyssPrivateIdentity{}, err
+		}
+		if len(nonce) != aead.NonceSize() {
+			return AbyssPrivateIdentity{}, errors.New("invalid nonce")
+		}
+		pkcs8, err = aead.Open(nil, nonce, block_p.Bytes, []byte(name))
+		if err != nil {
+			return AbyssPrivateIdentity{}, errors.New("wrong passphrase or corrupted key")
+		}
+	default:
+		return AbyssPrivateIdentity{}, errors.New("unsupported private key")
+	}
+
+	parsed_privatekey, err := x509.ParsePKCS8PrivateKey(pkcs8)
+	if err != nil {
+		return AbyssPrivateIdentity{}, err
+	}
+	signer, ok := parsed_privatekey.(crypto.Signer)
+	if !ok {
+		return AbyssPrivateIdentity{}, errors.New("unsupported private key")
+	}
+	identity, err := MakeAbyssPrivateIdentity(signer, name)
+	if err != nil {
+		return identity, err
+	}
+
+	for {
+		var rotation_block *pem.Block
+		rotation_block, rest = pem.Decode(rest)
+		if rotation_block == nil {
+			break
+		}
+		if rotation_block.Type != "ABYSS IDENTITY ROTATION" {
+			return AbyssPrivateIdentity{}, errors.New("unexpected pem block: " + rotation_block.Type)
+		}
+		rotation, err := DecodeAbyssRotation(rotation_block.Bytes)
+		if err != nil {
+			return AbyssPrivateIdentity{}, err
+		}
+		identity.Rotations = append(identity.Rotations, rotation)
+	}
+	if _, err := VerifyAbyssRotationChain(identity.Rotations, identity.Identity.Hash); err != nil {
+		return AbyssPrivateIdentity{}, err
+	}
+	return identity, nil
+}
+
+func SaveAbyssPrivateIdentity(path string, identity AbyssPrivateIdentity, passphrase []byte) error {
+	pemfile, err := EncodeAbyssPrivateIdentity(identity, passphrase)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, pemfile, 0600)
+}
+
+func LoadAbyssPrivateIdentity(path string, passphrase []byte) (AbyssPrivateIdentity, error) {
+	pemfile, err := os.ReadFile(path)
+	if err != nil {
+		return AbyssPrivateIdentity{}, err
+	}
+	return DecodeAbyssPrivateIdentity(pemfile, passphrase)
+}
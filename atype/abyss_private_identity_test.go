@@ -0,0 +1,108 @@
+package atype
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/pem"
+	"path/filepath"
+	"testing"
+)
+
+func TestAbyssPrivateIdentityKeystore(t *testing.T) {
+	identity, err := GenerateAbyssPrivateIdentity("mallang")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+
+	//plain
+	plain_path := filepath.Join(dir, "plain.pem")
+	if err := SaveAbyssPrivateIdentity(plain_path, identity, nil); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadAbyssPrivateIdentity(plain_path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Identity.Hash != identity.Identity.Hash || loaded.Name != "mallang" {
+		t.Fatal("plain identity mismatch")
+	}
+
+	//encrypted
+	enc_path := filepath.Join(dir, "enc.pem")
+	if err := SaveAbyssPrivateIdentity(enc_path, identity, []byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadAbyssPrivateIdentity(enc_path, nil); err == nil {
+		t.Fatal("loaded encrypted key without passphrase")
+	}
+	if _, err := LoadAbyssPrivateIdentity(enc_path, []byte("wrong")); err == nil {
+		t.Fatal("loaded encrypted key with wrong passphrase")
+	}
+	loaded, err = LoadAbyssPrivateIdentity(enc_path, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Identity.Hash != identity.Identity.Hash {
+		t.Fatal("encrypted identity mismatch")
+	}
+
+	//the derived identity can verify what the private identity signs
+	signature, err := SignAbyssMessage(loaded.Privatekey, []byte("message"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyAbyssSignature(identity.Identity, []byte("message"), signature); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAbyssPrivateIdentityKDFLimits(t *testing.T) {
+	identity, err := GenerateAbyssPrivateIdentity("mallang")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pemfile, err := EncodeAbyssPrivateIdentity(identity, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(pemfile)
+
+	//a crafted file must not make the loader allocate gigabytes
+	for _, params := range []string{"1073741824,8,1", "32768,1024,1", "32768,8,1000000", "1048576,16,1"} {
+		block.Headers["KDF-Params"] = params
+		if _, err := DecodeAbyssPrivateIdentity(pem.EncodeToMemory(block), []byte("secret")); err == nil {
+			t.Fatal("accepted KDF parameters " + params)
+		}
+	}
+
+	//degenerate values must fail cleanly instead of reaching scrypt
+	for _, params := range []string{"32768,0,1", "32768,8,0", "0,8,1", "1,8,1", "30000,8,1", "-32768,8,1", "32768,-8,1"} {
+		block.Headers["KDF-Params"] = params
+		if _, err := DecodeAbyssPrivateIdentity(pem.EncodeToMemory(block), []byte("secret")); err == nil {
+			t.Fatal("accepted KDF parameters " + params)
+		}
+	}
+}
+
+func TestAbyssPrivateIdentityRSA(t *testing.T) {
+	priv_key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal("failed to generate rsa key pair")
+	}
+	identity, err := MakeAbyssPrivateIdentity(priv_key, "mallang")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pemfile, err := EncodeAbyssPrivateIdentity(identity, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := DecodeAbyssPrivateIdentity(pemfile, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Identity.Hash != identity.Identity.Hash {
+		t.Fatal("rsa identity mismatch")
+	}
+}
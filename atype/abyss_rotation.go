@@ -0,0 +1,107 @@
+package atype
+
+import (
+	"crypto"
+	"encoding/json"
+	"errors"
+)
+
+// signed statement that the owner of Old moved to New. signed by the old key.
+type AbyssRotation struct {
+	Old       AbyssIdentity
+	New       AbyssIdentity
+	Signature []byte
+}
+
+type abyssRotationJson struct {
+	OldPublickey []byte
+	OldName      string
+	NewPublickey []byte
+	NewName      string
+	Signature    []byte
+}
+
+func makeRotationPayload(old_hash string, new_hash string) []byte {
+	return []byte("abyss identity rotation\n" + old_hash + "\n" + new_hash)
+}
+
+func MakeAbyssRotation(old AbyssPrivateIdentity, new AbyssIdentity) (AbyssRotation, error) {
+	signature, err := SignAbyssMessage(old.Privatekey, makeRotationPayload(old.Identity.Hash, new.Hash))
+	if err != nil {
+		return AbyssRotation{}, err
+	}
+	return AbyssRotation{old.Identity, new, signature}, nil
+}
+
+func VerifyAbyssRotation(rotation AbyssRotation) error {
+	if rotation.Old.Hash == rotation.New.Hash {
+		return errors.New("rotation to the same identity")
+	}
+	return VerifyAbyssSignature(rotation.Old, makeRotationPayload(rotation.Old.Hash, rotation.New.Hash), rotation.Signature)
+}
+
+// checks a rotation history, oldest first, that must end in current_hash.
+// returns the previous hashes, oldest first.
+func VerifyAbyssRotationChain(rotations []AbyssRotation, current_hash string) ([]string, error) {
+	previous_hashes := make([]string, 0, len(rotations))
+	for i, rotation := range rotations {
+		if err := VerifyAbyssRotation(rotation); err != nil {
+			return nil, err
+		}
+		if i+1 < len(rotations) && rotation.New.Hash != rotations[i+1].Old.Hash {
+			return nil, errors.New("broken rotation chain")
+		}
+		previous_hashes = append(previous_hashes, rotation.Old.Hash)
+	}
+	if len(rotations) != 0 && rotations[len(rotations)-1].New.Hash != current_hash {
+		return nil, errors.New("rotation chain does not end in current identity")
+	}
+	return previous_hashes, nil
+}
+
+func EncodeAbyssRotation(rotation AbyssRotation) ([]byte, error) {
+	return json.Marshal(abyssRotationJson{
+		OldPublickey: rotation.Old.Publickey,
+		OldName:      rotation.Old.Name,
+		NewPublickey: rotation.New.Publickey,
+		NewName:      rotation.New.Name,
+		Signature:    rotation.Signature,
+	})
+}
+
+// the signature is verified.
+func DecodeAbyssRotation(data []byte) (AbyssRotation, error) {
+	var parsed abyssRotationJson
+	if err := json.Unmarshal(data, &parsed); err != nil {
+		return AbyssRotation{}, err
+	}
+	var rotation AbyssRotation
+	var err error
+	rotation.Old, err = MakeAbyssIdentity(parsed.OldPublickey, parsed.OldName)
+	if err != nil {
+		return AbyssRotation{}, err
+	}
+	rotation.New, err = MakeAbyssIdentity(parsed.NewPublickey, parsed.NewName)
+	if err != nil {
+		return AbyssRotation{}, err
+	}
+	rotation.Signature = parsed.Signature
+	if err := VerifyAbyssRotation(rotation); err != nil {
+		return AbyssRotation{}, err
+	}
+	return rotation, nil
+}
+
+// new private identity that carries the history of old, plus the rotation from old.
+func RotateAbyssPrivateIdentity(old AbyssPrivateIdentity, new_privatekey crypto.Signer, new_name string) (AbyssPrivateIdentity, error) {
+	result, err := MakeAbyssPrivateIdentity(new_privatekey, new_name)
+	if err != nil {
+		return result, err
+	}
+	rotation, err := MakeAbyssRotation(old, result.Identity)
+	if err != nil {
+		return result, err
+	}
+	result.Rotations = append(append(make([]AbyssRotation, 0, len(old.Rotations)+1), old.Rotations...), rotation)
+	return result, nil
+}
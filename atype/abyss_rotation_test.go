@@ -0,0 +1,80 @@
+package atype
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"path/filepath"
+	"testing"
+)
+
+func TestAbyssRotation(t *testing.T) {
+	id1, err := GenerateAbyssPrivateIdentity("mallang")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, key2, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id2, err := RotateAbyssPrivateIdentity(id1, key2, "mallang")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, key3, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id3, err := RotateAbyssPrivateIdentity(id2, key3, "mallang2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	previous, err := VerifyAbyssRotationChain(id3.Rotations, id3.Identity.Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(previous) != 2 || previous[0] != id1.Identity.Hash || previous[1] != id2.Identity.Hash {
+		t.Fatal("previous hashes not match")
+	}
+
+	//encoding
+	encoded, err := EncodeAbyssRotation(id3.Rotations[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := DecodeAbyssRotation(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Old.Hash != id2.Identity.Hash || decoded.New.Hash != id3.Identity.Hash {
+		t.Fatal("decoded rotation not match")
+	}
+
+	//keystore keeps the history
+	path := filepath.Join(t.TempDir(), "id3.pem")
+	if err := SaveAbyssPrivateIdentity(path, id3, nil); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadAbyssPrivateIdentity(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.Rotations) != 2 || loaded.Rotations[0].Old.Hash != id1.Identity.Hash {
+		t.Fatal("rotations lost in keystore")
+	}
+
+	//forgery: a rotation signed by the wrong key
+	forged := id3.Rotations[1]
+	forged.Old = id1.Identity
+	if VerifyAbyssRotation(forged) == nil {
+		t.Fatal("forged rotation accepted")
+	}
+
+	//broken chain
+	if _, err := VerifyAbyssRotationChain(id3.Rotations[1:], id2.Identity.Hash); err == nil {
+		t.Fatal("chain with wrong end accepted")
+	}
+	if _, err := VerifyAbyssRotationChain([]AbyssRotation{id3.Rotations[1], id3.Rotations[0]}, id3.Identity.Hash); err == nil {
+		t.Fatal("unordered chain accepted")
+	}
+}
@@ -2,20 +2,22 @@ module abyss
 
 go 1.22.1
 
-require github.com/google/uuid v1.6.0
+require (
+	github.com/btcsuite/btcutil v1.0.2
+	github.com/google/uuid v1.6.0
+	github.com/quic-go/quic-go v0.43.1
+	golang.org/x/crypto v0.24.0
+	golang.org/x/exp v0.0.0-20240613232115-7f521ea00fb8
+	gonum.org/v1/gonum v0.15.0
+)
 
 require (
-	github.com/btcsuite/btcutil v1.0.2 // indirect
 	github.com/go-task/slim-sprig v0.0.0-20230315185526-52ccab3ef572 // indirect
 	github.com/google/pprof v0.0.0-20210407192527-94a9f03dee38 // indirect
 	github.com/onsi/ginkgo/v2 v2.9.5 // indirect
-	github.com/quic-go/quic-go v0.43.1 // indirect
 	go.uber.org/mock v0.4.0 // indirect
-	golang.org/x/crypto v0.24.0 // indirect
-	golang.org/x/exp v0.0.0-20240613232115-7f521ea00fb8 // indirect
 	golang.org/x/mod v0.18.0 // indirect
 	golang.org/x/net v0.26.0 // indirect
 	golang.org/x/sys v0.21.0 // indirect
 	golang.org/x/tools v0.22.0 // indirect
-	gonum.org/v1/gonum v0.15.0 // indirect
 )